@@ -6,7 +6,7 @@ import (
 	"log"       // For logging messages
 	"os"        // For OS functionality like signals
 	"os/signal" // For signal handling
-	"sync"      // For synchronization primitives
+	"strconv"   // For parsing the inherited listener descriptor
 	"syscall"   // For system call constants
 
 	// Project imports
@@ -14,32 +14,77 @@ import (
 )
 
 func main() {
-	// Create wait group to track all goroutines
-	var wg sync.WaitGroup
-
 	// Setup context that will be cancelled on SIGINT or SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop() // Ensure context cancellation function is called
+	// An upgrade hands the listener to a new process and then stops this one
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Load settings from the config file named by PROXY_CONFIG_FILE, if any
+	var options []proxy.Option
+	configFile := os.Getenv("PROXY_CONFIG_FILE")
+	if configFile != "" {
+		options = append(options, proxy.WithConfigFile(configFile))
+	}
+	// A process started by an upgrade adopts its predecessor's listening socket
+	if fd := os.Getenv(inheritedFDEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", inheritedFDEnv, err)
+		}
+		options = append(options, proxy.WithInheritedListener(uintptr(n)))
+	}
 	// Initialize the proxy server with configured addresses
-	proxyServer, proxyError := proxy.CreateProxy()
+	proxyServer, proxyError := proxy.CreateProxy(options...)
 	if proxyError != nil {
 		//nolint:gocritic
 		log.Fatalf("Failed to create proxy server: %v", proxyError)
 	}
-	// Add to wait group before starting the goroutine
-	wg.Add(1)
-
-	// Start the proxy server in a separate goroutine
+	log.Printf("Effective config: %s", proxyServer.ConfigString())
+	// On SIGHUP re-read the config file and the TLS certificate without dropping connections
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	upgrade := notifyUpgrade()
+	defer signal.Stop(upgrade)
 	go func() {
-		// Run the proxy until context is cancelled or error occurs
-		if err := proxyServer.Run(ctx, &wg); err != nil {
-			log.Printf("Proxy server error: %v", err)
-			stop() // Cancel context on error
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-upgrade:
+				if err := startUpgrade(proxyServer); err != nil {
+					log.Printf("Failed to start upgraded process: %v", err)
+					continue
+				}
+				// The new process accepts from now on; finish the connections already here
+				log.Printf("Upgraded process started, draining connections")
+				cancel()
+				return
+			case <-reload:
+				if configFile != "" {
+					if err := proxyServer.Reload(options...); err != nil {
+						log.Printf("Failed to reload config: %v", err)
+					} else {
+						log.Printf("Config reloaded")
+					}
+				}
+				// Without TLS there is no certificate to re-read
+				if !proxyServer.Config().TLSEnabled {
+					continue
+				}
+				if err := proxyServer.ReloadCert(); err != nil {
+					log.Printf("Failed to reload certificate: %v", err)
+					continue
+				}
+				log.Printf("Certificate reloaded")
+			}
 		}
 	}()
-	// Block until context is cancelled (by signal or error)
-	<-ctx.Done()
 
-	// Wait for all goroutines to complete before exiting
-	wg.Wait()
+	// Run the proxy until context is cancelled (by signal) or an error occurs,
+	// then wait for all connections to complete before exiting
+	if err := proxyServer.ListenAndServe(ctx); err != nil {
+		log.Printf("Proxy server error: %v", err)
+	}
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/ev-gor/tcp-reverse-proxy/internal/proxy"
+)
+
+// inheritedFDEnv tells a process started by an upgrade which descriptor holds the listener
+const inheritedFDEnv = "PROXY_INHERITED_FD"
+
+// startUpgrade starts a new copy of this binary, with the same arguments and
+// environment, that takes over the listening socket
+func startUpgrade(proxyServer *proxy.Proxy) error {
+	f, err := proxyServer.ListenerFile()
+	if err != nil {
+		return err
+	}
+	// The new process has its own copy once it has started
+	defer f.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles[0] becomes descriptor 3 in the new process
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), inheritedFDEnv+"=3")
+	return cmd.Start()
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyUpgrade returns a channel that never receives, since there is no SIGUSR2 here
+func notifyUpgrade() chan os.Signal {
+	return make(chan os.Signal, 1)
+}
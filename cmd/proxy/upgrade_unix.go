@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyUpgrade returns a channel that receives SIGUSR2, which starts an upgrade
+func notifyUpgrade() chan os.Signal {
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+	return upgrade
+}
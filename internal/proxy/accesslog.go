@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects how access log lines are written
+type AccessLogFormat int
+
+const (
+	// AccessLogPlain writes space-separated key=value pairs
+	AccessLogPlain AccessLogFormat = iota
+	// AccessLogJSON writes one JSON object per line
+	AccessLogJSON
+)
+
+// Close reasons for connections that weren't cut short by an error
+const (
+	reasonClosed   = "closed"
+	reasonShutdown = "shutdown"
+)
+
+// accessLogEntry summarises one finished connection
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ConnID     uint64    `json:"conn_id,omitempty"`
+	Client     string    `json:"client"`
+	Backend    string    `json:"backend,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Reason     string    `json:"reason"`
+	// Set only for TLS clients verified with WithClientCAs
+	ClientCertSubject     string `json:"client_cert_subject,omitempty"`
+	ClientCertSerial      string `json:"client_cert_serial,omitempty"`
+	ClientCertFingerprint string `json:"client_cert_fingerprint,omitempty"`
+	// Set only for TLS clients
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+	TLSServerName  string `json:"tls_server_name,omitempty"`
+}
+
+// accessLogger writes one line per connection, serialising writes from concurrent connections
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format AccessLogFormat
+}
+
+func (l *accessLogger) log(entry accessLogEntry) error {
+	var line []byte
+	switch l.format {
+	case AccessLogJSON:
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("encode access log entry: %w", err)
+		}
+		line = append(b, '\n')
+	default:
+		line = fmt.Appendf(nil, "%s conn_id=%d client=%s backend=%s duration_ms=%.3f bytes_in=%d bytes_out=%d reason=%q",
+			entry.Time.Format(time.RFC3339Nano), entry.ConnID, entry.Client, entry.Backend,
+			entry.DurationMS, entry.BytesIn, entry.BytesOut, entry.Reason)
+		if entry.ClientCertSubject != "" {
+			line = fmt.Appendf(line, " client_cert_subject=%q client_cert_serial=%s client_cert_fingerprint=%s",
+				entry.ClientCertSubject, entry.ClientCertSerial, entry.ClientCertFingerprint)
+		}
+		if entry.TLSVersion != "" {
+			line = fmt.Appendf(line, " tls_version=%q tls_cipher_suite=%s tls_server_name=%s",
+				entry.TLSVersion, entry.TLSCipherSuite, entry.TLSServerName)
+		}
+		line = append(line, '\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccessLoggerPlain(t *testing.T) {
+	var buf bytes.Buffer
+	l := &accessLogger{w: &buf}
+	err := l.log(accessLogEntry{
+		Time:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		ConnID:     3,
+		Client:     "192.0.2.1:1234",
+		Backend:    "127.0.0.1:9000",
+		DurationMS: 1.5,
+		BytesIn:    10,
+		BytesOut:   20,
+		Reason:     reasonClosed,
+	})
+	if err != nil {
+		t.Fatalf("log() failed: %v", err)
+	}
+	want := `2024-01-02T03:04:05Z conn_id=3 client=192.0.2.1:1234 backend=127.0.0.1:9000 duration_ms=1.500 bytes_in=10 bytes_out=20 reason="closed"` + "\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestHandleAccessLog(t *testing.T) {
+	t.Run("relayed connection", func(t *testing.T) {
+		var buf bytes.Buffer
+		backendAddr := startEchoBackend(t, "")
+		p := newTestProxy(t, WithBackendAddr(backendAddr), WithAccessLog(&buf), WithAccessLogFormat(AccessLogJSON))
+
+		clientConn, proxyConn := net.Pipe()
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go p.handle(withConnID(ctx, 5), proxyConn, &wg)
+
+		go clientConn.Write([]byte("ping"))
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(clientConn, make([]byte, 4)); err != nil {
+			t.Fatalf("Failed to read from proxy: %v", err)
+		}
+		clientConn.Close()
+		wg.Wait()
+
+		var entry accessLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("failed to parse access log line %q: %v", buf.String(), err)
+		}
+		if entry.ConnID != 5 || entry.Backend != backendAddr || entry.BytesIn != 4 || entry.BytesOut != 4 || entry.Reason != reasonClosed {
+			t.Errorf("unexpected access log entry %+v", entry)
+		}
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		var buf bytes.Buffer
+		p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithAccessLog(&buf))
+
+		clientConn, proxyConn := net.Pipe()
+		defer clientConn.Close()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		p.handle(t.Context(), proxyConn, &wg)
+
+		if !strings.Contains(buf.String(), `reason="backend dial failed"`) {
+			t.Errorf("expected dial failure reason in %q", buf.String())
+		}
+		if strings.Count(buf.String(), "\n") != 1 {
+			t.Errorf("expected exactly one access log line, got %q", buf.String())
+		}
+	})
+}
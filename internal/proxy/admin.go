@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	adminShutdownTimeout = 5 * time.Second
+	// readyDialTimeout bounds the backend check behind /readyz
+	readyDialTimeout = time.Second
+	// maxMaintenanceMessage caps the message accepted by PUT /maintenance
+	maxMaintenanceMessage = 64 << 10
+)
+
+// startAdmin binds the admin HTTP server and serves it until ctx is cancelled.
+// Its goroutines are tracked by wg.
+func (p *Proxy) startAdmin(ctx context.Context, wg *sync.WaitGroup) error {
+	listener, err := net.Listen("tcp", p.config.adminAddr)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBind, err)
+	}
+	p.addrMu.Lock()
+	p.adminAddr = listener.Addr()
+	p.addrMu.Unlock()
+	p.logger.Info("admin http listening", "addr", listener.Addr())
+
+	srv := &http.Server{Handler: p.adminHandler(), ReadHeaderTimeout: readyDialTimeout}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.logger.Error("admin http server failed", "error", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		//nolint:errcheck
+		srv.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+// adminHandler serves /healthz, which succeeds once the proxy is listening and reports
+// its start time and uptime, /readyz, which additionally requires the backend to
+// accept a connection and the proxy to be out of maintenance mode, and /maintenance,
+// where GET reports maintenance mode. Only with an admin token are PUT, which switches
+// it on with the request body as the message, and DELETE, which switches it off,
+// served too, and then only to requests bearing the token.
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if !p.isListening() {
+			http.Error(w, "not listening", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok\nstarted_at: %s\nuptime: %s\n", p.StartedAt().Format(time.RFC3339), p.Uptime().Round(time.Second))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !p.isListening() {
+			http.Error(w, "not listening", http.StatusServiceUnavailable)
+			return
+		}
+		if p.InMaintenance() {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if err := p.checkBackend(r.Context()); err != nil {
+			http.Error(w, "backend unreachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /maintenance", func(w http.ResponseWriter, _ *http.Request) {
+		if p.InMaintenance() {
+			fmt.Fprintln(w, "on")
+			return
+		}
+		fmt.Fprintln(w, "off")
+	})
+	token := p.config.adminToken
+	if token == "" {
+		return mux
+	}
+	mux.HandleFunc("PUT /maintenance", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMaintenanceMessage))
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, "read message: "+err.Error(), status)
+			return
+		}
+		p.SetMaintenance(true, message)
+		fmt.Fprintln(w, "on")
+	}))
+	mux.HandleFunc("DELETE /maintenance", requireToken(token, func(w http.ResponseWriter, _ *http.Request) {
+		p.SetMaintenance(false, nil)
+		fmt.Fprintln(w, "off")
+	}))
+	return mux
+}
+
+// requireToken only passes on requests with an "Authorization: Bearer <token>" header
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (p *Proxy) isListening() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkBackend dials the configured backend and hangs up. CONNECT and SOCKS5
+// clients pick their own targets, so there is nothing to check in those modes.
+func (p *Proxy) checkBackend(ctx context.Context) error {
+	cfg := p.loadConfig()
+	if cfg.connectMode || cfg.socks5Mode {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyDialTimeout)
+	defer cancel()
+	network := backendNetwork(cfg)
+	if cfg.udp {
+		network = udpNetwork(cfg)
+	}
+	conn, err := backendDialer(cfg).DialContext(ctx, network, cfg.backendAddr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
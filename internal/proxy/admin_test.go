@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminHTTP(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr), WithAdminHTTP("127.0.0.1:0"))
+
+	// Before Run nothing is listening yet
+	rec := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz before Run = %d, want 503", rec.Code)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go p.Run(ctx)
+	<-p.Ready()
+	p.addrMu.Lock()
+	adminURL := "http://" + p.adminAddr.String()
+	p.addrMu.Unlock()
+
+	get := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(adminURL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := get("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", got)
+	}
+	rec = httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if body := rec.Body.String(); !strings.HasPrefix(body, "ok\n") || !strings.Contains(body, "started_at: "+p.StartedAt().Format(time.RFC3339)) || !strings.Contains(body, "uptime: ") {
+		t.Errorf("/healthz body = %q, want ok with the start time and uptime", body)
+	}
+	if got := get("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz = %d, want 200", got)
+	}
+
+	// Nothing listens on port 1, so the proxy is alive but not ready
+	if err := p.Reload(WithBackendAddr("127.0.0.1:1")); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if got := get("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz = %d with the backend down, want 200", got)
+	}
+	if got := get("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %d with the backend down, want 503", got)
+	}
+
+	cancel()
+	p.Wait()
+	if resp, err := http.Get(adminURL + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Error("admin server still serving after shutdown")
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// backendPoolRefillInterval is how often the pool is topped up and expired
+	// connections are dropped when nothing wakes it sooner
+	backendPoolRefillInterval = time.Second
+	// aliveCheckTimeout is how long a borrowed connection is read from to see if it is still open
+	aliveCheckTimeout = time.Millisecond
+)
+
+// backendPool keeps pre-dialed idle connections per backend address so handle
+// can skip the dial. A borrowed connection carries one client's byte stream and
+// is closed with it; the pool dials a replacement in the background.
+type backendPool struct {
+	size    int
+	maxIdle time.Duration
+	dial    func(ctx context.Context, addr string) (net.Conn, error)
+	// wake asks maintain to top up the pool after a borrow
+	wake chan struct{}
+
+	mu       sync.Mutex
+	backends map[string]*poolBackend
+}
+
+type poolBackend struct {
+	idle     []idleConn // oldest first
+	lastUsed time.Time
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func newBackendPool(size int, maxIdle time.Duration, dial func(ctx context.Context, addr string) (net.Conn, error)) *backendPool {
+	return &backendPool{
+		size:     size,
+		maxIdle:  maxIdle,
+		dial:     dial,
+		wake:     make(chan struct{}, 1),
+		backends: make(map[string]*poolBackend),
+	}
+}
+
+// warm registers addr so maintain fills its pool before the first client arrives
+func (b *backendPool) warm(addr string) {
+	b.mu.Lock()
+	if _, ok := b.backends[addr]; !ok {
+		b.backends[addr] = &poolBackend{lastUsed: time.Now()}
+	}
+	b.mu.Unlock()
+	b.signal()
+}
+
+// get returns a healthy idle connection to addr, or nil if there is none.
+// Connections that have expired or been closed by the backend are discarded.
+func (b *backendPool) get(addr string) net.Conn {
+	defer b.signal()
+	for {
+		b.mu.Lock()
+		backend, ok := b.backends[addr]
+		if !ok {
+			backend = &poolBackend{}
+			b.backends[addr] = backend
+		}
+		backend.lastUsed = time.Now()
+		if len(backend.idle) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		// The newest connection is the least likely to have been dropped
+		idle := backend.idle[len(backend.idle)-1]
+		backend.idle = backend.idle[:len(backend.idle)-1]
+		b.mu.Unlock()
+
+		if time.Since(idle.since) < b.maxIdle && connAlive(idle.conn) {
+			return idle.conn
+		}
+		//nolint:errcheck
+		idle.conn.Close()
+	}
+}
+
+func (b *backendPool) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// maintain keeps every backend's pool topped up and drops expired connections
+// until ctx is done, then closes whatever is left idle. Backends that haven't
+// been borrowed from for maxIdle are forgotten.
+func (b *backendPool) maintain(ctx context.Context, onDialError func(addr string, err error)) {
+	defer b.closeIdle()
+	ticker := time.NewTicker(min(backendPoolRefillInterval, b.maxIdle))
+	defer ticker.Stop()
+	for {
+		for _, addr := range b.expire() {
+			b.fill(ctx, addr, onDialError)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// expire closes idle connections older than maxIdle and returns the addresses still in use
+func (b *backendPool) expire() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var addrs []string
+	for addr, backend := range b.backends {
+		fresh := backend.idle[:0]
+		for _, idle := range backend.idle {
+			if time.Since(idle.since) < b.maxIdle {
+				fresh = append(fresh, idle)
+				continue
+			}
+			//nolint:errcheck
+			idle.conn.Close()
+		}
+		backend.idle = fresh
+		if len(backend.idle) == 0 && time.Since(backend.lastUsed) >= b.maxIdle {
+			delete(b.backends, addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// fill dials addr until its pool is full, stopping at the first failure
+func (b *backendPool) fill(ctx context.Context, addr string, onDialError func(addr string, err error)) {
+	for b.missing(addr) > 0 {
+		conn, err := b.dial(ctx, addr)
+		if err != nil {
+			if ctx.Err() == nil {
+				onDialError(addr, err)
+			}
+			return
+		}
+		b.mu.Lock()
+		backend, ok := b.backends[addr]
+		if !ok || len(backend.idle) >= b.size {
+			b.mu.Unlock()
+			//nolint:errcheck
+			conn.Close()
+			return
+		}
+		backend.idle = append(backend.idle, idleConn{conn: conn, since: time.Now()})
+		b.mu.Unlock()
+	}
+}
+
+func (b *backendPool) missing(addr string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	backend, ok := b.backends[addr]
+	if !ok {
+		return 0
+	}
+	return b.size - len(backend.idle)
+}
+
+func (b *backendPool) closeIdle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for addr, backend := range b.backends {
+		for _, idle := range backend.idle {
+			//nolint:errcheck
+			idle.conn.Close()
+		}
+		delete(b.backends, addr)
+	}
+}
+
+// connAlive checks an idle connection by reading with a short deadline. A healthy
+// connection times out; EOF means the backend hung up, and any data is unexpected
+// for a connection nobody has written to yet. Records TLS handles itself, such as
+// session tickets, are consumed by the read without surfacing.
+func connAlive(conn net.Conn) bool {
+	// A deadline already in the past would fail the read before it looked at the socket
+	if err := conn.SetReadDeadline(time.Now().Add(aliveCheckTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	if _, err := conn.Read(b[:]); !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
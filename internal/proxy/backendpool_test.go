@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idleCount returns how many connections the pool holds for addr
+func idleCount(b *backendPool, addr string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if backend, ok := b.backends[addr]; ok {
+		return len(backend.idle)
+	}
+	return 0
+}
+
+func TestBackendPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	var dialer net.Dialer
+	pool := newBackendPool(2, time.Minute, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pool.maintain(ctx, func(addr string, err error) { t.Errorf("dial %s failed: %v", addr, err) })
+	}()
+
+	pool.warm(addr)
+	waitFor(t, func() bool { return idleCount(pool, addr) == 2 })
+	if got := idleCount(pool, addr); got != 2 {
+		t.Fatalf("pool holds %d connections, want 2", got)
+	}
+
+	conn := pool.get(addr)
+	if conn == nil {
+		t.Fatal("get() returned nil from a full pool")
+	}
+	conn.Close()
+	// The borrowed connection is replaced
+	waitFor(t, func() bool { return idleCount(pool, addr) == 2 })
+	if got := idleCount(pool, addr); got != 2 {
+		t.Errorf("pool holds %d connections after a borrow, want 2", got)
+	}
+
+	cancel()
+	<-done
+	if got := idleCount(pool, addr); got != 0 {
+		t.Errorf("pool holds %d connections after shutdown, want 0", got)
+	}
+}
+
+func TestBackendPoolHealthCheck(t *testing.T) {
+	pool := newBackendPool(2, time.Minute, nil)
+	healthy, healthyServer := tcpPair(t)
+	defer healthyServer.Close()
+	dead, deadServer := tcpPair(t)
+	deadServer.Close()
+	time.Sleep(10 * time.Millisecond)
+	pool.backends["backend"] = &poolBackend{idle: []idleConn{
+		{conn: healthy, since: time.Now()},
+		{conn: dead, since: time.Now()},
+	}}
+
+	// The dead connection is newest, so it is checked and discarded first
+	conn := pool.get("backend")
+	if conn != healthy {
+		t.Fatalf("get() = %v, want the healthy connection", conn)
+	}
+	defer conn.Close()
+	if _, err := dead.Write([]byte("x")); err == nil {
+		t.Error("expected the dead connection to be closed")
+	}
+	// The health check leaves no deadline behind
+	go healthyServer.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "pong" {
+		t.Errorf("got %q (err: %v) from the borrowed connection", buf, err)
+	}
+	if conn := pool.get("backend"); conn != nil {
+		t.Errorf("get() = %v from an empty pool, want nil", conn)
+	}
+}
+
+func TestBackendPoolMaxIdle(t *testing.T) {
+	pool := newBackendPool(1, 50*time.Millisecond, nil)
+	client, server := tcpPair(t)
+	defer server.Close()
+	pool.backends["backend"] = &poolBackend{
+		idle:     []idleConn{{conn: client, since: time.Now().Add(-time.Second)}},
+		lastUsed: time.Now().Add(-time.Second),
+	}
+
+	// An expired connection is closed and the unused backend forgotten
+	if addrs := pool.expire(); len(addrs) != 0 {
+		t.Errorf("expire() kept %v, want nothing", addrs)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("expected the expired connection to be closed")
+	}
+	if len(pool.backends) != 0 {
+		t.Errorf("expected the idle backend to be forgotten, got %v", pool.backends)
+	}
+}
+
+func TestProxy_BackendPool(t *testing.T) {
+	dialer := &recordingDialer{}
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr), WithDialer(dialer), WithBackendPool(1))
+
+	defer p.Wait()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-p.Ready()
+
+	// The pool dials before any client connects
+	waitFor(t, func() bool { return idleCount(p.backendPool, backendAddr) == 1 })
+	if got := idleCount(p.backendPool, backendAddr); got != 1 {
+		t.Fatalf("pool holds %d connections, want 1", got)
+	}
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	echo(t, conn, "ping")
+	dials := func() int {
+		dialer.mu.Lock()
+		defer dialer.mu.Unlock()
+		return len(dialer.addrs)
+	}
+	waitFor(t, func() bool { return dials() >= 2 })
+	if got := dials(); got != 2 {
+		t.Errorf("dialed %d times, want the pooled dial plus its replacement", got)
+	}
+}
+
+func TestWithBackendPoolValidation(t *testing.T) {
+	if _, err := CreateProxy(WithBackendPool(-1)); err == nil {
+		t.Error("expected error for negative backend pool size")
+	}
+	if _, err := CreateProxy(WithBackendPoolMaxIdle(0)); err == nil {
+		t.Error("expected error for zero backend pool max idle")
+	}
+	_, err := CreateProxy(WithBackendPool(2), WithConnectMode(true))
+	if err == nil || !strings.Contains(err.Error(), "backend pool") {
+		t.Errorf("expected backend pool error in connect mode, got %v", err)
+	}
+}
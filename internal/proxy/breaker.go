@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops dialing a backend after repeated failures. Once a backend
+// has failed the configured number of times within the window its circuit opens
+// and clients are turned away without a dial. After the cooldown a single probe
+// connection is let through: success closes the circuit, failure reopens it.
+type circuitBreaker struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	backends map[string]*breakerState
+}
+
+type breakerState struct {
+	// recent holds the times of failures within the window, oldest first
+	recent   []time.Time
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(failures int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failures: failures,
+		window:   window,
+		cooldown: cooldown,
+		backends: make(map[string]*breakerState),
+	}
+}
+
+// allow reports whether a connection to backend may be attempted
+func (b *circuitBreaker) allow(backend string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.backends[backend]
+	if !ok || !state.open {
+		return true
+	}
+	if state.probing || time.Since(state.openedAt) < b.cooldown {
+		return false
+	}
+	state.probing = true
+	return true
+}
+
+// success closes the circuit for backend and forgets its failures
+func (b *circuitBreaker) success(backend string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.backends, backend)
+}
+
+// failure records a failed connection to backend, opening its circuit if needed.
+// It reports whether this failure opened a circuit that was closed.
+func (b *circuitBreaker) failure(backend string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.backends[backend]
+	if !ok {
+		state = &breakerState{}
+		b.backends[backend] = state
+	}
+	now := time.Now()
+	if state.probing {
+		state.probing = false
+		state.openedAt = now
+		return false
+	}
+	cutoff := now.Add(-b.window)
+	for len(state.recent) > 0 && state.recent[0].Before(cutoff) {
+		state.recent = state.recent[1:]
+	}
+	state.recent = append(state.recent, now)
+	if len(state.recent) >= b.failures {
+		opened := !state.open
+		state.open = true
+		state.openedAt = now
+		state.recent = nil
+		return opened
+	}
+	return false
+}
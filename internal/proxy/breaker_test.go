@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute, 50*time.Millisecond)
+	const backend = "127.0.0.1:9000"
+
+	if b.failure(backend) {
+		t.Fatal("expected failure below the threshold not to report an opened circuit")
+	}
+	if !b.allow(backend) {
+		t.Fatal("expected circuit to stay closed below the failure threshold")
+	}
+	if !b.failure(backend) {
+		t.Fatal("expected the failure at the threshold to report an opened circuit")
+	}
+	if b.allow(backend) {
+		t.Fatal("expected circuit to open at the failure threshold")
+	}
+	if !b.allow("127.0.0.1:9001") {
+		t.Fatal("expected other backends to be unaffected")
+	}
+
+	// After the cooldown exactly one probe is let through
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow(backend) {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if b.allow(backend) {
+		t.Fatal("expected only one probe at a time")
+	}
+
+	// A failed probe reopens the circuit for another cooldown
+	if b.failure(backend) {
+		t.Fatal("expected a failed probe not to report a newly opened circuit")
+	}
+	if b.allow(backend) {
+		t.Fatal("expected circuit to reopen after a failed probe")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow(backend) {
+		t.Fatal("expected a probe after the second cooldown")
+	}
+
+	// A successful probe closes it
+	b.success(backend)
+	if !b.allow(backend) || !b.allow(backend) {
+		t.Fatal("expected circuit to close after a successful probe")
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := newCircuitBreaker(2, 50*time.Millisecond, time.Minute)
+	const backend = "127.0.0.1:9000"
+
+	// Failures further apart than the window don't add up
+	b.failure(backend)
+	time.Sleep(60 * time.Millisecond)
+	b.failure(backend)
+	if !b.allow(backend) {
+		t.Fatal("expected failures outside the window to be forgotten")
+	}
+}
+
+func TestHandleCircuitBreaker(t *testing.T) {
+	dialer := &recordingDialer{}
+	// Nothing listens on port 1, so every dial fails
+	p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithDialer(dialer), WithCircuitBreaker(2, time.Minute, time.Minute))
+
+	for range 3 {
+		clientConn, proxyConn := net.Pipe()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		p.handle(t.Context(), proxyConn, &wg)
+		clientConn.Close()
+	}
+	if got := len(dialer.addrs); got != 2 {
+		t.Errorf("dialed %d times, want 2 before the circuit opened", got)
+	}
+	if got := p.Stats().DialErrors; got != 2 {
+		t.Errorf("DialErrors = %d, want 2", got)
+	}
+	if got := p.Stats().Rejected.CircuitOpen; got != 1 {
+		t.Errorf("Rejected.CircuitOpen = %d, want 1", got)
+	}
+}
+
+func TestHandleDrainOnUnhealthy(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	var dials atomic.Int64
+	// The first dial reaches the backend, every later one fails and opens the circuit
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		return nil, errors.New("backend down")
+	})
+	p := newTestProxy(t, WithBackendAddr(backendAddr), WithDialer(dialer),
+		WithCircuitBreaker(1, time.Minute, time.Minute), WithDrainOnUnhealthy(true))
+
+	var wg sync.WaitGroup
+	established, proxyConn := net.Pipe()
+	defer established.Close()
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+	echo(t, established, "ping")
+
+	failing, proxyConn := net.Pipe()
+	defer failing.Close()
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+
+	established.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := established.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the established connection to be closed when the circuit opened, got %v", err)
+	}
+	wg.Wait()
+}
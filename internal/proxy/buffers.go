@@ -0,0 +1,62 @@
+package proxy
+
+import "sync"
+
+// bufferPool hands out relay buffers for one direction. Buffers are pooled as
+// *[]byte so Put doesn't allocate.
+type bufferPool struct {
+	// size returns the current buffer size in bytes, which Reload may change
+	size func() int
+	pool sync.Pool
+	// free replaces pool when WithBufferPoolMax caps it
+	free chan *[]byte
+}
+
+func newBufferPool(size func() int, max int) *bufferPool {
+	b := &bufferPool{size: size}
+	b.pool.New = func() any {
+		buf := make([]byte, b.size())
+		return &buf
+	}
+	if max > 0 {
+		b.free = make(chan *[]byte, max)
+	}
+	return b
+}
+
+// get returns a pooled buffer of the current size. Buffers sized for a
+// previous config are replaced rather than handed out.
+func (b *bufferPool) get() *[]byte {
+	var bufPtr *[]byte
+	if b.free != nil {
+		select {
+		case bufPtr = <-b.free:
+		default:
+			buf := make([]byte, b.size())
+			bufPtr = &buf
+		}
+	} else {
+		bufPtr = b.pool.Get().(*[]byte)
+	}
+	if size := b.size(); len(*bufPtr) != size {
+		*bufPtr = make([]byte, size)
+	}
+	return bufPtr
+}
+
+// put returns a buffer to the pool. A capped pool that is already full drops it.
+func (b *bufferPool) put(bufPtr *[]byte) {
+	if b.free == nil {
+		b.pool.Put(bufPtr)
+		return
+	}
+	select {
+	case b.free <- bufPtr:
+	default:
+	}
+}
+
+// idle returns the number of buffers held by a capped pool
+func (b *bufferPool) idle() int {
+	return len(b.free)
+}
@@ -1,92 +1,1224 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gopkg.in/yaml.v3"
 )
 
-const (
-	listenAddrDefault  = "127.0.0.1:8080"
-	backendAddrDefault = "127.0.0.1:9000"
-	bufferSizeDefault  = 32
-	tlsEnabledDefault  = false
-)
+const (
+	listenAddrDefault  = "127.0.0.1:8080"
+	backendAddrDefault = "127.0.0.1:9000"
+	bufferSizeDefault  = 32 * bufferSizeUnit
+	tlsEnabledDefault  = false
+	noDelayDefault     = true
+
+	// bufferSizeUnit is what WithBufferSize multiplies its size by; buffer sizes are kept in bytes
+	bufferSizeUnit = 1024
+	// largeBufferSize is the per-buffer size above which a warning is logged
+	largeBufferSize = 4 << 20
+
+	// unixAddrPrefix marks a backend address as a Unix socket path
+	unixAddrPrefix = "unix://"
+
+	tlsHandshakeTimeoutDefault = 10 * time.Second
+	connectTimeoutDefault      = 5 * time.Second
+	backendTLSTimeoutDefault   = 5 * time.Second
+	minTLSVersionDefault       = tls.VersionTLS12
+	backendPoolMaxIdleDefault  = 30 * time.Second
+	maxHandshakeBytesDefault   = 8 << 10
+)
+
+type Option func(*config) error
+
+type config struct {
+	listenAddr          string
+	listenAddrs         []string
+	listenNetwork       string
+	inheritListener     bool
+	inheritedFD         uintptr
+	backendAddr         string
+	backendNetwork      string
+	mirrorAddr          string
+	allowSelfLoop       bool
+	bufferSize          int // client to backend
+	replyBufferSize     int // backend to client
+	bufferPoolMax       int
+	tlsEnabled          bool
+	certFilePath        string
+	keyFilePath         string
+	certificate         *tls.Certificate // from WithCertKeyPEM, preferred over the files
+	clientCAs           *x509.CertPool
+	maxConnLifetime     time.Duration
+	keepAlive           time.Duration
+	readTimeout         time.Duration
+	firstByteTimeout    time.Duration
+	maxEarlyBytes       int
+	maxHandshakeBytes   int
+	connectTimeout      time.Duration
+	backendProbe        bool
+	flushTimeout        time.Duration
+	writeTimeout        time.Duration
+	acceptors           int
+	handlerPoolSize     int
+	drainTimeout        time.Duration
+	dialer              ContextDialer
+	dialLocalAddr       *net.TCPAddr
+	dialNetwork         string
+	fallbackDelay       time.Duration
+	dnsCacheTTL         time.Duration
+	dnsCache            *dnsCache
+	breakerFailures     int
+	breakerWindow       time.Duration
+	breakerCooldown     time.Duration
+	drainOnUnhealthy    bool
+	dialErrorResponse   []byte
+	clientGreeting      []byte
+	backendPoolSize     int
+	backendPoolMaxIdle  time.Duration
+	noDelay             bool
+	backendReadBuffer   int
+	backendWriteBuffer  int
+	tlsHandshakeTimeout time.Duration
+	minTLSVersion       uint16
+	tlsCipherSuites     []uint16
+	alpnProtocols       []string
+	sessionTicketKeys   [][32]byte
+	noSessionTickets    bool
+	logger              *slog.Logger
+	hooks               Hooks
+	middleware          []Middleware
+	connWrapper         func(net.Conn) net.Conn
+	tracerProvider      trace.TracerProvider
+	meterProvider       metric.MeterProvider
+	accessLog           io.Writer
+	accessLogFormat     AccessLogFormat
+	adminAddr           string
+	adminToken          string
+	listenerFactory     ListenerFactory
+	maxConnections      int
+	maxConnectionsWait  time.Duration
+	maxConnectionsPerIP int
+	allowedCIDRs        []*net.IPNet
+	deniedCIDRs         []*net.IPNet
+	rateLimit           int64
+	acceptRate          int
+	acceptBurst         int
+	sendProxyProtocol   int
+	acceptProxyProtocol bool
+	connectMode         bool
+	connectAllowlist    []string
+	allowedDestPorts    []int
+	routes              []Route
+	socks5Mode          bool
+	socks5Username      string
+	socks5Password      string
+	udp                 bool
+	udpSessionTimeout   time.Duration
+	certStore           *certStore
+
+	backendTLSEnabled            bool
+	backendServerName            string
+	backendRootCAs               *x509.CertPool
+	backendTLSInsecureSkipVerify bool
+	backendTLSHandshakeTimeout   time.Duration
+}
+
+// Config is a read-only view of the settings a proxy runs with
+type Config struct {
+	ListenAddr  string
+	BackendAddr string
+	BufferSize  int // in bytes
+	TLSEnabled  bool
+}
+
+// DefaultConfig reports the settings a proxy created without options would use.
+func DefaultConfig() Config {
+	return defaultConfig().view()
+}
+
+// ---- Option functions ----
+
+func WithListenAddr(addr string) Option {
+	return func(cfg *config) error {
+		host, port, err := parseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("parse address: %w", err)
+		}
+		cfg.listenAddr = net.JoinHostPort(host, port)
+		cfg.listenAddrs = nil
+		cfg.listenNetwork = "tcp"
+		return nil
+	}
+}
+
+// WithBackendAddr sets the backend address as host:port, or as unix:///path for a Unix socket.
+func WithBackendAddr(addr string) Option {
+	return func(cfg *config) error {
+		if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+			return WithUnixBackend(path)(cfg)
+		}
+		host, port, err := parseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("parse address: %w", err)
+		}
+		cfg.backendAddr = net.JoinHostPort(host, port)
+		cfg.backendNetwork = "tcp"
+		return nil
+	}
+}
+
+// WithMirrorBackend copies everything clients send to a second backend at addr,
+// e.g. for shadowing traffic to a canary. It is always dialed over plain TCP,
+// since WithBackendTLS settings apply to the primary only. Its responses are
+// discarded, and a mirror that can't be dialed, fails or falls behind is logged
+// and dropped for that connection without affecting the primary backend.
+func WithMirrorBackend(addr string) Option {
+	return func(cfg *config) error {
+		host, port, err := parseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("mirror address: %w", err)
+		}
+		cfg.mirrorAddr = net.JoinHostPort(host, port)
+		return nil
+	}
+}
+
+// WithAllowSelfLoop lets the backend address be one of the proxy's own listen
+// addresses, which CreateProxy otherwise rejects because every client would be
+// relayed back to the proxy. A warning is still logged.
+func WithAllowSelfLoop(allow bool) Option {
+	return func(cfg *config) error {
+		cfg.allowSelfLoop = allow
+		return nil
+	}
+}
+
+// WithBufferSize sets the relay buffer size in KiB for both directions: a size of
+// 32 allocates 32*1024 bytes per buffer, and every connection uses one buffer per
+// direction. Sizes above 4 MiB are allowed but logged as a warning, since they are
+// usually a byte count passed by mistake; use WithBufferSizeBytes for bytes.
+func WithBufferSize(size int) Option {
+	return WithBufferSizes(size, size)
+}
+
+// WithBufferSizes sets the relay buffer sizes in KiB separately for data sent
+// from the client to the backend and from the backend to the client. As with
+// WithBufferSize, each size is multiplied by 1024.
+func WithBufferSizes(clientToBackend, backendToClient int) Option {
+	return func(cfg *config) error {
+		if clientToBackend <= 0 || backendToClient <= 0 {
+			return errors.New("buffer size must be positive")
+		}
+		cfg.bufferSize = clientToBackend * bufferSizeUnit
+		cfg.replyBufferSize = backendToClient * bufferSizeUnit
+		return nil
+	}
+}
+
+// WithBufferSizeBytes sets the relay buffer size in bytes for both directions.
+func WithBufferSizeBytes(n int) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return errors.New("buffer size must be positive")
+		}
+		cfg.bufferSize = n
+		cfg.replyBufferSize = n
+		return nil
+	}
+}
+
+func WithTlSEnabled(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.tlsEnabled = enabled
+		return nil
+	}
+}
+
+func WithCertFilePath(path string) Option {
+	return func(cfg *config) error {
+		_, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("cert file path: %w", err)
+		}
+		cfg.certFilePath = path
+		return nil
+	}
+}
+
+func WithKeyFilePath(path string) Option {
+	return func(cfg *config) error {
+		_, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("key file path: %w", err)
+		}
+		cfg.keyFilePath = path
+		return nil
+	}
+}
+
+// WithCertKeyPEM sets the listener certificate from PEM-encoded bytes, e.g. fetched
+// from a secret manager, instead of files. It takes precedence over the cert and
+// key file paths, and Reload accepts it to rotate the certificate.
+func WithCertKeyPEM(certPEM, keyPEM []byte) Option {
+	return func(cfg *config) error {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrLoadCert, err)
+		}
+		cfg.certificate = &cert
+		return nil
+	}
+}
+
+// WithMaxConnLifetime caps how long a single proxied connection may live. Zero disables the cap.
+func WithMaxConnLifetime(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("max connection lifetime must not be negative")
+		}
+		cfg.maxConnLifetime = d
+		return nil
+	}
+}
+
+// WithClientCAs requires TLS clients to present a certificate signed by one of
+// the CAs in pool. The certificate's subject, serial and fingerprint are then
+// reported in Stats, the access log and the connection's log lines.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(cfg *config) error {
+		if pool == nil {
+			return errors.New("client CA pool is nil")
+		}
+		cfg.clientCAs = pool
+		return nil
+	}
+}
+
+// WithClientCAFile loads a PEM bundle of CAs for WithClientCAs.
+func WithClientCAFile(path string) Option {
+	return func(cfg *config) error {
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("client ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return fmt.Errorf("client ca file: no valid certificates in %s", path)
+		}
+		cfg.clientCAs = pool
+		return nil
+	}
+}
+
+// WithTLSHandshakeTimeout bounds how long a client may take to complete the TLS handshake. Zero disables the bound.
+func WithTLSHandshakeTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("tls handshake timeout must not be negative")
+		}
+		cfg.tlsHandshakeTimeout = d
+		return nil
+	}
+}
+
+// WithMinTLSVersion sets the minimum TLS version accepted by the listener, e.g. tls.VersionTLS13.
+func WithMinTLSVersion(v uint16) Option {
+	return func(cfg *config) error {
+		switch v {
+		case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+			cfg.minTLSVersion = v
+			return nil
+		default:
+			return fmt.Errorf("unknown tls version: %#04x", v)
+		}
+	}
+}
+
+// WithTLSCipherSuites restricts the TLS 1.2 cipher suites offered by the listener.
+// Only suites returned by tls.CipherSuites are accepted; TLS 1.3 suites are not configurable.
+func WithTLSCipherSuites(suites []uint16) Option {
+	return func(cfg *config) error {
+		known := make(map[uint16]bool)
+		for _, suite := range tls.CipherSuites() {
+			known[suite.ID] = true
+		}
+		for _, id := range suites {
+			if !known[id] {
+				return fmt.Errorf("unknown or insecure tls cipher suite: %#04x", id)
+			}
+		}
+		cfg.tlsCipherSuites = append([]uint16(nil), suites...)
+		return nil
+	}
+}
+
+// WithALPNProtocols sets the ALPN protocols advertised by the TLS listener, in order of preference.
+func WithALPNProtocols(protocols []string) Option {
+	return func(cfg *config) error {
+		for _, proto := range protocols {
+			if proto == "" || len(proto) > 255 {
+				return fmt.Errorf("invalid alpn protocol: %q", proto)
+			}
+		}
+		cfg.alpnProtocols = append([]string(nil), protocols...)
+		return nil
+	}
+}
+
+// WithTLSSessionTicketKeys sets the keys the TLS listener encrypts session tickets
+// with. The first key encrypts new tickets and all of them are tried to decrypt, so
+// instances sharing the keys, or restarted with them, can resume each other's sessions.
+func WithTLSSessionTicketKeys(keys [][32]byte) Option {
+	return func(cfg *config) error {
+		if len(keys) == 0 {
+			return errors.New("no session ticket keys given")
+		}
+		cfg.sessionTicketKeys = slices.Clone(keys)
+		return nil
+	}
+}
+
+// WithTLSSessionTicketsDisabled stops the TLS listener from issuing session tickets,
+// so every client does a full handshake.
+func WithTLSSessionTicketsDisabled(disabled bool) Option {
+	return func(cfg *config) error {
+		cfg.noSessionTickets = disabled
+		return nil
+	}
+}
+
+// WithBackendTLS makes the proxy dial the backend over TLS, verifying its certificate against serverName.
+// An empty serverName falls back to the host part of the backend address.
+func WithBackendTLS(serverName string) Option {
+	return func(cfg *config) error {
+		cfg.backendTLSEnabled = true
+		cfg.backendServerName = serverName
+		return nil
+	}
+}
+
+// WithConnectTimeout bounds how long establishing the backend connection may take,
+// not counting a backend TLS handshake. Zero disables the bound. Defaults to 5s.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("connect timeout must not be negative")
+		}
+		cfg.connectTimeout = d
+		return nil
+	}
+}
+
+// WithBackendProbe makes the proxy watch each freshly dialed backend connection for
+// a few milliseconds before relaying, and treat one that is reset or closed straight
+// away as a failed dial. Data the backend sends meanwhile is passed on to the client.
+func WithBackendProbe(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.backendProbe = enabled
+		return nil
+	}
+}
+
+// WithBackendHandshakeTimeout bounds the backend TLS handshake, which starts once
+// the connection is established. Zero disables the bound. Defaults to 5s.
+func WithBackendHandshakeTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("backend handshake timeout must not be negative")
+		}
+		cfg.backendTLSHandshakeTimeout = d
+		return nil
+	}
+}
+
+// WithBackendRootCAs sets the CA pool used to verify the backend certificate instead of the system roots.
+func WithBackendRootCAs(pool *x509.CertPool) Option {
+	return func(cfg *config) error {
+		if pool == nil {
+			return errors.New("backend root CA pool is nil")
+		}
+		cfg.backendRootCAs = pool
+		return nil
+	}
+}
+
+// WithBackendCAFile loads a PEM bundle used to verify the backend certificate instead of the system roots.
+func WithBackendCAFile(path string) Option {
+	return func(cfg *config) error {
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("backend ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return fmt.Errorf("backend ca file: no valid certificates in %s", path)
+		}
+		cfg.backendRootCAs = pool
+		return nil
+	}
+}
+
+// WithBackendTLSInsecureSkipVerify disables backend certificate verification. Intended for testing only.
+func WithBackendTLSInsecureSkipVerify(skip bool) Option {
+	return func(cfg *config) error {
+		cfg.backendTLSInsecureSkipVerify = skip
+		return nil
+	}
+}
+
+// WithLogger sets the structured logger used by the proxy. Defaults to a text handler on stderr at info level.
+func WithLogger(logger *slog.Logger) Option {
+	return func(cfg *config) error {
+		if logger == nil {
+			return errors.New("logger is nil")
+		}
+		cfg.logger = logger
+		return nil
+	}
+}
+
+// WithLogOutput keeps the default text logger at info level but writes it to w instead of stderr.
+func WithLogOutput(w io.Writer) Option {
+	return func(cfg *config) error {
+		if w == nil {
+			return errors.New("log output is nil")
+		}
+		cfg.logger = slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		return nil
+	}
+}
+
+// WithLogDisabled discards everything the proxy logs. The access log, if any, is unaffected.
+func WithLogDisabled() Option {
+	return func(cfg *config) error {
+		cfg.logger = slog.New(slog.DiscardHandler)
+		return nil
+	}
+}
+
+// WithTracerProvider makes the proxy emit a span per connection through tp.
+// Without it spans go to a no-op tracer.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(cfg *config) error {
+		if tp == nil {
+			return errors.New("tracer provider is nil")
+		}
+		cfg.tracerProvider = tp
+		return nil
+	}
+}
+
+// WithMeterProvider makes the proxy record metrics, such as backend dial latency,
+// through mp. Without it nothing is recorded.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(cfg *config) error {
+		if mp == nil {
+			return errors.New("meter provider is nil")
+		}
+		cfg.meterProvider = mp
+		return nil
+	}
+}
+
+// WithAccessLog writes one summary line per finished connection to w, separately
+// from the logger: start time, client and backend addresses, duration, bytes in
+// each direction and why the connection ended.
+func WithAccessLog(w io.Writer) Option {
+	return func(cfg *config) error {
+		if w == nil {
+			return errors.New("access log writer is nil")
+		}
+		cfg.accessLog = w
+		return nil
+	}
+}
+
+// WithAccessLogFormat selects plain key=value (the default) or JSON access log lines.
+func WithAccessLogFormat(format AccessLogFormat) Option {
+	return func(cfg *config) error {
+		if format != AccessLogPlain && format != AccessLogJSON {
+			return fmt.Errorf("unknown access log format %d", format)
+		}
+		cfg.accessLogFormat = format
+		return nil
+	}
+}
+
+// WithAdminHTTP serves /healthz and /readyz on addr for liveness and readiness
+// probes. /healthz succeeds once the proxy is listening; /readyz also requires
+// the backend to accept a connection. The server has no authentication, so
+// anyone who can reach addr can read them and GET /maintenance; bind it to
+// loopback or a management network. Endpoints that change state are only
+// served with WithAdminToken.
+func WithAdminHTTP(addr string) Option {
+	return func(cfg *config) error {
+		host, port, err := parseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("admin address: %w", err)
+		}
+		cfg.adminAddr = net.JoinHostPort(host, port)
+		return nil
+	}
+}
+
+// WithAdminToken enables PUT and DELETE /maintenance on the admin server for
+// requests with an "Authorization: Bearer <token>" header. Without a token they
+// are not served at all.
+func WithAdminToken(token string) Option {
+	return func(cfg *config) error {
+		if token == "" {
+			return errors.New("admin token must not be empty")
+		}
+		cfg.adminToken = token
+		return nil
+	}
+}
+
+// WithHooks registers callbacks invoked over the lifetime of each proxied connection.
+func WithHooks(hooks Hooks) Option {
+	return func(cfg *config) error {
+		cfg.hooks = hooks
+		return nil
+	}
+}
+
+// WithConnMiddleware wraps connection handling in mw. Middleware from repeated calls
+// is chained in order, the first registered being the outermost.
+func WithConnMiddleware(mw Middleware) Option {
+	return func(cfg *config) error {
+		if mw == nil {
+			return errors.New("connection middleware is nil")
+		}
+		cfg.middleware = append(cfg.middleware, mw)
+		return nil
+	}
+}
+
+// WithConnWrapper wraps every client connection as it is accepted and every backend
+// connection as it is dialed, e.g. to count bytes or instrument reads and writes.
+func WithConnWrapper(wrap func(net.Conn) net.Conn) Option {
+	return func(cfg *config) error {
+		if wrap == nil {
+			return errors.New("conn wrapper is nil")
+		}
+		cfg.connWrapper = wrap
+		return nil
+	}
+}
+
+// WithMaxConnections limits the number of concurrently proxied connections. Zero means no limit.
+func WithMaxConnections(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return errors.New("max connections must not be negative")
+		}
+		cfg.maxConnections = n
+		return nil
+	}
+}
+
+// WithMaxConnectionsWait sets how long a newly accepted connection waits for a free slot
+// when the connection limit is reached before it is closed. Zero closes it immediately.
+func WithMaxConnectionsWait(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("max connections wait must not be negative")
+		}
+		cfg.maxConnectionsWait = d
+		return nil
+	}
+}
+
+// WithMaxConnectionsPerIP limits the number of concurrent connections from a single client IP.
+// Zero means no limit.
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return errors.New("max connections per ip must not be negative")
+		}
+		cfg.maxConnectionsPerIP = n
+		return nil
+	}
+}
+
+// WithRateLimit caps the combined throughput of all connections in bytes per second. Zero disables throttling.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(cfg *config) error {
+		if bytesPerSec < 0 {
+			return errors.New("rate limit must not be negative")
+		}
+		cfg.rateLimit = bytesPerSec
+		return nil
+	}
+}
+
+// WithAcceptRateLimit limits how many new connections are accepted per second, with
+// bursts of up to burst, e.g. to spare the backend a thundering herd after a restart.
+// Connections over the rate wait in the listen backlog. A zero rate disables it.
+func WithAcceptRateLimit(perSec, burst int) Option {
+	return func(cfg *config) error {
+		if perSec < 0 {
+			return errors.New("accept rate limit must not be negative")
+		}
+		if perSec > 0 && burst <= 0 {
+			return errors.New("accept rate limit burst must be positive")
+		}
+		cfg.acceptRate = perSec
+		cfg.acceptBurst = burst
+		return nil
+	}
+}
+
+// WithSendProxyProtocol makes the proxy send a PROXY protocol header of the given version
+// to the backend before any client data, so the backend sees the real client address.
+// Zero disables the header.
+func WithSendProxyProtocol(version int) Option {
+	return func(cfg *config) error {
+		if version < 0 || version > 2 {
+			return fmt.Errorf("unsupported proxy protocol version: %d", version)
+		}
+		cfg.sendProxyProtocol = version
+		return nil
+	}
+}
+
+// WithAcceptProxyProtocol makes the listener expect a PROXY protocol (v1 or v2) header from an
+// upstream load balancer on every connection. The header is stripped and the client address it
+// carries is reported as the connection's remote address. Connections without a valid header are dropped.
+// Headers are read on each connection's own goroutine, and the client address checks
+// and per-IP limit apply to the address in the header.
+func WithAcceptProxyProtocol(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.acceptProxyProtocol = enabled
+		return nil
+	}
+}
+
+// WithConnectMode makes the proxy read an HTTP CONNECT request from each client
+// and tunnel to the requested host instead of the configured backend.
+func WithConnectMode(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.connectMode = enabled
+		return nil
+	}
+}
+
+// WithConnectAllowlist restricts CONNECT mode to the given host:port targets.
+func WithConnectAllowlist(targets ...string) Option {
+	return func(cfg *config) error {
+		allowlist := make([]string, 0, len(targets))
+		for _, target := range targets {
+			host, port, err := parseAddress(target)
+			if err != nil {
+				return fmt.Errorf("connect allowlist: %w", err)
+			}
+			allowlist = append(allowlist, net.JoinHostPort(host, port))
+		}
+		cfg.connectAllowlist = allowlist
+		return nil
+	}
+}
+
+// WithAllowedDestPorts restricts CONNECT and SOCKS5 clients to targets on the given
+// ports; others are refused with 403 Forbidden or a SOCKS5 "not allowed" reply.
+// No ports allows any. It has no effect on other modes, whose backend is fixed.
+func WithAllowedDestPorts(ports []int) Option {
+	return func(cfg *config) error {
+		for _, port := range ports {
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("allowed destination port %d out of range", port)
+			}
+		}
+		cfg.allowedDestPorts = slices.Clone(ports)
+		return nil
+	}
+}
+
+// WithRoutes gives connections matching a route its own backend, buffer size and
+// timeouts. Routes match on the TLS server name a client sent, or on the requested
+// target in CONNECT and SOCKS5 modes; the first match wins and connections that
+// match none use the global settings.
+func WithRoutes(routes ...Route) Option {
+	return func(cfg *config) error {
+		for _, r := range routes {
+			if r.Match == "" {
+				return errors.New("route match is empty")
+			}
+			if r.Backend != "" {
+				if _, _, err := parseAddress(r.Backend); err != nil {
+					return fmt.Errorf("route %s backend: %w", r.Match, err)
+				}
+			}
+			if r.BufferSize < 0 || r.DialTimeout < 0 || r.IdleTimeout < 0 {
+				return fmt.Errorf("route %s: buffer size and timeouts must not be negative", r.Match)
+			}
+		}
+		cfg.routes = slices.Clone(routes)
+		return nil
+	}
+}
+
+// WithSocks5Mode makes the proxy speak SOCKS5 to clients and tunnel to the
+// requested host instead of the configured backend.
+func WithSocks5Mode(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.socks5Mode = enabled
+		return nil
+	}
+}
+
+// WithSocks5Credentials requires SOCKS5 clients to authenticate with the given username and password.
+func WithSocks5Credentials(username, password string) Option {
+	return func(cfg *config) error {
+		if username == "" {
+			return errors.New("socks5 username must not be empty")
+		}
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5 credentials must not exceed 255 bytes")
+		}
+		cfg.socks5Username = username
+		cfg.socks5Password = password
+		return nil
+	}
+}
+
+// WithUDP makes the proxy relay UDP datagrams instead of TCP connections.
+func WithUDP(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.udp = enabled
+		return nil
+	}
+}
+
+// WithUDPSessionTimeout sets how long a UDP client session may stay idle before it is dropped.
+func WithUDPSessionTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return errors.New("udp session timeout must be positive")
+		}
+		cfg.udpSessionTimeout = d
+		return nil
+	}
+}
+
+// WithUnixListener makes the proxy listen on a Unix domain socket at path instead of TCP.
+func WithUnixListener(path string) Option {
+	return func(cfg *config) error {
+		if path == "" {
+			return errors.New("unix socket path must not be empty")
+		}
+		cfg.listenAddr = path
+		cfg.listenAddrs = nil
+		cfg.listenNetwork = "unix"
+		return nil
+	}
+}
+
+// WithUnixBackend makes the proxy dial a backend listening on the Unix domain socket at path.
+func WithUnixBackend(path string) Option {
+	return func(cfg *config) error {
+		if path == "" {
+			return errors.New("unix socket path must not be empty")
+		}
+		cfg.backendAddr = path
+		cfg.backendNetwork = "unix"
+		return nil
+	}
+}
+
+// WithKeepAlive enables TCP keepalives with the given period on client and backend connections.
+// A zero period disables keepalives.
+func WithKeepAlive(period time.Duration) Option {
+	return func(cfg *config) error {
+		if period < 0 {
+			return errors.New("keepalive period must not be negative")
+		}
+		cfg.keepAlive = period
+		return nil
+	}
+}
+
+// WithNoDelay sets TCP_NODELAY on client and backend connections. Go already disables
+// Nagle's algorithm by default, so this is mainly for turning it back on with false.
+func WithNoDelay(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.noDelay = enabled
+		return nil
+	}
+}
+
+// WithBackendSocketBuffers sets the kernel receive and send buffer sizes in bytes
+// (SO_RCVBUF and SO_SNDBUF) on backend connections only, leaving client connections
+// alone. Zero keeps the OS default for that direction.
+func WithBackendSocketBuffers(read, write int) Option {
+	return func(cfg *config) error {
+		if read < 0 || write < 0 {
+			return errors.New("backend socket buffer sizes must not be negative")
+		}
+		cfg.backendReadBuffer = read
+		cfg.backendWriteBuffer = write
+		return nil
+	}
+}
+
+// WithAcceptors runs n accept loops, each on its own listener bound to the listen address with SO_REUSEPORT.
+func WithAcceptors(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return errors.New("acceptors must not be negative")
+		}
+		cfg.acceptors = n
+		return nil
+	}
+}
+
+// WithHandlerPool handles connections on a fixed pool of size workers instead of a
+// goroutine each. While every worker is busy the accept loop waits for one to
+// free up. Zero keeps one goroutine per connection.
+func WithHandlerPool(size int) Option {
+	return func(cfg *config) error {
+		if size < 0 {
+			return errors.New("handler pool size must not be negative")
+		}
+		cfg.handlerPoolSize = size
+		return nil
+	}
+}
+
+// WithDrainTimeout lets active connections finish for up to d after shutdown begins
+// before they are closed. Zero closes them immediately.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("drain timeout must not be negative")
+		}
+		cfg.drainTimeout = d
+		return nil
+	}
+}
+
+// WithDialer routes backend connections through d instead of a standard net.Dialer.
+// The dial timeout still applies through the context passed to d.
+func WithDialer(d ContextDialer) Option {
+	return func(cfg *config) error {
+		if d == nil {
+			return errors.New("dialer is nil")
+		}
+		cfg.dialer = d
+		return nil
+	}
+}
+
+// WithDualStack turns Happy Eyeballs (RFC 6555) dialing of dual-stack backends on
+// or off. When on, IPv4 is tried if IPv6 hasn't connected within fallbackDelay;
+// zero keeps Go's default delay of 300ms.
+func WithDualStack(enabled bool, fallbackDelay time.Duration) Option {
+	return func(cfg *config) error {
+		if fallbackDelay < 0 {
+			return errors.New("fallback delay must not be negative")
+		}
+		cfg.fallbackDelay = fallbackDelay
+		if !enabled {
+			// A negative FallbackDelay disables the fallback in net.Dialer
+			cfg.fallbackDelay = -1
+		}
+		return nil
+	}
+}
+
+// WithDialNetwork forces TCP backends to be dialed over "tcp4" or "tcp6" instead of either.
+// In UDP mode it picks "udp4" or "udp6" the same way.
+func WithDialNetwork(network string) Option {
+	return func(cfg *config) error {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("unsupported dial network %q", network)
+		}
+		cfg.dialNetwork = network
+		return nil
+	}
+}
+
+// WithDialLocalAddr makes backend connections originate from addr, an IP address
+// with an optional port, e.g. to egress through a particular interface. It has no
+// effect with WithDialer or a Unix socket backend.
+func WithDialLocalAddr(addr string) Option {
+	return func(cfg *config) error {
+		local, err := parseLocalAddr(addr)
+		if err != nil {
+			return fmt.Errorf("dial local addr: %w", err)
+		}
+		cfg.dialLocalAddr = local
+		return nil
+	}
+}
+
+// WithDNSCacheTTL caches backend host name lookups for d instead of resolving on
+// every connection. Zero disables the cache. It has no effect with WithDialer.
+func WithDNSCacheTTL(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("dns cache ttl must not be negative")
+		}
+		cfg.dnsCacheTTL = d
+		return nil
+	}
+}
+
+// WithCircuitBreaker stops dialing a backend once it has failed to connect failures
+// times within window. Clients are then closed straight away until cooldown has
+// passed and a single probe connection to the backend succeeds.
+func WithCircuitBreaker(failures int, window, cooldown time.Duration) Option {
+	return func(cfg *config) error {
+		if failures <= 0 {
+			return errors.New("circuit breaker failures must be positive")
+		}
+		if window <= 0 || cooldown <= 0 {
+			return errors.New("circuit breaker window and cooldown must be positive")
+		}
+		cfg.breakerFailures = failures
+		cfg.breakerWindow = window
+		cfg.breakerCooldown = cooldown
+		return nil
+	}
+}
+
+// WithBackendPool keeps up to size idle connections to each backend dialed ahead
+// of time, so clients don't wait for a dial. Each one serves a single client and
+// is replaced in the background once borrowed. Zero dials per client.
+func WithBackendPool(size int) Option {
+	return func(cfg *config) error {
+		if size < 0 {
+			return errors.New("backend pool size must not be negative")
+		}
+		cfg.backendPoolSize = size
+		return nil
+	}
+}
 
-type Option func(*config) error
+// WithBackendPoolMaxIdle sets how long a pooled backend connection may sit idle before it is closed.
+func WithBackendPoolMaxIdle(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return errors.New("backend pool max idle must be positive")
+		}
+		cfg.backendPoolMaxIdle = d
+		return nil
+	}
+}
 
-type config struct {
-	listenAddr   string
-	backendAddr  string
-	bufferSize   int
-	tlsEnabled   bool
-	certFilePath string
-	keyFilePath  string
+// WithDrainOnUnhealthy closes the established connections to a backend when its
+// circuit opens, so their clients reconnect and are sent elsewhere. They are torn
+// down as on shutdown, honouring WithShutdownFlushTimeout. Requires WithCircuitBreaker.
+func WithDrainOnUnhealthy(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.drainOnUnhealthy = enabled
+		return nil
+	}
 }
 
-// ---- Option functions ----
+// WithDialErrorResponse writes response to the client before closing it when the
+// backend can't be reached, e.g. a short error banner. CONNECT and SOCKS5 clients
+// get their protocol's error reply instead. Nil (the default) closes silently.
+func WithDialErrorResponse(response []byte) Option {
+	return func(cfg *config) error {
+		cfg.dialErrorResponse = bytes.Clone(response)
+		return nil
+	}
+}
 
-func WithListenAddr(addr string) Option {
+// WithClientGreeting writes greeting to each client once it is accepted and any TLS
+// handshake is done, before the backend is dialed, for protocols where the server
+// speaks first. Not available in CONNECT, SOCKS5 or UDP mode, whose clients expect
+// a protocol reply instead.
+func WithClientGreeting(greeting []byte) Option {
 	return func(cfg *config) error {
-		host, port, err := parseAddress(addr)
+		cfg.clientGreeting = bytes.Clone(greeting)
+		return nil
+	}
+}
+
+// WithListenerFactory makes the proxy accept on listeners created by factory, e.g.
+// sockets inherited from systemd. The listeners are used as they are: TLS and
+// PROXY protocol handling are not layered on top.
+func WithListenerFactory(factory ListenerFactory) Option {
+	return func(cfg *config) error {
+		if factory == nil {
+			return errors.New("listener factory is nil")
+		}
+		cfg.listenerFactory = factory
+		return nil
+	}
+}
+
+// WithInheritedListener makes the proxy accept on the listening socket with file
+// descriptor fd, passed in by the process that started this one (see
+// Proxy.ListenerFile), instead of binding the listen address. TLS and PROXY protocol
+// handling are layered on top as usual, and the listen address only serves as a label.
+func WithInheritedListener(fd uintptr) Option {
+	return func(cfg *config) error {
+		cfg.inheritListener = true
+		cfg.inheritedFD = fd
+		return nil
+	}
+}
+
+// WithListenAddrs makes the proxy listen on every given host:port, all forwarding to the same backend.
+func WithListenAddrs(addrs ...string) Option {
+	return func(cfg *config) error {
+		if len(addrs) == 0 {
+			return errors.New("no listen addresses given")
+		}
+		listenAddrs := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			host, port, err := parseAddress(addr)
+			if err != nil {
+				return fmt.Errorf("parse address %q: %w", addr, err)
+			}
+			listenAddrs = append(listenAddrs, net.JoinHostPort(host, port))
+		}
+		cfg.listenAddr = listenAddrs[0]
+		cfg.listenAddrs = listenAddrs
+		cfg.listenNetwork = "tcp"
+		return nil
+	}
+}
+
+// WithBufferPoolMax keeps at most n idle relay buffers for reuse and lets the
+// rest be garbage collected, bounding the memory retained after a burst.
+// Zero uses a sync.Pool, which shrinks only under GC pressure.
+func WithBufferPoolMax(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return errors.New("buffer pool max must not be negative")
+		}
+		cfg.bufferPoolMax = n
+		return nil
+	}
+}
+
+// WithAllowedCIDRs only lets clients whose IP falls in one of cidrs connect. An empty list allows everyone.
+func WithAllowedCIDRs(cidrs []string) Option {
+	return func(cfg *config) error {
+		nets, err := parseCIDRs(cidrs)
 		if err != nil {
-			return fmt.Errorf("parse address: %w", err)
+			return fmt.Errorf("allowed cidrs: %w", err)
 		}
-		cfg.listenAddr = net.JoinHostPort(host, port)
+		cfg.allowedCIDRs = nets
 		return nil
 	}
 }
 
-func WithBackendAddr(addr string) Option {
+// WithDeniedCIDRs rejects clients whose IP falls in one of cidrs, even if they are also allowed.
+func WithDeniedCIDRs(cidrs []string) Option {
 	return func(cfg *config) error {
-		host, port, err := parseAddress(addr)
+		nets, err := parseCIDRs(cidrs)
 		if err != nil {
-			return fmt.Errorf("parse address: %w", err)
+			return fmt.Errorf("denied cidrs: %w", err)
 		}
-		cfg.backendAddr = net.JoinHostPort(host, port)
+		cfg.deniedCIDRs = nets
 		return nil
 	}
 }
 
-func WithBufferSize(size int) Option {
+// WithFirstByteTimeout closes a connection whose client sends nothing within d of
+// being accepted, before any backend is dialed. It applies to plain and TLS
+// forwarding; CONNECT and SOCKS5 handshakes have their own timeouts. Zero disables it.
+func WithFirstByteTimeout(d time.Duration) Option {
 	return func(cfg *config) error {
-		if size <= 0 {
-			return errors.New("buffer size must be positive")
+		if d < 0 {
+			return errors.New("first byte timeout must not be negative")
 		}
-		cfg.bufferSize = size
+		cfg.firstByteTimeout = d
 		return nil
 	}
 }
 
-func WithTlSEnabled(enabled bool) Option {
+// WithMaxEarlyBytes drops a client that sends more than n bytes before its backend
+// connection is established, counting any read while waiting for the first byte.
+// Zero disables the check.
+func WithMaxEarlyBytes(n int) Option {
 	return func(cfg *config) error {
-		cfg.tlsEnabled = enabled
+		if n < 0 {
+			return errors.New("max early bytes must not be negative")
+		}
+		cfg.maxEarlyBytes = n
 		return nil
 	}
 }
 
-func WithCertFilePath(path string) Option {
+// WithMaxHandshakeBytes caps how many bytes of a CONNECT request, SOCKS5 handshake
+// or PROXY protocol header are read before the connection is closed. It defaults
+// to 8 KiB.
+func WithMaxHandshakeBytes(n int) Option {
 	return func(cfg *config) error {
-		_, err := os.Stat(path)
-		if err != nil {
-			return fmt.Errorf("cert file path: %w", err)
+		if n <= 0 {
+			return errors.New("max handshake bytes must be positive")
 		}
-		cfg.certFilePath = path
+		cfg.maxHandshakeBytes = n
 		return nil
 	}
 }
 
-func WithKeyFilePath(path string) Option {
+// WithReadTimeout closes a connection when a single read from either side blocks
+// for longer than d. The deadline is a fixed ceiling set before each read call; it
+// is not an idle timeout and nothing received during the read moves it. Zero
+// disables it.
+func WithReadTimeout(d time.Duration) Option {
 	return func(cfg *config) error {
-		_, err := os.Stat(path)
-		if err != nil {
-			return fmt.Errorf("key file path: %w", err)
+		if d < 0 {
+			return errors.New("read timeout must not be negative")
 		}
-		cfg.keyFilePath = path
+		cfg.readTimeout = d
+		return nil
+	}
+}
+
+// WithWriteTimeout closes a connection when relaying one buffer of data to either
+// side takes longer than d, so a peer that stops reading can't pin it forever.
+// Zero disables the timeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("write timeout must not be negative")
+		}
+		cfg.writeTimeout = d
+		return nil
+	}
+}
+
+// WithShutdownFlushTimeout lets data already read from one side be written to the
+// other for up to d when a connection is torn down, e.g. at shutdown, instead of
+// being dropped. Zero closes both sides straight away.
+func WithShutdownFlushTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return errors.New("shutdown flush timeout must not be negative")
+		}
+		cfg.flushTimeout = d
 		return nil
 	}
 }
@@ -111,12 +1243,18 @@ func FromEnv(prefix string) Option {
 			} else if n <= 0 {
 				return errors.New("buffer size must be positive")
 			} else {
-				c.bufferSize = n
+				c.bufferSize = n * bufferSizeUnit
+				c.replyBufferSize = n * bufferSizeUnit
 			}
 		}
+		// Any value that is set applies, so false can turn off TLS enabled elsewhere
 		if v, ok := os.LookupEnv(prefix + "_TLS_ENABLED"); ok {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("tls enabled: %w", err)
+			}
 			//nolint:errcheck
-			WithTlSEnabled(v == "true")(c)
+			WithTlSEnabled(enabled)(c)
 		}
 		if v, ok := os.LookupEnv(prefix + "_CERT_FILE_PATH"); ok {
 			if err := WithCertFilePath(v)(c); err != nil {
@@ -128,8 +1266,89 @@ func FromEnv(prefix string) Option {
 				return fmt.Errorf("apply option: %w", err)
 			}
 		}
+		var backendTLS *bool
+		if v, ok := os.LookupEnv(prefix + "_BACKEND_TLS"); ok {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("backend tls: %w", err)
+			}
+			backendTLS = &enabled
+		}
+		var backendServerName *string
+		if v, ok := os.LookupEnv(prefix + "_BACKEND_SERVER_NAME"); ok {
+			backendServerName = &v
+		}
+		if err := applyBackendTLS(c, backendTLS, backendServerName); err != nil {
+			return fmt.Errorf("apply option: %w", err)
+		}
+		return nil
+	}
+}
+
+// applyBackendTLS sets the backend TLS fields that config sources keep apart:
+// enabled turns backend TLS on through WithBackendTLS or off, and serverName is
+// the name WithBackendTLS verifies against. Either may be nil to leave it as is.
+func applyBackendTLS(c *config, enabled *bool, serverName *string) error {
+	if serverName != nil {
+		c.backendServerName = *serverName
+	}
+	if enabled == nil {
+		return nil
+	}
+	if !*enabled {
+		c.backendTLSEnabled = false
 		return nil
 	}
+	return WithBackendTLS(c.backendServerName)(c)
+}
+
+// fileConfig is the schema shared by the JSON, YAML and TOML config loaders.
+// Fields are pointers so a value set to zero or false can be told apart from one
+// that was left out; only the fields present are applied.
+type fileConfig struct {
+	ListenAddr   *string `json:"listen_addr" yaml:"listen_addr" toml:"listen_addr"`
+	BackendAddr  *string `json:"backend_addr" yaml:"backend_addr" toml:"backend_addr"`
+	BufferSize   *int    `json:"buffer_size" yaml:"buffer_size" toml:"buffer_size"`
+	TlSEnabled   *bool   `json:"tls_enabled" yaml:"tls_enabled" toml:"tls_enabled"`
+	CertFilePath *string `json:"cert_file_path" yaml:"cert_file_path" toml:"cert_file_path"`
+	KeyFilePath  *string `json:"key_file_path" yaml:"key_file_path" toml:"key_file_path"`
+
+	BackendTLS        *bool   `json:"backend_tls" yaml:"backend_tls" toml:"backend_tls"`
+	BackendServerName *string `json:"backend_server_name" yaml:"backend_server_name" toml:"backend_server_name"`
+}
+
+// apply validates the fields that are set by delegating to the matching options
+func (raw fileConfig) apply(cfg *config) error {
+	if raw.ListenAddr != nil {
+		if err := WithListenAddr(*raw.ListenAddr)(cfg); err != nil {
+			return err
+		}
+	}
+	if raw.BackendAddr != nil {
+		if err := WithBackendAddr(*raw.BackendAddr)(cfg); err != nil {
+			return err
+		}
+	}
+	if raw.BufferSize != nil {
+		if err := WithBufferSize(*raw.BufferSize)(cfg); err != nil {
+			return err
+		}
+	}
+	if raw.TlSEnabled != nil {
+		//nolint:errcheck
+		WithTlSEnabled(*raw.TlSEnabled)(cfg)
+	}
+	if raw.CertFilePath != nil {
+		if err := WithCertFilePath(*raw.CertFilePath)(cfg); err != nil {
+			return err
+		}
+	}
+	if raw.KeyFilePath != nil {
+		if err := WithKeyFilePath(*raw.KeyFilePath)(cfg); err != nil {
+			return err
+		}
+	}
+	return applyBackendTLS(cfg, raw.BackendTLS, raw.BackendServerName)
 }
 
 func WithConfigJSON(b []byte) Option {
@@ -137,57 +1356,56 @@ func WithConfigJSON(b []byte) Option {
 		return func(cfg *config) error { return nil }
 	}
 	return func(cfg *config) error {
-		var raw struct {
-			ListenAddr   string `json:"listen_addr"`
-			BackendAddr  string `json:"backend_addr"`
-			BufferSize   int    `json:"buffer_size"`
-			TlSEnabled   bool   `json:"tls_enabled"`
-			CertFilePath string `json:"cert_file_path"`
-			KeyFilePath  string `json:"key_file_path"`
-		}
+		var raw fileConfig
 		if err := json.Unmarshal(b, &raw); err != nil {
 			return fmt.Errorf("parse json config: %w", err)
 		}
-		if raw.ListenAddr != "" {
-			if err := WithListenAddr(raw.ListenAddr)(cfg); err != nil {
-				return err
-			}
-		}
-		if raw.BackendAddr != "" {
-			if err := WithBackendAddr(raw.BackendAddr)(cfg); err != nil {
-				return err
-			}
-		}
-		if raw.BufferSize != 0 {
-			if err := WithBufferSize(raw.BufferSize)(cfg); err != nil {
-				return err
-			}
-		}
-		if raw.TlSEnabled {
-			//nolint:errcheck
-			WithTlSEnabled(raw.TlSEnabled)(cfg)
-		}
-		if raw.CertFilePath != "" {
-			if err := WithCertFilePath(raw.CertFilePath)(cfg); err != nil {
-				return err
-			}
+		return raw.apply(cfg)
+	}
+}
+
+func WithConfigYAML(b []byte) Option {
+	if len(b) == 0 {
+		return func(cfg *config) error { return nil }
+	}
+	return func(cfg *config) error {
+		var raw fileConfig
+		if err := yaml.Unmarshal(b, &raw); err != nil {
+			return fmt.Errorf("parse yaml config: %w", err)
 		}
-		if raw.KeyFilePath != "" {
-			if err := WithKeyFilePath(raw.KeyFilePath)(cfg); err != nil {
-				return err
-			}
+		return raw.apply(cfg)
+	}
+}
+
+func WithConfigTOML(b []byte) Option {
+	if len(b) == 0 {
+		return func(cfg *config) error { return nil }
+	}
+	return func(cfg *config) error {
+		var raw fileConfig
+		if err := toml.Unmarshal(b, &raw); err != nil {
+			return fmt.Errorf("parse toml config: %w", err)
 		}
-		return nil
+		return raw.apply(cfg)
 	}
 }
 
+// WithConfigFile picks the format from the file extension: .yaml/.yml for YAML,
+// .toml for TOML and JSON for anything else.
 func WithConfigFile(path string) Option {
 	return func(c *config) error {
 		b, err := os.ReadFile(path)
 		if err != nil {
 			return fmt.Errorf("read config file: %w", err)
 		}
-		return WithConfigJSON(b)(c)
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			return WithConfigYAML(b)(c)
+		case ".toml":
+			return WithConfigTOML(b)(c)
+		default:
+			return WithConfigJSON(b)(c)
+		}
 	}
 }
 
@@ -195,46 +1413,372 @@ func WithFlags() Option {
 	return func(c *config) error {
 		listenAddr := flag.String("listen", listenAddrDefault, "Proxy listen address")
 		backendAddr := flag.String("backend", backendAddrDefault, "Backend server address")
-		bufferSize := flag.Int("buffer-size", bufferSizeDefault, "Buffer size for data transfer")
+		bufferSize := flag.Int("buffer-size", bufferSizeDefault/bufferSizeUnit, "Buffer size for data transfer in KiB")
 		tlsEnabled := flag.Bool("tls-enabled", tlsEnabledDefault, "Enable TLS")
 		certFilePath := flag.String("cert-file-path", "", "Path to TLS certificate file")
 		keyFilePath := flag.String("key-file-path", "", "Path to TLS key file")
+		backendTLS := flag.Bool("backend-tls", false, "Dial the backend over TLS")
+		backendServerName := flag.String("backend-server-name", "", "Server name to verify the backend certificate against")
 		flag.Parse()
 
-		if *listenAddr != "" {
+		// Only flags given on the command line are applied, including ones explicitly
+		// set to zero or false, so their defaults don't override other sources
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+		if set["listen"] {
 			if err := WithListenAddr(*listenAddr)(c); err != nil {
 				return err
 			}
 		}
-		if *backendAddr != "" {
+		if set["backend"] {
 			if err := WithBackendAddr(*backendAddr)(c); err != nil {
 				return err
 			}
 		}
-		if *bufferSize > 0 {
-			//nolint:errcheck
-			WithBufferSize(*bufferSize)(c)
+		if set["buffer-size"] {
+			if err := WithBufferSize(*bufferSize)(c); err != nil {
+				return err
+			}
 		}
-		if *tlsEnabled {
+		if set["tls-enabled"] {
 			//nolint:errcheck
 			WithTlSEnabled(*tlsEnabled)(c)
 		}
-		if *certFilePath != "" {
+		if set["cert-file-path"] {
 			if err := WithCertFilePath(*certFilePath)(c); err != nil {
 				return err
 			}
 		}
-		if *keyFilePath != "" {
+		if set["key-file-path"] {
 			if err := WithKeyFilePath(*keyFilePath)(c); err != nil {
 				return err
 			}
 		}
+		if !set["backend-tls"] {
+			backendTLS = nil
+		}
+		if !set["backend-server-name"] {
+			backendServerName = nil
+		}
+		return applyBackendTLS(c, backendTLS, backendServerName)
+	}
+}
+
+// Layered combines config sources in a fixed order of precedence, whatever order
+// the caller has them in: file, then env, then flags, then explicit options. Each
+// source only writes the settings it actually specifies, so a higher layer
+// overrides just those. Nil sources are skipped.
+func Layered(file, env, flags Option, explicit ...Option) Option {
+	return func(c *config) error {
+		layers := []struct {
+			name    string
+			options []Option
+		}{
+			{"config file", []Option{file}},
+			{"env", []Option{env}},
+			{"flags", []Option{flags}},
+			{"option", explicit},
+		}
+		for _, layer := range layers {
+			for _, opt := range layer.options {
+				if opt == nil {
+					continue
+				}
+				if err := opt(c); err != nil {
+					return fmt.Errorf("%s: %w", layer.name, err)
+				}
+			}
+		}
 		return nil
 	}
 }
 
 // ---- Helpers ----
 
+// validate checks the config as a whole once every option has been applied, so
+// combinations that can't work fail in CreateProxy rather than when Run starts
+func (c config) validate() error {
+	if err := validateAddr(c.listenNetwork, c.listenAddr); err != nil {
+		return fmt.Errorf("listen address: %w", err)
+	}
+	if err := validateAddr(c.backendNetwork, c.backendAddr); err != nil {
+		return fmt.Errorf("backend address: %w", err)
+	}
+	if c.bufferSize <= 0 || c.replyBufferSize <= 0 {
+		return errors.New("buffer size must be positive")
+	}
+	if c.tlsEnabled && c.certificate == nil {
+		if err := validateTLSFile("cert", c.certFilePath); err != nil {
+			return err
+		}
+		if err := validateTLSFile("key", c.keyFilePath); err != nil {
+			return err
+		}
+	}
+	if c.clientCAs != nil && !c.tlsEnabled {
+		return errors.New("client certificate verification requires tls")
+	}
+	if c.adminToken != "" && c.adminAddr == "" {
+		return errors.New("admin token requires an admin http address")
+	}
+	if c.drainOnUnhealthy && c.breakerFailures == 0 {
+		return errors.New("drain on unhealthy requires a circuit breaker")
+	}
+	if c.noSessionTickets && len(c.sessionTicketKeys) > 0 {
+		return errors.New("session ticket keys cannot be combined with disabled session tickets")
+	}
+	if c.connectMode && c.socks5Mode {
+		return errors.New("connect mode and socks5 mode are mutually exclusive")
+	}
+	if c.acceptors > 1 && c.listenNetwork == "unix" {
+		return errors.New("multiple acceptors require a tcp listener")
+	}
+	if c.backendPoolSize > 0 && (c.connectMode || c.socks5Mode || c.udp) {
+		return errors.New("backend pool needs a fixed backend and cannot be combined with connect, socks5 or udp mode")
+	}
+	if !c.allowSelfLoop && c.selfLoop() {
+		return fmt.Errorf("backend address %s is the proxy's own listen address; use WithAllowSelfLoop if this is intended",
+			displayAddr(c.backendNetwork, c.backendAddr))
+	}
+	if c.inheritListener && (c.acceptors > 1 || len(c.listenAddrs) > 1 || c.udp) {
+		return errors.New("an inherited listener cannot be combined with multiple acceptors, listen addresses or udp mode")
+	}
+	if len(c.routes) > 0 && !c.tlsEnabled && !c.connectMode && !c.socks5Mode {
+		return errors.New("routes need tls, connect or socks5 mode to match on")
+	}
+	if len(c.clientGreeting) > 0 && (c.connectMode || c.socks5Mode || c.udp) {
+		return errors.New("client greeting cannot be combined with connect, socks5 or udp mode")
+	}
+	if c.mirrorAddr != "" && c.udp {
+		return errors.New("mirror backend cannot be combined with udp mode")
+	}
+	if c.udp && len(c.listenAddrs) > 1 {
+		return errors.New("udp mode supports a single listen address")
+	}
+	if c.udp && (c.tlsEnabled || c.connectMode || c.socks5Mode || c.listenNetwork == "unix" || c.backendNetwork == "unix") {
+		return errors.New("udp mode cannot be combined with tls, connect, socks5 mode or unix sockets")
+	}
+	return nil
+}
+
+func defaultConfig() config {
+	return config{
+		listenAddr:      listenAddrDefault,
+		listenNetwork:   "tcp",
+		backendAddr:     backendAddrDefault,
+		backendNetwork:  "tcp",
+		bufferSize:      bufferSizeDefault,
+		replyBufferSize: bufferSizeDefault,
+		tlsEnabled:      tlsEnabledDefault,
+		noDelay:         noDelayDefault,
+
+		tlsHandshakeTimeout: tlsHandshakeTimeoutDefault,
+		connectTimeout:      connectTimeoutDefault,
+		minTLSVersion:       minTLSVersionDefault,
+		udpSessionTimeout:   udpSessionTimeoutDefault,
+		backendPoolMaxIdle:  backendPoolMaxIdleDefault,
+		maxHandshakeBytes:   maxHandshakeBytesDefault,
+		tracerProvider:      noop.NewTracerProvider(),
+		meterProvider:       metricnoop.NewMeterProvider(),
+		logger:              slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo})),
+
+		backendTLSHandshakeTimeout: backendTLSTimeoutDefault,
+	}
+}
+
+// view exports the settings exposed through Config. Unix socket addresses are
+// shown with the unix:// prefix WithBackendAddr accepts.
+func (c config) view() Config {
+	return Config{
+		ListenAddr:  displayAddr(c.listenNetwork, c.listenAddr),
+		BackendAddr: displayAddr(c.backendNetwork, c.backendAddr),
+		BufferSize:  c.bufferSize,
+		TLSEnabled:  c.tlsEnabled,
+	}
+}
+
+// String describes the effective config for logging. Cert and key paths are cut
+// down to their file name and credentials are never included.
+func (c config) String() string {
+	listen := c.listenAddr
+	if len(c.listenAddrs) > 1 {
+		listen = strings.Join(c.listenAddrs, ",")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "listen=%s backend=%s buffer_size=%d tls=%t",
+		displayAddr(c.listenNetwork, listen), displayAddr(c.backendNetwork, c.backendAddr), c.bufferSize, c.tlsEnabled)
+	if c.replyBufferSize != c.bufferSize {
+		fmt.Fprintf(&b, " reply_buffer_size=%d", c.replyBufferSize)
+	}
+	if c.tlsEnabled && c.certificate != nil {
+		b.WriteString(" cert=[in memory]")
+	} else if c.tlsEnabled {
+		fmt.Fprintf(&b, " cert=%s key=%s", redactPath(c.certFilePath), redactPath(c.keyFilePath))
+	}
+	if c.socks5Username != "" {
+		b.WriteString(" socks5_credentials=[redacted]")
+	}
+	return b.String()
+}
+
+func displayAddr(network, addr string) string {
+	if network == "unix" {
+		return unixAddrPrefix + addr
+	}
+	return addr
+}
+
+// redactPath keeps only the file name so logs don't reveal where secrets live
+func redactPath(path string) string {
+	if path == "" {
+		return "[unset]"
+	}
+	return ".../" + filepath.Base(path)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func validateAddr(network, addr string) error {
+	if network == "unix" {
+		if addr == "" {
+			return errors.New("unix socket path must not be empty")
+		}
+		return nil
+	}
+	_, _, err := parseAddress(addr)
+	return err
+}
+
+// logWarnings logs settings that are allowed but likely to be mistakes
+func (c config) logWarnings(logger *slog.Logger) {
+	if c.allowSelfLoop && c.selfLoop() {
+		logger.Warn("backend address is the proxy's own listen address, every client will be relayed back to the proxy", "backend", c.backendAddr)
+	}
+	if c.bufferSize > largeBufferSize || c.replyBufferSize > largeBufferSize {
+		logger.Warn("relay buffers are unusually large; WithBufferSize takes KiB, not bytes",
+			"buffer_size", c.bufferSize, "reply_buffer_size", c.replyBufferSize, "per_connection", c.bufferSize+c.replyBufferSize)
+	}
+}
+
+// selfLoop reports whether the fixed backend is one of the proxy's own listen
+// addresses, so the proxy would dial itself for every client
+func (c config) selfLoop() bool {
+	if c.connectMode || c.socks5Mode {
+		return false
+	}
+	listenAddrs := c.listenAddrs
+	if len(listenAddrs) == 0 {
+		listenAddrs = []string{c.listenAddr}
+	}
+	for _, listen := range listenAddrs {
+		if reachesListener(c.listenNetwork, listen, c.backendNetwork, c.backendAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachesListener reports whether dialing backend would connect to a listener
+// bound to listen. Hosts are compared without DNS lookups: localhost counts as
+// loopback, and a listener on an unspecified address is reached through loopback
+// and every local interface address.
+func reachesListener(listenNetwork, listen, backendNetwork, backend string) bool {
+	if listenNetwork == "unix" || backendNetwork == "unix" {
+		return listenNetwork == backendNetwork && filepath.Clean(listen) == filepath.Clean(backend)
+	}
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	backendHost, backendPort, err := net.SplitHostPort(backend)
+	// Port 0 binds an ephemeral port no configured backend can know about
+	if err != nil || listenPort != backendPort || listenPort == "0" {
+		return false
+	}
+	if strings.EqualFold(listenHost, backendHost) {
+		return true
+	}
+	backendIP, err := netip.ParseAddr(backendHost)
+	// Dialing localhost or an unspecified address connects over loopback
+	anyLoopback := strings.EqualFold(backendHost, "localhost") || err == nil && backendIP.IsUnspecified()
+	if err != nil && !anyLoopback {
+		return false
+	}
+	backendIP = backendIP.Unmap()
+	if listenHost == "" {
+		return anyLoopback || backendIP.IsLoopback() || isLocalIP(backendIP)
+	}
+	listenIP, err := netip.ParseAddr(listenHost)
+	switch {
+	case err != nil:
+		return false
+	case listenIP.IsUnspecified():
+		return anyLoopback || backendIP.IsLoopback() || isLocalIP(backendIP)
+	case listenIP.IsLoopback():
+		return anyLoopback || backendIP == listenIP.Unmap()
+	default:
+		return backendIP == listenIP.Unmap()
+	}
+}
+
+// isLocalIP reports whether ip is assigned to one of this host's interfaces
+func isLocalIP(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if prefix, err := netip.ParsePrefix(addr.String()); err == nil && prefix.Addr().Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTLSFile checks that a TLS cert or key file is configured and can be opened
+func validateTLSFile(kind, path string) error {
+	if path == "" {
+		return fmt.Errorf("tls is enabled but no %s file path is set", kind)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("tls %s file: %w", kind, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("tls %s file %s is a directory", kind, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("tls %s file: %w", kind, err)
+	}
+	//nolint:errcheck
+	f.Close()
+	return nil
+}
+
+// parseLocalAddr parses an IP address, or an IP address and port, without resolving any names
+func parseLocalAddr(addr string) (*net.TCPAddr, error) {
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)), nil
+	}
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(addrPort), nil
+}
+
 func parseAddress(addr string) (string, string, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -1,12 +1,17 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaults(t *testing.T) {
@@ -27,6 +32,78 @@ func TestDefaults(t *testing.T) {
 	if p.config.tlsEnabled != tlsEnabledDefault {
 		t.Errorf("expected default TLS %v, got %v", tlsEnabledDefault, p.config.tlsEnabled)
 	}
+	if p.config.tlsHandshakeTimeout != tlsHandshakeTimeoutDefault {
+		t.Errorf("expected default TLS handshake timeout %v, got %v", tlsHandshakeTimeoutDefault, p.config.tlsHandshakeTimeout)
+	}
+	if p.config.minTLSVersion != tls.VersionTLS12 {
+		t.Errorf("expected default min TLS version %#04x, got %#04x", tls.VersionTLS12, p.config.minTLSVersion)
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	want := Config{
+		ListenAddr:  listenAddrDefault,
+		BackendAddr: backendAddrDefault,
+		BufferSize:  bufferSizeDefault,
+		TLSEnabled:  tlsEnabledDefault,
+	}
+	if got := DefaultConfig(); got != want {
+		t.Errorf("DefaultConfig() = %+v, want %+v", got, want)
+	}
+
+	p, err := CreateProxy()
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if got := p.Config(); got != want {
+		t.Errorf("Config() = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfigAccessors(t *testing.T) {
+	p, err := CreateProxy(WithListenAddr("0.0.0.0:8443"), WithUnixBackend("/run/backend.sock"), WithBufferSize(64))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if got := p.ListenAddr(); got != "0.0.0.0:8443" {
+		t.Errorf("ListenAddr() = %q", got)
+	}
+	if got := p.BackendAddr(); got != "unix:///run/backend.sock" {
+		t.Errorf("BackendAddr() = %q", got)
+	}
+	if got := p.BufferSize(); got != 64*1024 {
+		t.Errorf("BufferSize() = %d", got)
+	}
+
+	if err := p.Reload(WithBackendAddr("127.0.0.1:9001")); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if got := p.BackendAddr(); got != "127.0.0.1:9001" {
+		t.Errorf("BackendAddr() after reload = %q", got)
+	}
+}
+
+func TestDefaultsWithTLSFailFast(t *testing.T) {
+	// Enabling TLS on top of the defaults fails in CreateProxy, not when Run builds the listener
+	_, err := CreateProxy(WithTlSEnabled(true))
+	if err == nil || !strings.Contains(err.Error(), "tls is enabled but no cert file path is set") {
+		t.Fatalf("expected missing cert error, got %v", err)
+	}
+
+	certFile, _, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("create temp cert and key: %v", err)
+	}
+	_, err = CreateProxy(WithTlSEnabled(true), WithCertFilePath(certFile))
+	if err == nil || !strings.Contains(err.Error(), "tls is enabled but no key file path is set") {
+		t.Fatalf("expected missing key error, got %v", err)
+	}
+
+	// A directory passes the option's stat check but can't be used as a key
+	_, err = CreateProxy(WithTlSEnabled(true), WithCertFilePath(certFile), WithKeyFilePath(t.TempDir()))
+	if err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Fatalf("expected key file directory error, got %v", err)
+	}
 }
 
 // -------------------- Positive tests --------------------
@@ -71,8 +148,8 @@ func TestFromEnv(t *testing.T) {
 	if p.config.backendAddr != "127.0.0.1:8888" {
 		t.Errorf("expected backend addr %q, got %q", "127.0.0.1:8888", p.config.backendAddr)
 	}
-	if p.config.bufferSize != 64 {
-		t.Errorf("expected buffer size 64, got %d", p.config.bufferSize)
+	if p.config.bufferSize != 64*bufferSizeUnit {
+		t.Errorf("expected buffer size 64 KiB, got %d bytes", p.config.bufferSize)
 	}
 	if !p.config.tlsEnabled {
 		t.Errorf("expected TLS enabled")
@@ -111,7 +188,7 @@ func TestWithFlags(t *testing.T) {
 	if p.config.backendAddr != "127.0.0.1:7001" {
 		t.Errorf("got backend addr %q", p.config.backendAddr)
 	}
-	if p.config.bufferSize != 256 {
+	if p.config.bufferSize != 256*bufferSizeUnit {
 		t.Errorf("got buffer size %d", p.config.bufferSize)
 	}
 	if !p.config.tlsEnabled {
@@ -125,6 +202,223 @@ func TestWithFlags(t *testing.T) {
 	}
 }
 
+// TestWithFlagsKeepsOtherSources tests that flags left at their defaults don't override earlier options
+func TestWithFlagsKeepsOtherSources(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	os.Args = []string{"cmd", "-buffer-size", "8"}
+
+	p, err := CreateProxy(WithListenAddr("127.0.0.1:7000"), WithBackendAddr("127.0.0.1:7001"), WithFlags())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.config.listenAddr != "127.0.0.1:7000" || p.config.backendAddr != "127.0.0.1:7001" {
+		t.Errorf("got listen %q and backend %q, want the values set before WithFlags", p.config.listenAddr, p.config.backendAddr)
+	}
+	if p.config.bufferSize != 8*bufferSizeUnit {
+		t.Errorf("got buffer size %d", p.config.bufferSize)
+	}
+}
+
+// TestConfigPresence tests that loaders apply fields set to zero or false and skip the ones left out
+func TestConfigPresence(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.tlsEnabled = true
+	if err := WithConfigJSON([]byte(`{"tls_enabled": false}`))(&cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.tlsEnabled {
+		t.Error("expected tls_enabled: false to turn TLS off")
+	}
+	if cfg.listenAddr != listenAddrDefault || cfg.bufferSize != bufferSizeDefault {
+		t.Errorf("fields missing from the file changed: listen %q, buffer size %d", cfg.listenAddr, cfg.bufferSize)
+	}
+	if err := WithConfigYAML([]byte("buffer_size: 0\n"))(&cfg); err == nil || !strings.Contains(err.Error(), "buffer size must be positive") {
+		t.Errorf("expected buffer_size: 0 to be rejected, got %v", err)
+	}
+	if err := WithConfigTOML([]byte(`listen_addr = ""`))(&cfg); err == nil {
+		t.Error("expected an empty listen_addr to be rejected")
+	}
+
+	resetFlags()
+	defer resetFlags()
+	os.Args = []string{"cmd", "-tls-enabled=false"}
+	cfg.tlsEnabled = true
+	if err := WithFlags()(&cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.tlsEnabled {
+		t.Error("expected -tls-enabled=false to turn TLS off")
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-buffer-size", "0"}
+	if err := WithFlags()(&cfg); err == nil || !strings.Contains(err.Error(), "buffer size must be positive") {
+		t.Errorf("expected -buffer-size 0 to be rejected, got %v", err)
+	}
+}
+
+// TestDisableTLSOverride tests that every loader can turn off TLS enabled by an earlier source
+func TestDisableTLSOverride(t *testing.T) {
+	certFile, keyFile, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("create temp cert and key: %v", err)
+	}
+	base := []Option{WithTlSEnabled(true), WithCertFilePath(certFile), WithKeyFilePath(keyFile)}
+	t.Setenv("NOTLS_TLS_ENABLED", "false")
+
+	for _, tt := range []struct {
+		name     string
+		override func() Option
+	}{
+		{"json", func() Option { return WithConfigJSON([]byte(`{"tls_enabled": false}`)) }},
+		{"yaml", func() Option { return WithConfigYAML([]byte("tls_enabled: false\n")) }},
+		{"toml", func() Option { return WithConfigTOML([]byte("tls_enabled = false\n")) }},
+		{"env", func() Option { return FromEnv("NOTLS") }},
+		{"flags", func() Option {
+			resetFlags()
+			os.Args = []string{"cmd", "-tls-enabled=false"}
+			return WithFlags()
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetFlags()
+			p, err := CreateProxy(append(base, tt.override())...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.config.tlsEnabled {
+				t.Error("expected the later source to disable TLS")
+			}
+		})
+	}
+
+	// Layered gives the env the last word over a file that enables TLS
+	file := WithConfigJSON([]byte(`{"tls_enabled": true}`))
+	p, err := CreateProxy(Layered(file, FromEnv("NOTLS"), nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.config.tlsEnabled {
+		t.Error("expected the env to disable TLS enabled by the file")
+	}
+
+	t.Setenv("NOTLS_TLS_ENABLED", "maybe")
+	if _, err := CreateProxy(FromEnv("NOTLS")); err == nil || !strings.Contains(err.Error(), "tls enabled") {
+		t.Errorf("expected tls enabled parse error, got %v", err)
+	}
+}
+
+// TestBackendTLSSources tests that every loader can turn on backend TLS with a server name and turn it off again
+func TestBackendTLSSources(t *testing.T) {
+	t.Setenv("BTLS_BACKEND_TLS", "true")
+	t.Setenv("BTLS_BACKEND_SERVER_NAME", "backend.internal")
+	t.Setenv("NOBTLS_BACKEND_TLS", "false")
+
+	for _, tt := range []struct {
+		name    string
+		enable  func() Option
+		disable func() Option
+	}{
+		{
+			"json",
+			func() Option {
+				return WithConfigJSON([]byte(`{"backend_tls": true, "backend_server_name": "backend.internal"}`))
+			},
+			func() Option { return WithConfigJSON([]byte(`{"backend_tls": false}`)) },
+		},
+		{
+			"yaml",
+			func() Option {
+				return WithConfigYAML([]byte("backend_tls: true\nbackend_server_name: backend.internal\n"))
+			},
+			func() Option { return WithConfigYAML([]byte("backend_tls: false\n")) },
+		},
+		{
+			"toml",
+			func() Option {
+				return WithConfigTOML([]byte("backend_tls = true\nbackend_server_name = \"backend.internal\"\n"))
+			},
+			func() Option { return WithConfigTOML([]byte("backend_tls = false\n")) },
+		},
+		{"env", func() Option { return FromEnv("BTLS") }, func() Option { return FromEnv("NOBTLS") }},
+		{
+			"flags",
+			func() Option {
+				resetFlags()
+				os.Args = []string{"cmd", "-backend-tls", "-backend-server-name", "backend.internal"}
+				return WithFlags()
+			},
+			func() Option {
+				resetFlags()
+				os.Args = []string{"cmd", "-backend-tls=false"}
+				return WithFlags()
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetFlags()
+			p, err := CreateProxy(tt.enable())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !p.config.backendTLSEnabled || p.config.backendServerName != "backend.internal" {
+				t.Errorf("got backend tls %v with server name %q, want it on for backend.internal",
+					p.config.backendTLSEnabled, p.config.backendServerName)
+			}
+
+			p, err = CreateProxy(WithBackendTLS("backend.internal"), tt.disable())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.config.backendTLSEnabled {
+				t.Error("expected the later source to disable backend TLS")
+			}
+		})
+	}
+
+	t.Setenv("BTLS_BACKEND_TLS", "maybe")
+	if _, err := CreateProxy(FromEnv("BTLS")); err == nil || !strings.Contains(err.Error(), "backend tls") {
+		t.Errorf("expected backend tls parse error, got %v", err)
+	}
+}
+
+func TestLayered(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	os.Args = []string{"cmd", "-buffer-size", "16"}
+	t.Setenv("LAYERED_BACKEND_ADDR", "127.0.0.1:6002")
+	file := WithConfigJSON([]byte(`{"listen_addr": "127.0.0.1:6000", "backend_addr": "127.0.0.1:6001", "buffer_size": 4}`))
+
+	// The explicit option is listed first and the file last, yet precedence is fixed
+	p, err := CreateProxy(Layered(file, FromEnv("LAYERED"), WithFlags(), WithListenAddr("127.0.0.1:6003")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.config.listenAddr != "127.0.0.1:6003" {
+		t.Errorf("got listen addr %q, want the explicit option", p.config.listenAddr)
+	}
+	if p.config.backendAddr != "127.0.0.1:6002" {
+		t.Errorf("got backend addr %q, want the env value over the file", p.config.backendAddr)
+	}
+	if p.config.bufferSize != 16*bufferSizeUnit {
+		t.Errorf("got buffer size %d, want the flag over the file", p.config.bufferSize)
+	}
+
+	// Missing sources are skipped and errors name their layer
+	p, err = CreateProxy(Layered(file, nil, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.config.backendAddr != "127.0.0.1:6001" {
+		t.Errorf("got backend addr %q, want the file value", p.config.backendAddr)
+	}
+	_, err = CreateProxy(Layered(nil, FromEnv("LAYERED"), nil, WithBackendAddr("invalid")))
+	if err == nil || !strings.Contains(err.Error(), "option: ") {
+		t.Errorf("expected error from the option layer, got %v", err)
+	}
+}
+
 func TestWithConfigJSON(t *testing.T) {
 	jsonConfig := `{
 		"listen_addr": "0.0.0.0:1111",
@@ -133,7 +427,13 @@ func TestWithConfigJSON(t *testing.T) {
 		"tls_enabled": true
 	}`
 
-	p, err := CreateProxy(WithConfigJSON([]byte(jsonConfig)))
+	// TLS needs a cert and key to pass validation
+	certFile, keyFile, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("create temp cert and key: %v", err)
+	}
+
+	p, err := CreateProxy(WithConfigJSON([]byte(jsonConfig)), WithCertFilePath(certFile), WithKeyFilePath(keyFile))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -144,7 +444,7 @@ func TestWithConfigJSON(t *testing.T) {
 	if p.config.backendAddr != "0.0.0.0:2222" {
 		t.Errorf("got backend addr %q", p.config.backendAddr)
 	}
-	if p.config.bufferSize != 128 {
+	if p.config.bufferSize != 128*bufferSizeUnit {
 		t.Errorf("got buffer size %d", p.config.bufferSize)
 	}
 	if !p.config.tlsEnabled {
@@ -170,6 +470,297 @@ func TestWithConfigFile(t *testing.T) {
 	}
 }
 
+func TestWithConfigYAML(t *testing.T) {
+	yamlConfig := `
+listen_addr: 0.0.0.0:1111
+backend_addr: 0.0.0.0:2222
+buffer_size: 128
+tls_enabled: true
+`
+
+	// TLS needs a cert and key to pass validation
+	certFile, keyFile, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("create temp cert and key: %v", err)
+	}
+
+	p, err := CreateProxy(WithConfigYAML([]byte(yamlConfig)), WithCertFilePath(certFile), WithKeyFilePath(keyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if p.config.listenAddr != "0.0.0.0:1111" {
+		t.Errorf("got listen addr %q", p.config.listenAddr)
+	}
+	if p.config.backendAddr != "0.0.0.0:2222" {
+		t.Errorf("got backend addr %q", p.config.backendAddr)
+	}
+	if p.config.bufferSize != 128*bufferSizeUnit {
+		t.Errorf("got buffer size %d", p.config.bufferSize)
+	}
+	if !p.config.tlsEnabled {
+		t.Errorf("expected TLS enabled")
+	}
+}
+
+func TestWithConfigYAMLInvalid(t *testing.T) {
+	_, err := CreateProxy(WithConfigYAML([]byte("listen_addr: [unclosed")))
+	if err == nil || !strings.Contains(err.Error(), "parse yaml config") {
+		t.Errorf("expected YAML parse error, got %v", err)
+	}
+
+	_, err = CreateProxy(WithConfigYAML([]byte("buffer_size: -1")))
+	if err == nil || !strings.Contains(err.Error(), "must be positive") {
+		t.Errorf("expected buffer size error, got %v", err)
+	}
+
+	_, err = CreateProxy(WithBufferSizeBytes(-1))
+	if err == nil || !strings.Contains(err.Error(), "buffer size must be positive") {
+		t.Errorf("expected buffer size error, got %v", err)
+	}
+}
+
+func TestWithBufferSizeBytes(t *testing.T) {
+	p, err := CreateProxy(WithBufferSizeBytes(1500))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if got := len(*p.requestBufs.get()); got != 1500 {
+		t.Errorf("buffer length = %d, want 1500", got)
+	}
+
+	// The last buffer size option wins, whichever unit it uses
+	p, err = CreateProxy(WithBufferSizeBytes(1500), WithBufferSize(2))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if got := len(*p.requestBufs.get()); got != 2048 {
+		t.Errorf("buffer length = %d, want 2048", got)
+	}
+}
+
+func TestWithBufferSizes(t *testing.T) {
+	p, err := CreateProxy(WithBufferSizes(2, 8))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if got := len(*p.requestBufs.get()); got != 2*bufferSizeUnit {
+		t.Errorf("client to backend buffer length = %d, want %d", got, 2*bufferSizeUnit)
+	}
+	if got := len(*p.replyBufs.get()); got != 8*bufferSizeUnit {
+		t.Errorf("backend to client buffer length = %d, want %d", got, 8*bufferSizeUnit)
+	}
+
+	// WithBufferSize sets both directions
+	p, err = CreateProxy(WithBufferSizes(2, 8), WithBufferSize(4))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if p.config.bufferSize != 4*bufferSizeUnit || p.config.replyBufferSize != 4*bufferSizeUnit {
+		t.Errorf("got buffer sizes %d and %d, want %d for both", p.config.bufferSize, p.config.replyBufferSize, 4*bufferSizeUnit)
+	}
+
+	for _, sizes := range [][2]int{{0, 8}, {8, 0}, {-1, 8}} {
+		if _, err := CreateProxy(WithBufferSizes(sizes[0], sizes[1])); err == nil || !strings.Contains(err.Error(), "buffer size must be positive") {
+			t.Errorf("WithBufferSizes(%d, %d): expected buffer size error, got %v", sizes[0], sizes[1], err)
+		}
+	}
+}
+
+func TestLargeBufferSizeWarning(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		option  Option
+		warning bool
+	}{
+		{"default", WithBufferSize(32), false},
+		{"at the limit", WithBufferSize(4096), false},
+		{"bytes passed as KiB", WithBufferSize(65536), true},
+		{"large reply buffer", WithBufferSizes(32, 8192), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logBuf bytes.Buffer
+			if _, err := CreateProxy(tt.option, WithLogger(slog.New(slog.NewTextHandler(&logBuf, nil)))); err != nil {
+				t.Fatalf("CreateProxy() failed: %v", err)
+			}
+			if got := strings.Contains(logBuf.String(), "unusually large"); got != tt.warning {
+				t.Errorf("warning logged = %t, want %t (log: %q)", got, tt.warning, logBuf.String())
+			}
+		})
+	}
+}
+
+func TestWithConfigFileYAML(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.YML"} {
+		tmpFile := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(tmpFile, []byte("listen_addr: 1.2.3.4:5555\n"), 0o644); err != nil {
+			t.Fatalf("write config file: %v", err)
+		}
+
+		p, err := CreateProxy(WithConfigFile(tmpFile))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if p.config.listenAddr != "1.2.3.4:5555" {
+			t.Errorf("%s: expected listen addr 1.2.3.4:5555, got %q", name, p.config.listenAddr)
+		}
+	}
+}
+
+func TestWithConfigTOML(t *testing.T) {
+	tomlConfig := `
+listen_addr = "0.0.0.0:1111"
+backend_addr = "0.0.0.0:2222"
+buffer_size = 128
+tls_enabled = true
+`
+
+	// TLS needs a cert and key to pass validation
+	certFile, keyFile, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("create temp cert and key: %v", err)
+	}
+
+	p, err := CreateProxy(WithConfigTOML([]byte(tomlConfig)), WithCertFilePath(certFile), WithKeyFilePath(keyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if p.config.listenAddr != "0.0.0.0:1111" {
+		t.Errorf("got listen addr %q", p.config.listenAddr)
+	}
+	if p.config.backendAddr != "0.0.0.0:2222" {
+		t.Errorf("got backend addr %q", p.config.backendAddr)
+	}
+	if p.config.bufferSize != 128*bufferSizeUnit {
+		t.Errorf("got buffer size %d", p.config.bufferSize)
+	}
+	if !p.config.tlsEnabled {
+		t.Errorf("expected TLS enabled")
+	}
+}
+
+func TestWithConfigTOMLEmpty(t *testing.T) {
+	cfg := config{}
+	if err := WithConfigTOML(nil)(&cfg); err != nil {
+		t.Errorf("expected nil error for empty TOML, got %v", err)
+	}
+}
+
+func TestWithConfigTOMLInvalid(t *testing.T) {
+	_, err := CreateProxy(WithConfigTOML([]byte("listen_addr = ")))
+	if err == nil || !strings.Contains(err.Error(), "parse toml config") {
+		t.Errorf("expected TOML parse error, got %v", err)
+	}
+
+	_, err = CreateProxy(WithConfigTOML([]byte(`backend_addr = "invalid"`)))
+	if err == nil || !strings.Contains(err.Error(), "split host port") {
+		t.Errorf("expected parse address error, got %v", err)
+	}
+}
+
+func TestWithConfigFileTOML(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(tmpFile, []byte(`listen_addr = "1.2.3.4:5555"`), 0o644); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+
+	p, err := CreateProxy(WithConfigFile(tmpFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.config.listenAddr != "1.2.3.4:5555" {
+		t.Errorf("expected listen addr 1.2.3.4:5555, got %q", p.config.listenAddr)
+	}
+}
+
+func TestWithMinTLSVersion(t *testing.T) {
+	p, err := CreateProxy(WithMinTLSVersion(tls.VersionTLS13))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.config.minTLSVersion != tls.VersionTLS13 {
+		t.Errorf("expected min TLS version %#04x, got %#04x", tls.VersionTLS13, p.config.minTLSVersion)
+	}
+}
+
+func TestWithTLSCipherSuites(t *testing.T) {
+	suites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	p, err := CreateProxy(WithTLSCipherSuites(suites))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.config.tlsCipherSuites) != len(suites) {
+		t.Fatalf("expected %d cipher suites, got %d", len(suites), len(p.config.tlsCipherSuites))
+	}
+	for i, id := range suites {
+		if p.config.tlsCipherSuites[i] != id {
+			t.Errorf("expected cipher suite %#04x at %d, got %#04x", id, i, p.config.tlsCipherSuites[i])
+		}
+	}
+}
+
+func TestWithBackendCAFile(t *testing.T) {
+	certPath, _ := generateTempCert(t, t.TempDir())
+	p, err := CreateProxy(WithBackendTLS("backend.internal"), WithBackendCAFile(certPath))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.config.backendRootCAs == nil {
+		t.Errorf("expected backend root CAs to be set")
+	}
+	if !p.config.backendTLSEnabled || p.config.backendServerName != "backend.internal" {
+		t.Errorf("expected backend TLS enabled for %q, got %v for %q", "backend.internal", p.config.backendTLSEnabled, p.config.backendServerName)
+	}
+}
+
+func TestWithALPNProtocols(t *testing.T) {
+	p, err := CreateProxy(WithALPNProtocols([]string{"h2", "http/1.1"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(p.config.alpnProtocols, ",") != "h2,http/1.1" {
+		t.Errorf("got alpn protocols %q", p.config.alpnProtocols)
+	}
+}
+
+func TestWithLogOutput(t *testing.T) {
+	var logBuf bytes.Buffer
+	p, err := CreateProxy(WithLogOutput(&logBuf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.logger.Info("hello")
+	p.logger.Debug("too verbose")
+	if got := logBuf.String(); !strings.Contains(got, "msg=hello") || strings.Contains(got, "too verbose") {
+		t.Errorf("log output = %q, want the info line only", got)
+	}
+	if _, err := CreateProxy(WithLogOutput(nil)); err == nil || !strings.Contains(err.Error(), "log output is nil") {
+		t.Errorf("expected nil writer error, got %v", err)
+	}
+}
+
+func TestWithLogDisabled(t *testing.T) {
+	p, err := CreateProxy(WithLogDisabled())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.logger.Enabled(t.Context(), slog.LevelError) {
+		t.Error("expected logging to be disabled")
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	p, err := CreateProxy(WithLogger(logger))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.logger != logger {
+		t.Errorf("expected proxy to use the provided logger")
+	}
+}
+
 // -------------------- Negative tests --------------------
 
 func TestInvalidAddress(t *testing.T) {
@@ -193,6 +784,41 @@ func TestInvalidBufferSize(t *testing.T) {
 	}
 }
 
+func TestInvalidMaxConnLifetime(t *testing.T) {
+	_, err := CreateProxy(WithMaxConnLifetime(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("expected max connection lifetime error, got %v", err)
+	}
+}
+
+func TestInvalidTLSHandshakeTimeout(t *testing.T) {
+	_, err := CreateProxy(WithTLSHandshakeTimeout(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("expected TLS handshake timeout error, got %v", err)
+	}
+}
+
+func TestInvalidMinTLSVersion(t *testing.T) {
+	_, err := CreateProxy(WithMinTLSVersion(0x0999))
+	if err == nil || !strings.Contains(err.Error(), "unknown tls version") {
+		t.Errorf("expected unknown TLS version error, got %v", err)
+	}
+}
+
+func TestInvalidTLSCipherSuites(t *testing.T) {
+	// Unknown ID
+	_, err := CreateProxy(WithTLSCipherSuites([]uint16{0xffff}))
+	if err == nil || !strings.Contains(err.Error(), "cipher suite") {
+		t.Errorf("expected cipher suite error, got %v", err)
+	}
+
+	// Known but insecure suite
+	_, err = CreateProxy(WithTLSCipherSuites([]uint16{tls.TLS_RSA_WITH_RC4_128_SHA}))
+	if err == nil || !strings.Contains(err.Error(), "cipher suite") {
+		t.Errorf("expected cipher suite error, got %v", err)
+	}
+}
+
 func TestMissingCertFile(t *testing.T) {
 	_, err := CreateProxy(WithCertFilePath("/nonexistent/cert.pem"))
 	if err == nil || !strings.Contains(err.Error(), "cert file path") {
@@ -207,6 +833,196 @@ func TestMissingKeyFile(t *testing.T) {
 	}
 }
 
+func TestInvalidBackendCAFile(t *testing.T) {
+	_, err := CreateProxy(WithBackendCAFile("/nonexistent/ca.pem"))
+	if err == nil || !strings.Contains(err.Error(), "backend ca file") {
+		t.Errorf("expected backend CA file error, got %v", err)
+	}
+
+	// File exists but contains no certificates
+	certFile, _, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("create temp cert and key: %v", err)
+	}
+	_, err = CreateProxy(WithBackendCAFile(certFile))
+	if err == nil || !strings.Contains(err.Error(), "no valid certificates") {
+		t.Errorf("expected no valid certificates error, got %v", err)
+	}
+}
+
+func TestInvalidALPNProtocols(t *testing.T) {
+	_, err := CreateProxy(WithALPNProtocols([]string{"h2", ""}))
+	if err == nil || !strings.Contains(err.Error(), "invalid alpn protocol") {
+		t.Errorf("expected invalid ALPN protocol error, got %v", err)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	_, err := CreateProxy(WithLogger(nil))
+	if err == nil || !strings.Contains(err.Error(), "logger is nil") {
+		t.Errorf("expected nil logger error, got %v", err)
+	}
+}
+
+func TestInvalidMaxConnections(t *testing.T) {
+	_, err := CreateProxy(WithMaxConnections(-1))
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("expected max connections error, got %v", err)
+	}
+
+	_, err = CreateProxy(WithMaxConnectionsWait(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("expected max connections wait error, got %v", err)
+	}
+
+	_, err = CreateProxy(WithMaxConnectionsPerIP(-1))
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("expected max connections per ip error, got %v", err)
+	}
+}
+
+func TestInvalidRateLimit(t *testing.T) {
+	_, err := CreateProxy(WithRateLimit(-1))
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("expected rate limit error, got %v", err)
+	}
+}
+
+func TestInvalidSendProxyProtocol(t *testing.T) {
+	_, err := CreateProxy(WithSendProxyProtocol(3))
+	if err == nil || !strings.Contains(err.Error(), "unsupported proxy protocol version") {
+		t.Errorf("expected proxy protocol version error, got %v", err)
+	}
+}
+
+func TestInvalidConnectAllowlist(t *testing.T) {
+	_, err := CreateProxy(WithConnectAllowlist("example.com"))
+	if err == nil || !strings.Contains(err.Error(), "connect allowlist") {
+		t.Errorf("expected connect allowlist error, got %v", err)
+	}
+}
+
+func TestWithUnixListener(t *testing.T) {
+	p, err := CreateProxy(WithUnixListener("/tmp/proxy.sock"))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if p.config.listenNetwork != "unix" || p.config.listenAddr != "/tmp/proxy.sock" {
+		t.Errorf("got %s %q, want unix %q", p.config.listenNetwork, p.config.listenAddr, "/tmp/proxy.sock")
+	}
+
+	_, err = CreateProxy(WithUnixListener(""))
+	if err == nil || !strings.Contains(err.Error(), "unix socket path must not be empty") {
+		t.Errorf("expected empty path error, got %v", err)
+	}
+}
+
+func TestWithUnixBackend(t *testing.T) {
+	for _, opt := range []Option{WithUnixBackend("/run/backend.sock"), WithBackendAddr("unix:///run/backend.sock")} {
+		p, err := CreateProxy(opt)
+		if err != nil {
+			t.Fatalf("CreateProxy() failed: %v", err)
+		}
+		if p.config.backendNetwork != "unix" || p.config.backendAddr != "/run/backend.sock" {
+			t.Errorf("got %s %q, want unix %q", p.config.backendNetwork, p.config.backendAddr, "/run/backend.sock")
+		}
+	}
+
+	_, err := CreateProxy(WithBackendAddr("unix://"))
+	if err == nil || !strings.Contains(err.Error(), "unix socket path must not be empty") {
+		t.Errorf("expected empty path error, got %v", err)
+	}
+}
+
+func TestInvalidKeepAlive(t *testing.T) {
+	_, err := CreateProxy(WithKeepAlive(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "keepalive period must not be negative") {
+		t.Errorf("expected keepalive error, got %v", err)
+	}
+}
+
+func TestWithNoDelay(t *testing.T) {
+	p, err := CreateProxy()
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if !p.config.noDelay {
+		t.Error("expected TCP_NODELAY to be enabled by default")
+	}
+
+	p, err = CreateProxy(WithNoDelay(false))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if p.config.noDelay {
+		t.Error("expected WithNoDelay(false) to re-enable Nagle's algorithm")
+	}
+}
+
+func TestInvalidAcceptors(t *testing.T) {
+	_, err := CreateProxy(WithAcceptors(-1))
+	if err == nil || !strings.Contains(err.Error(), "acceptors must not be negative") {
+		t.Errorf("expected acceptors error, got %v", err)
+	}
+
+	_, err = CreateProxy(WithAcceptors(2), WithUnixListener("/tmp/proxy.sock"))
+	if err == nil || !strings.Contains(err.Error(), "multiple acceptors require a tcp listener") {
+		t.Errorf("expected unix listener error, got %v", err)
+	}
+}
+
+func TestInvalidDialer(t *testing.T) {
+	_, err := CreateProxy(WithDialer(nil))
+	if err == nil || !strings.Contains(err.Error(), "dialer is nil") {
+		t.Errorf("expected nil dialer error, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	certFile, keyFile, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("create temp cert and key: %v", err)
+	}
+	valid := config{listenNetwork: "tcp", listenAddr: listenAddrDefault, backendNetwork: "tcp", backendAddr: backendAddrDefault, bufferSize: bufferSizeDefault, replyBufferSize: bufferSizeDefault}
+
+	tests := []struct {
+		name    string
+		modify  func(c *config)
+		wantErr string
+	}{
+		{name: "defaults", modify: func(c *config) {}},
+		{name: "tls with readable cert and key", modify: func(c *config) {
+			c.tlsEnabled, c.certFilePath, c.keyFilePath = true, certFile, keyFile
+		}},
+		{name: "unix listener", modify: func(c *config) { c.listenNetwork, c.listenAddr = "unix", "/tmp/proxy.sock" }},
+		{name: "bad listen address", modify: func(c *config) { c.listenAddr = "nope" }, wantErr: "listen address"},
+		{name: "bad backend address", modify: func(c *config) { c.backendAddr = "nope" }, wantErr: "backend address"},
+		{name: "empty unix backend", modify: func(c *config) { c.backendNetwork, c.backendAddr = "unix", "" }, wantErr: "unix socket path must not be empty"},
+		{name: "zero buffer size", modify: func(c *config) { c.bufferSize = 0 }, wantErr: "buffer size must be positive"},
+		{name: "zero reply buffer size", modify: func(c *config) { c.replyBufferSize = 0 }, wantErr: "buffer size must be positive"},
+		{name: "tls without cert", modify: func(c *config) { c.tlsEnabled, c.keyFilePath = true, keyFile }, wantErr: "no cert file path is set"},
+		{name: "tls with missing key file", modify: func(c *config) {
+			c.tlsEnabled, c.certFilePath, c.keyFilePath = true, certFile, filepath.Join(t.TempDir(), "missing.pem")
+		}, wantErr: "missing.pem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			err := cfg.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
 func TestFromEnvInvalidValues(t *testing.T) {
 	// Invalid listen address
 	t.Setenv("BAD_LISTEN_ADDR_LISTEN_ADDR", "invalid")
@@ -424,3 +1240,212 @@ func createTempCertAndKey(t *testing.T) (string, string, error) {
 func resetFlags() {
 	flag.CommandLine = flag.NewFlagSet("cmd", flag.ExitOnError)
 }
+
+func TestWithListenAddrs(t *testing.T) {
+	cfg := &config{}
+	if err := WithListenAddrs("127.0.0.1:8080", ":9090")(cfg); err != nil {
+		t.Fatalf("WithListenAddrs() failed: %v", err)
+	}
+	if cfg.listenAddr != "127.0.0.1:8080" || len(cfg.listenAddrs) != 2 || cfg.listenAddrs[1] != ":9090" {
+		t.Errorf("listenAddr = %q, listenAddrs = %v", cfg.listenAddr, cfg.listenAddrs)
+	}
+
+	if err := WithListenAddrs()(cfg); err == nil {
+		t.Error("expected error for no addresses")
+	}
+	if err := WithListenAddrs("127.0.0.1:8080", "bad")(cfg); err == nil || !strings.Contains(err.Error(), `"bad"`) {
+		t.Errorf("expected error naming the bad address, got %v", err)
+	}
+
+	_, err := CreateProxy(WithUDP(true), WithListenAddrs("127.0.0.1:8080", "127.0.0.1:8081"))
+	if err == nil || !strings.Contains(err.Error(), "udp mode supports a single listen address") {
+		t.Errorf("expected udp error, got %v", err)
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	certFile, keyFile, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("Failed to create temp cert and key: %v", err)
+	}
+	p, err := CreateProxy(
+		WithListenAddr("127.0.0.1:8443"),
+		WithBackendAddr("unix:///run/backend.sock"),
+		WithTlSEnabled(true),
+		WithCertFilePath(certFile),
+		WithKeyFilePath(keyFile),
+		WithSocks5Mode(true),
+		WithSocks5Credentials("user", "hunter2"),
+	)
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+
+	got := p.ConfigString()
+	for _, want := range []string{
+		"listen=127.0.0.1:8443",
+		"backend=unix:///run/backend.sock",
+		"buffer_size=32768",
+		"tls=true",
+		"cert=.../" + filepath.Base(certFile),
+		"socks5_credentials=[redacted]",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ConfigString() = %q, missing %q", got, want)
+		}
+	}
+	for _, secret := range []string{filepath.Dir(certFile), filepath.Dir(keyFile), "hunter2"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("ConfigString() = %q, leaks %q", got, secret)
+		}
+	}
+}
+
+func TestInvalidCIDRs(t *testing.T) {
+	_, err := CreateProxy(WithAllowedCIDRs([]string{"10.0.0.0/8", "10.0.0.1"}))
+	if err == nil || !strings.Contains(err.Error(), "allowed cidrs") {
+		t.Errorf("expected allowed cidrs error, got %v", err)
+	}
+	_, err = CreateProxy(WithDeniedCIDRs([]string{"not-a-cidr"}))
+	if err == nil || !strings.Contains(err.Error(), "denied cidrs") {
+		t.Errorf("expected denied cidrs error, got %v", err)
+	}
+}
+
+func TestInvalidWriteTimeout(t *testing.T) {
+	_, err := CreateProxy(WithWriteTimeout(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "write timeout must not be negative") {
+		t.Errorf("expected write timeout error, got %v", err)
+	}
+}
+
+func TestInvalidReadTimeout(t *testing.T) {
+	_, err := CreateProxy(WithReadTimeout(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "read timeout must not be negative") {
+		t.Errorf("expected read timeout error, got %v", err)
+	}
+}
+
+func TestInvalidFirstByteTimeout(t *testing.T) {
+	_, err := CreateProxy(WithFirstByteTimeout(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "first byte timeout must not be negative") {
+		t.Errorf("expected first byte timeout error, got %v", err)
+	}
+}
+
+func TestInvalidMaxHandshakeBytes(t *testing.T) {
+	_, err := CreateProxy(WithMaxHandshakeBytes(0))
+	if err == nil || !strings.Contains(err.Error(), "max handshake bytes must be positive") {
+		t.Errorf("expected max handshake bytes error, got %v", err)
+	}
+}
+
+func TestInvalidBackendSocketBuffers(t *testing.T) {
+	_, err := CreateProxy(WithBackendSocketBuffers(0, -1))
+	if err == nil || !strings.Contains(err.Error(), "backend socket buffer sizes must not be negative") {
+		t.Errorf("expected backend socket buffer error, got %v", err)
+	}
+}
+
+func TestInvalidAllowedDestPorts(t *testing.T) {
+	_, err := CreateProxy(WithAllowedDestPorts([]int{443, 0}))
+	if err == nil || !strings.Contains(err.Error(), "allowed destination port 0 out of range") {
+		t.Errorf("expected port range error, got %v", err)
+	}
+}
+
+func TestInvalidClientGreeting(t *testing.T) {
+	_, err := CreateProxy(WithConnectMode(true), WithClientGreeting([]byte("hello\r\n")))
+	if err == nil || !strings.Contains(err.Error(), "client greeting cannot be combined") {
+		t.Errorf("expected client greeting error, got %v", err)
+	}
+}
+
+func TestInvalidAccessLog(t *testing.T) {
+	_, err := CreateProxy(WithAccessLog(nil))
+	if err == nil || !strings.Contains(err.Error(), "access log writer is nil") {
+		t.Errorf("expected nil writer error, got %v", err)
+	}
+	_, err = CreateProxy(WithAccessLogFormat(AccessLogFormat(9)))
+	if err == nil || !strings.Contains(err.Error(), "unknown access log format") {
+		t.Errorf("expected access log format error, got %v", err)
+	}
+}
+
+func TestInvalidDialOptions(t *testing.T) {
+	_, err := CreateProxy(WithDialNetwork("udp"))
+	if err == nil || !strings.Contains(err.Error(), `unsupported dial network "udp"`) {
+		t.Errorf("expected dial network error, got %v", err)
+	}
+	_, err = CreateProxy(WithDualStack(true, -time.Second))
+	if err == nil || !strings.Contains(err.Error(), "fallback delay must not be negative") {
+		t.Errorf("expected fallback delay error, got %v", err)
+	}
+}
+
+func TestInvalidDNSCacheTTL(t *testing.T) {
+	_, err := CreateProxy(WithDNSCacheTTL(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "dns cache ttl must not be negative") {
+		t.Errorf("expected dns cache ttl error, got %v", err)
+	}
+}
+
+func TestInvalidCircuitBreaker(t *testing.T) {
+	_, err := CreateProxy(WithCircuitBreaker(0, time.Minute, time.Minute))
+	if err == nil || !strings.Contains(err.Error(), "circuit breaker failures must be positive") {
+		t.Errorf("expected failures error, got %v", err)
+	}
+	_, err = CreateProxy(WithCircuitBreaker(3, 0, time.Minute))
+	if err == nil || !strings.Contains(err.Error(), "window and cooldown must be positive") {
+		t.Errorf("expected window error, got %v", err)
+	}
+}
+
+func TestInvalidDrainOnUnhealthy(t *testing.T) {
+	_, err := CreateProxy(WithDrainOnUnhealthy(true))
+	if err == nil || !strings.Contains(err.Error(), "drain on unhealthy requires a circuit breaker") {
+		t.Errorf("expected circuit breaker error, got %v", err)
+	}
+}
+
+func TestInvalidHandlerPool(t *testing.T) {
+	_, err := CreateProxy(WithHandlerPool(-1))
+	if err == nil || !strings.Contains(err.Error(), "handler pool size must not be negative") {
+		t.Errorf("expected handler pool error, got %v", err)
+	}
+}
+
+func TestSelfLoop(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options []Option
+		loop    bool
+	}{
+		{"same address", []Option{WithListenAddr("127.0.0.1:8080"), WithBackendAddr("127.0.0.1:8080")}, true},
+		{"localhost backend", []Option{WithListenAddr("127.0.0.1:8080"), WithBackendAddr("localhost:8080")}, true},
+		{"all interfaces", []Option{WithListenAddr(":8080"), WithBackendAddr("127.0.0.1:8080")}, true},
+		{"unspecified backend", []Option{WithListenAddr("0.0.0.0:8080"), WithBackendAddr("0.0.0.0:8080")}, true},
+		{"one of several listen addresses", []Option{WithListenAddrs("127.0.0.1:8080", "127.0.0.1:8081"), WithBackendAddr("127.0.0.1:8081")}, true},
+		{"same unix socket", []Option{WithUnixListener("/tmp/proxy.sock"), WithUnixBackend("/tmp/./proxy.sock")}, true},
+		{"different port", []Option{WithListenAddr("127.0.0.1:8080"), WithBackendAddr("127.0.0.1:9000")}, false},
+		{"different loopback address", []Option{WithListenAddr("127.0.0.1:8080"), WithBackendAddr("127.0.0.2:8080")}, false},
+		{"remote backend", []Option{WithListenAddr(":8080"), WithBackendAddr("192.0.2.1:8080")}, false},
+		{"ephemeral port", []Option{WithListenAddr("127.0.0.1:0"), WithBackendAddr("127.0.0.1:0")}, false},
+		{"connect mode", []Option{WithListenAddr("127.0.0.1:8080"), WithBackendAddr("127.0.0.1:8080"), WithConnectMode(true)}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CreateProxy(tt.options...)
+			if tt.loop && (err == nil || !strings.Contains(err.Error(), "own listen address")) {
+				t.Errorf("expected self-loop error, got %v", err)
+			}
+			if !tt.loop && err != nil {
+				t.Errorf("CreateProxy() failed: %v", err)
+			}
+			if tt.loop {
+				if _, err := CreateProxy(append(tt.options, WithAllowSelfLoop(true))...); err != nil {
+					t.Errorf("CreateProxy() with WithAllowSelfLoop failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -2,79 +2,770 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func readAndWrite(ctx context.Context, connToRead net.Conn, connToWrite net.Conn, cancelConn context.CancelFunc, wg *sync.WaitGroup, bufPool *sync.Pool) {
+const (
+	// firstReadSize is how much is read up front when waiting for the client's first bytes
+	firstReadSize = 512
+	// backendProbeWait is how long WithBackendProbe watches a new backend connection
+	backendProbeWait = 5 * time.Millisecond
+)
+
+// ContextDialer dials backend connections. *net.Dialer implements it, as do
+// most proxy and service mesh dialers.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// connIDKey is the context key for the ID acceptLoop gives each connection
+type connIDKey struct{}
+
+func withConnID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// connIDFrom returns the connection ID carried by ctx, or 0 if there is none
+func connIDFrom(ctx context.Context) uint64 {
+	id, _ := ctx.Value(connIDKey{}).(uint64)
+	return id
+}
+
+// clientAddrKey is the context key for the client address handle records for each connection
+type clientAddrKey struct{}
+
+// ClientAddr returns the source address of the client a connection's context
+// belongs to, as accepted by the proxy and after any PROXY protocol header was
+// applied. Middleware should use it rather than the RemoteAddr of a conn that
+// may have been wrapped.
+func ClientAddr(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr, ok
+}
+
+// connLogger returns the proxy logger tagged with the connection ID carried by ctx, if any
+func (p *Proxy) connLogger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(connIDKey{}).(uint64); ok {
+		return p.logger.With("conn_id", id)
+	}
+	return p.logger
+}
+
+// readAndWrite copies data from connToRead to connToWrite until connToRead reaches
+// EOF, either side fails or the context is cancelled, and returns the number of
+// bytes written. The buffer comes from bufs, and written bytes are also added to
+// counter as they go.
+func (p *Proxy) readAndWrite(ctx context.Context, connToRead net.Conn, connToWrite net.Conn, cancelConn context.CancelFunc, wg *sync.WaitGroup, bufs *bufferPool, counter *atomic.Int64) int64 {
 	defer wg.Done()
-	buf := bufPool.Get().([]byte)
-	defer bufPool.Put(&buf)
+	log := p.connLogger(ctx)
+	bufPtr := bufs.get()
+	defer bufs.put(bufPtr)
+	buf := *bufPtr
+	readTimeout := p.readTimeout(ctx)
 
+	done := make(chan struct{})
+	defer close(done)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
+		// Stop reading but let a write in progress finish, up to the flush timeout
+		if flush := p.config.flushTimeout; flush > 0 {
+			//nolint:errcheck
+			connToRead.SetReadDeadline(time.Now())
+			//nolint:errcheck
+			connToWrite.SetWriteDeadline(time.Now().Add(flush))
+			timer := time.NewTimer(flush)
+			select {
+			case <-done:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
 		//nolint:errcheck
 		connToRead.Close()
 		//nolint:errcheck
 		connToWrite.Close()
 	}()
 
+	var total int64
 	for {
+		// Nothing new is read once the connection is being torn down
+		if ctx.Err() != nil {
+			return total
+		}
+		if readTimeout > 0 {
+			//nolint:errcheck
+			connToRead.SetReadDeadline(time.Now().Add(readTimeout))
+		}
 		n, err := connToRead.Read(buf)
 		if err != nil {
-			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
-				log.Printf("Error reading %v: %v", connToRead.RemoteAddr(), err)
+			// Pass a clean EOF on as a half-close and leave the other direction
+			// running; handle cancels once both are done
+			if err == io.EOF && closeWrite(connToWrite) {
+				return total
+			}
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && ctx.Err() == nil {
+				log.Error("read error", "remote_addr", connToRead.RemoteAddr(), "error", err)
 			}
 			if tcpConn, ok := connToRead.(*net.TCPConn); ok {
 				//nolint:errcheck
 				tcpConn.CloseWrite()
 			}
 			cancelConn()
-			return
+			return total
 		}
 
+		// Throttle against the shared budget before writing
+		if limiter := p.rateLimiter.Load(); limiter != nil {
+			// A chunk already read is still flushed unthrottled once ctx is done
+			if err := limiter.waitN(ctx, n); err != nil && p.config.flushTimeout == 0 {
+				cancelConn()
+				return total
+			}
+		}
+
+		if p.config.writeTimeout > 0 && ctx.Err() == nil {
+			//nolint:errcheck
+			connToWrite.SetWriteDeadline(time.Now().Add(p.config.writeTimeout))
+		}
 		written := 0
 		for written < n {
 			newWritten, writeErr := connToWrite.Write(buf[written:n])
 			if writeErr != nil {
-				log.Printf("write to %v error: %v", connToWrite.RemoteAddr(), writeErr)
+				log.Error("write error", "remote_addr", connToWrite.RemoteAddr(), "error", writeErr)
 				if tcpConn, ok := connToWrite.(*net.TCPConn); ok {
 					//nolint:errcheck
 					tcpConn.CloseRead()
 				}
 				cancelConn()
-				return
+				return total
 			}
 			written += newWritten
+			total += int64(newWritten)
+			counter.Add(int64(newWritten))
 		}
 	}
 }
 
-func handle(parentCtx context.Context, client net.Conn, backendAddr string, wg *sync.WaitGroup, bufPool *sync.Pool) {
+// canSplice reports whether the relay can bypass the userspace buffer.
+// Throttling, read or write deadlines and the shutdown flush need to see every chunk,
+// so they always take the buffered path.
+func (p *Proxy) canSplice(client, backend net.Conn) bool {
+	_, clientTCP := client.(*net.TCPConn)
+	_, backendTCP := backend.(*net.TCPConn)
+	return clientTCP && backendTCP && p.rateLimiter.Load() == nil &&
+		p.config.readTimeout == 0 && p.config.writeTimeout == 0 && p.config.flushTimeout == 0
+}
+
+// spliceCopy is the readAndWrite equivalent for two TCP connections. io.Copy lets
+// the runtime use splice on Linux, so data never passes through a userspace buffer.
+// The byte count is only added to counter once the copy is done.
+func (p *Proxy) spliceCopy(ctx context.Context, connToRead net.Conn, connToWrite net.Conn, cancelConn context.CancelFunc, wg *sync.WaitGroup, _ *bufferPool, counter *atomic.Int64) int64 {
 	defer wg.Done()
-	connCtx, cancelConn := context.WithCancel(parentCtx)
+	log := p.connLogger(ctx)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		//nolint:errcheck
+		connToRead.Close()
+		//nolint:errcheck
+		connToWrite.Close()
+	}()
+
+	total, err := io.Copy(connToWrite, connToRead)
+	counter.Add(total)
+	if err == nil && closeWrite(connToWrite) {
+		return total
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Error("relay error", "remote_addr", connToRead.RemoteAddr(), "error", err)
+	}
+	if tcpConn, ok := connToRead.(*net.TCPConn); ok {
+		//nolint:errcheck
+		tcpConn.CloseWrite()
+	}
+	cancelConn()
+	return total
+}
+
+func (p *Proxy) handle(ctx context.Context, client net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer p.releaseConnSlot()
+	// Middleware that rejects the connection returns without calling serveConn
+	//nolint:errcheck
+	defer client.Close()
+	// The accept loop leaves clients behind a PROXY protocol header for this goroutine to admit
+	if header := proxyHeaderConn(client); header != nil {
+		if !p.admitProxyClient(ctx, client, header) {
+			return
+		}
+	}
+	defer p.releaseIPSlot(clientIP(client.RemoteAddr()))
+	// Everything downstream reads the client address from here, whatever wraps the conn
+	ctx = context.WithValue(ctx, clientAddrKey{}, client.RemoteAddr())
+	if p.config.connWrapper != nil {
+		client = p.config.connWrapper(client)
+	}
+	p.handler(ctx, client)
+}
+
+// admitProxyClient reads the PROXY protocol header under client, giving up if ctx is
+// done first, then runs the client checks against the address it carries
+func (p *Proxy) admitProxyClient(ctx context.Context, client net.Conn, header *proxyProtoConn) bool {
+	log := p.connLogger(ctx)
+	stop := context.AfterFunc(ctx, func() {
+		//nolint:errcheck
+		header.Conn.Close()
+	})
+	err := header.readHeader()
+	stop()
+	if err != nil {
+		log.Warn("dropping connection with invalid proxy protocol header", "remote_addr", header.Conn.RemoteAddr(), "error", err)
+		return false
+	}
+	return p.admitClient(ctx, client, log)
+}
+
+// serveConn is the core Handler: it relays client to its backend until either side is done
+func (p *Proxy) serveConn(parentCtx context.Context, client net.Conn) {
+	// Take a snapshot so a concurrent Reload can't change settings mid-connection
+	cfg := p.loadConfig()
+	log := p.connLogger(parentCtx)
+	clientAddr, ok := ClientAddr(parentCtx)
+	if !ok {
+		clientAddr = client.RemoteAddr()
+	}
+	spanCtx, span := p.startConnSpan(parentCtx, clientAddr)
+	connCtx, cancelConn := context.WithCancel(spanCtx)
 	defer cancelConn()
+	p.counters.activeConnections.Add(1)
+	defer p.counters.activeConnections.Add(-1)
+
+	stats := Stats{ClientAddr: clientAddr}
+	defer func() { span.end(stats) }()
+	// closeReason says why the connection ended; failures overwrite it through fail
+	start := time.Now()
+	var backendAddr string
+	closeReason := reasonClosed
+	fail := func(msg string, err error) {
+		closeReason = msg
+		span.fail(msg, err)
+	}
+	if p.accessLog != nil {
+		defer func() {
+			err := p.accessLog.log(accessLogEntry{
+				Time:       start,
+				ConnID:     connIDFrom(parentCtx),
+				Client:     clientAddr.String(),
+				Backend:    backendAddr,
+				DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+				BytesIn:    stats.BytesClientToBackend,
+				BytesOut:   stats.BytesBackendToClient,
+				Reason:     closeReason,
+
+				ClientCertSubject:     stats.ClientCertSubject,
+				ClientCertSerial:      stats.ClientCertSerial,
+				ClientCertFingerprint: stats.ClientCertFingerprint,
+				TLSVersion:            stats.TLSVersion,
+				TLSCipherSuite:        stats.TLSCipherSuite,
+				TLSServerName:         stats.TLSServerName,
+			})
+			if err != nil {
+				log.Warn("failed to write access log", "error", err)
+			}
+		}()
+	}
+	if onStats := cfg.hooks.OnStats; onStats != nil {
+		defer func() { onStats(client, stats) }()
+	}
+	if onClose := cfg.hooks.OnClose; onClose != nil {
+		defer func() { onClose(client, stats.BytesClientToBackend, stats.BytesBackendToClient) }()
+	}
 	//nolint:errcheck
 	defer client.Close()
+	defer func() {
+		log.Info("connection closed", "remote_addr", clientAddr,
+			"bytes_in", stats.BytesClientToBackend, "bytes_out", stats.BytesBackendToClient)
+	}()
+
+	if err := setSocketOptions(client, cfg); err != nil {
+		log.Warn("failed to set socket options", "remote_addr", clientAddr, "error", err)
+	}
 
-	dialer := &net.Dialer{Timeout: 5 * time.Second}
-	backend, err := dialer.DialContext(connCtx, "tcp", backendAddr)
+	// Tear the connection down once it outlives the configured lifetime,
+	// whatever else is going on with it
+	if cfg.maxConnLifetime > 0 {
+		lifetimeTimer := time.AfterFunc(cfg.maxConnLifetime, cancelConn)
+		defer lifetimeTimer.Stop()
+	}
+
+	// Complete the TLS handshake up front so a client that never finishes it
+	// can't hold the connection open indefinitely
+	if tlsConn, ok := client.(*tls.Conn); ok {
+		if err := tlsHandshake(tlsConn, cfg.tlsHandshakeTimeout); err != nil {
+			log.Error("tls handshake failed", "remote_addr", clientAddr, "error", err)
+			fail("tls handshake failed", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		stats.setTLS(state)
+		log.Debug("tls handshake complete", "remote_addr", clientAddr, "tls_version", stats.TLSVersion,
+			"tls_cipher_suite", stats.TLSCipherSuite, "tls_server_name", stats.TLSServerName)
+		// Only a verified client certificate is worth reporting
+		if len(state.VerifiedChains) > 0 {
+			stats.setClientCert(state.PeerCertificates[0])
+			log = log.With("client_cert_subject", stats.ClientCertSubject, "client_cert_fingerprint", stats.ClientCertFingerprint)
+		}
+	}
+
+	// In maintenance mode the client only gets the message, no backend
+	if m := p.maintenance.Load(); m != nil {
+		if len(m.message) > 0 {
+			//nolint:errcheck
+			client.Write(m.message)
+		}
+		log.Info("rejected in maintenance mode", "remote_addr", clientAddr)
+		p.countRejected(connCtx, rejectMaintenance)
+		fail("maintenance", errMaintenance)
+		return
+	}
+
+	backendAddr, relayClient, err := resolveTarget(client, cfg)
+	if err != nil {
+		log.Error("client handshake failed", "remote_addr", clientAddr, "error", err)
+		fail("client handshake failed", err)
+		return
+	}
+	// A matching route can send the connection elsewhere and override its settings
+	route := p.matchRoute(client, cfg, backendAddr)
+	if route != nil {
+		cfg = route.apply(cfg)
+		if route.Backend != "" {
+			backendAddr = route.Backend
+		}
+		connCtx = context.WithValue(connCtx, routeKey{}, route)
+	}
+	span.setBackend(backendAddr)
+
+	if len(cfg.clientGreeting) > 0 {
+		if _, err := relayClient.Write(cfg.clientGreeting); err != nil {
+			log.Error("write error", "remote_addr", clientAddr, "error", err)
+			fail("write error", err)
+			return
+		}
+	}
+
+	// Don't dial until the client has sent something, so idle connections
+	// can't tie up backend connections as well as slots
+	var firstBytes []byte
+	if cfg.firstByteTimeout > 0 && !cfg.connectMode && !cfg.socks5Mode {
+		firstBytes, err = readFirstBytes(relayClient, cfg.firstByteTimeout)
+		if err != nil {
+			log.Warn("no data from client", "remote_addr", clientAddr, "error", err)
+			fail("no data from client", err)
+			return
+		}
+	}
+
+	if p.breaker != nil && !p.breaker.allow(backendAddr) {
+		log.Warn("backend circuit open, closing client", "remote_addr", clientAddr, "backend", backendAddr)
+		p.countRejected(connCtx, rejectCircuitOpen)
+		fail("backend circuit open", errCircuitOpen)
+		p.replyTarget(client, nil, errCircuitOpen)
+		return
+	}
+	// Keep an eye on what the client sends while the backend is being dialed
+	var early *earlyReader
+	if cfg.maxEarlyBytes > 0 {
+		early = watchEarlyBytes(relayClient, len(firstBytes), cfg.maxEarlyBytes)
+	}
+	// A pre-dialed connection from the pool saves a round trip to the backend
+	var backend net.Conn
+	// Data a probed backend sent straight away, owed to the client
+	var backendGreeting []byte
+	if p.backendPool != nil {
+		backend = p.backendPool.get(backendAddr)
+	}
+	if backend == nil {
+		dialStart := time.Now()
+		backend, err = dialBackend(connCtx, cfg, backendNetwork(cfg), backendAddr)
+		if err == nil && cfg.backendProbe {
+			backendGreeting, err = probeBackend(backend)
+			if err != nil {
+				//nolint:errcheck
+				backend.Close()
+				backend = nil
+			}
+		}
+		p.metrics.recordDial(connCtx, backendAddr, time.Since(dialStart), err)
+	}
+	if err == nil && cfg.connWrapper != nil {
+		backend = cfg.connWrapper(backend)
+	}
+	if onBackendDial := cfg.hooks.OnBackendDial; onBackendDial != nil {
+		onBackendDial(client, backendAddr, err)
+	}
+	if p.breaker != nil {
+		if err != nil {
+			if p.breaker.failure(backendAddr) && cfg.drainOnUnhealthy {
+				if n := p.backendConns.drain(backendAddr); n > 0 {
+					log.Warn("backend circuit opened, closing its connections", "backend", backendAddr, "active", n)
+				}
+			}
+		} else {
+			p.breaker.success(backendAddr)
+		}
+	}
+	if early != nil {
+		data, earlyErr := early.stop()
+		if earlyErr != nil {
+			if backend != nil {
+				//nolint:errcheck
+				backend.Close()
+			}
+			log.Warn("dropping client", "remote_addr", clientAddr, "backend", backendAddr, "error", earlyErr)
+			fail("too much early data", earlyErr)
+			return
+		}
+		firstBytes = append(firstBytes, data...)
+	}
 	if err != nil {
-		log.Printf("Error connecting to backend: %s\n", err)
+		p.counters.dialErrors.Add(1)
+		log.Error("backend dial failed", "remote_addr", clientAddr, "backend", backendAddr, "error", err)
+		fail("backend dial failed", err)
+		p.replyTarget(client, nil, err)
 		return
 	}
+	if err := setSocketOptions(backend, cfg); err != nil {
+		log.Warn("failed to set socket options", "backend", backendAddr, "error", err)
+	}
+	if err := setBackendSocketBuffers(backend, cfg); err != nil {
+		log.Warn("failed to set backend socket buffers", "backend", backendAddr, "error", err)
+	}
+	// Everything written to the backend from here on is copied to the mirror
+	if cfg.mirrorAddr != "" {
+		backend = startMirror(connCtx, cfg, backend, log)
+	}
 	//nolint:errcheck
 	defer backend.Close()
+	span.outcome = outcomeDialed
+	if cfg.drainOnUnhealthy {
+		defer p.backendConns.add(backendAddr, cancelConn)()
+	}
+
+	if cfg.sendProxyProtocol != 0 {
+		if err := writeProxyHeader(backend, clientAddr, client.LocalAddr(), cfg.sendProxyProtocol); err != nil {
+			log.Error("proxy protocol header failed", "remote_addr", clientAddr, "backend", backendAddr, "error", err)
+			fail("proxy protocol header failed", err)
+			return
+		}
+	}
+	p.replyTarget(client, backend, nil)
+	if len(firstBytes) > 0 {
+		if _, err := backend.Write(firstBytes); err != nil {
+			log.Error("write error", "remote_addr", backend.RemoteAddr(), "error", err)
+			fail("write error", err)
+			return
+		}
+		p.counters.bytesClientToBackend.Add(int64(len(firstBytes)))
+	}
+	if len(backendGreeting) > 0 {
+		if _, err := relayClient.Write(backendGreeting); err != nil {
+			log.Error("write error", "remote_addr", clientAddr, "error", err)
+			fail("write error", err)
+			return
+		}
+		p.counters.bytesBackendToClient.Add(int64(len(backendGreeting)))
+	}
+
+	// Plain TCP on both sides can be relayed in the kernel with splice
+	relay := p.readAndWrite
+	if p.canSplice(relayClient, backend) && p.readTimeout(connCtx) == 0 {
+		relay = p.spliceCopy
+	}
+	requestBufs, replyBufs := p.requestBufs, p.replyBufs
+	if route != nil && route.requestBufs != nil {
+		requestBufs, replyBufs = route.requestBufs, route.replyBufs
+	}
 
-	wg.Add(2)
-	go readAndWrite(connCtx, client, backend, cancelConn, wg, bufPool)
-	go readAndWrite(connCtx, backend, client, cancelConn, wg, bufPool)
+	// Wait for both directions to finish so the byte counts are final
+	var relayWg sync.WaitGroup
+	relayWg.Add(2)
+	// The relays track their helper goroutines here so none outlive the connection
+	var relayGoroutines sync.WaitGroup
+	relayGoroutines.Add(2)
+	go func() {
+		defer relayWg.Done()
+		stats.BytesClientToBackend = int64(len(firstBytes)) + relay(connCtx, relayClient, backend, cancelConn, &relayGoroutines, requestBufs, &p.counters.bytesClientToBackend)
+	}()
+	go func() {
+		defer relayWg.Done()
+		stats.BytesBackendToClient = int64(len(backendGreeting)) + relay(connCtx, backend, relayClient, cancelConn, &relayGoroutines, replyBufs, &p.counters.bytesBackendToClient)
+	}()
 
+	// A direction that ends with EOF only half-closes, so the connection is
+	// done once both have finished or something cancels it outright
+	go func() {
+		relayWg.Wait()
+		cancelConn()
+	}()
 	<-connCtx.Done()
+	relayWg.Wait()
+	relayGoroutines.Wait()
+	span.outcome = outcomeClosed
+	if parentCtx.Err() != nil {
+		closeReason = reasonShutdown
+	}
+}
+
+// resolveTarget works out where to relay client to and which connection to relay
+// from. In CONNECT and SOCKS5 modes the client names the destination itself.
+func resolveTarget(client net.Conn, cfg config) (string, net.Conn, error) {
+	switch {
+	case cfg.connectMode:
+		return readConnectRequest(client, cfg.connectAllowlist, cfg.allowedDestPorts, cfg.maxHandshakeBytes)
+	case cfg.socks5Mode:
+		target, err := readSocks5Request(client, cfg.socks5Username, cfg.socks5Password, cfg.allowedDestPorts, cfg.maxHandshakeBytes)
+		return target, client, err
+	}
+	return cfg.backendAddr, client, nil
+}
+
+// backendNetwork returns the network to dial the backend over.
+// Targets requested by CONNECT and SOCKS5 clients are always TCP.
+func backendNetwork(cfg config) string {
+	if cfg.backendNetwork == "unix" && !cfg.connectMode && !cfg.socks5Mode {
+		return "unix"
+	}
+	if cfg.dialNetwork != "" {
+		return cfg.dialNetwork
+	}
+	return "tcp"
+}
+
+// replyTarget tells a CONNECT or SOCKS5 client whether its target was reached.
+// Other clients only hear about a failed dial if WithDialErrorResponse is set.
+func (p *Proxy) replyTarget(client, backend net.Conn, dialErr error) {
+	switch {
+	case p.config.connectMode && dialErr != nil:
+		writeConnectResponse(client, http.StatusBadGateway)
+	case p.config.connectMode:
+		writeConnectResponse(client, http.StatusOK)
+	case p.config.socks5Mode && dialErr != nil:
+		writeSocks5Reply(client, socks5DialReply(dialErr), nil)
+	case p.config.socks5Mode:
+		writeSocks5Reply(client, socks5ReplySucceeded, backend.LocalAddr())
+	case dialErr != nil && len(p.config.dialErrorResponse) > 0:
+		//nolint:errcheck
+		client.Write(p.config.dialErrorResponse)
+	}
+}
+
+func dialBackend(ctx context.Context, cfg config, network, addr string) (net.Conn, error) {
+	// The connect and the backend TLS handshake each get their own timeout, and
+	// both stop early if the connection is cancelled
+	dialCtx, cancel := withOptionalTimeout(ctx, cfg.connectTimeout)
+	conn, err := backendDialer(cfg).DialContext(dialCtx, network, addr)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.backendTLSEnabled {
+		return conn, nil
+	}
+
+	serverName := cfg.backendServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	//nolint:gosec // InsecureSkipVerify is an explicit opt-in for testing
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            cfg.backendRootCAs,
+		InsecureSkipVerify: cfg.backendTLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	})
+	handshakeCtx, cancel := withOptionalTimeout(ctx, cfg.backendTLSHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		//nolint:errcheck
+		conn.Close()
+		return nil, fmt.Errorf("backend tls handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// probeBackend waits briefly for a freshly dialed backend to reset or close the
+// connection, as an overloaded service that accepts and then drops clients does.
+// Anything the backend sends in the meantime, such as a server greeting, is returned
+// so it can be passed on to the client.
+func probeBackend(backend net.Conn) ([]byte, error) {
+	if err := backend.SetReadDeadline(time.Now().Add(backendProbeWait)); err != nil {
+		return nil, fmt.Errorf("backend probe: %w", err)
+	}
+	buf := make([]byte, firstReadSize)
+	n, err := backend.Read(buf)
+	// Running out of time with nothing to read means the connection is fine
+	if n == 0 && err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("backend probe: %w", err)
+	}
+	if err := backend.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("backend probe: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// withOptionalTimeout is context.WithTimeout, except that a zero timeout leaves ctx unbounded
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// backendDialer returns the configured dialer, or a standard one honouring the keepalive,
+// dual-stack and DNS cache settings
+func backendDialer(cfg config) ContextDialer {
+	if cfg.dialer != nil {
+		return cfg.dialer
+	}
+	dialer := &net.Dialer{KeepAlive: -1, FallbackDelay: cfg.fallbackDelay}
+	if cfg.keepAlive > 0 {
+		dialer.KeepAlive = cfg.keepAlive
+	}
+	// UDP backends need the source address as a UDP one, and a TCP source
+	// address would make dialing a Unix socket fail
+	if cfg.dialLocalAddr != nil && cfg.udp {
+		dialer.LocalAddr = &net.UDPAddr{IP: cfg.dialLocalAddr.IP, Port: cfg.dialLocalAddr.Port, Zone: cfg.dialLocalAddr.Zone}
+	} else if cfg.dialLocalAddr != nil && backendNetwork(cfg) != "unix" {
+		dialer.LocalAddr = cfg.dialLocalAddr
+	}
+	if cfg.dnsCache != nil {
+		return &cachingDialer{dialer: dialer, cache: cfg.dnsCache, fallbackDelay: cfg.fallbackDelay}
+	}
+	return dialer
+}
+
+var errTooManyEarlyBytes = errors.New("client sent too much data before the backend connected")
+
+// earlyReader reads what a client sends before its backend connection is up, so a
+// client that sends more than the limit can be dropped
+type earlyReader struct {
+	conn net.Conn
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+// watchEarlyBytes reads from conn in the background until stop is called or more
+// than limit bytes have arrived, counting the have bytes read before
+func watchEarlyBytes(conn net.Conn, have, limit int) *earlyReader {
+	e := &earlyReader{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(e.done)
+		chunk := make([]byte, firstReadSize)
+		for have+len(e.buf) <= limit {
+			n, err := conn.Read(chunk)
+			e.buf = append(e.buf, chunk[:n]...)
+			// Stopped, or the client went away; the relay sees the same error on its next read
+			if err != nil {
+				return
+			}
+		}
+		e.err = fmt.Errorf("%w: more than %d bytes", errTooManyEarlyBytes, limit)
+	}()
+	return e
+}
+
+// stop ends the background read and returns the data read, or an error if the client sent too much
+func (e *earlyReader) stop() ([]byte, error) {
+	//nolint:errcheck
+	e.conn.SetReadDeadline(time.Now())
+	<-e.done
+	if err := e.conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("clear early data deadline: %w", err)
+	}
+	return e.buf, e.err
+}
+
+// readFirstBytes waits up to timeout for the client to send data and returns what arrived
+func readFirstBytes(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("set first byte deadline: %w", err)
+	}
+	buf := make([]byte, firstReadSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("wait for first byte: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("clear first byte deadline: %w", err)
+	}
+	return buf[:n], nil
+}
+
+var errHandshakeTooLarge = errors.New("client handshake too large")
+
+// handshakeConn caps how much a preamble parser may read from the client, so a
+// client can't make it buffer an endless request line or header block
+type handshakeConn struct {
+	net.Conn
+	left   int
+	lifted bool
+}
+
+// limitHandshake caps reads from conn at limit bytes; zero leaves them unbounded
+func limitHandshake(conn net.Conn, limit int) *handshakeConn {
+	return &handshakeConn{Conn: conn, left: limit, lifted: limit == 0}
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	if c.lifted {
+		return c.Conn.Read(b)
+	}
+	if c.left <= 0 {
+		return 0, errHandshakeTooLarge
+	}
+	if len(b) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.Conn.Read(b)
+	c.left -= n
+	return n, err
+}
+
+// lift removes the cap once the preamble has been parsed and reads belong to the relay
+func (c *handshakeConn) lift() {
+	c.lifted = true
+}
+
+func tlsHandshake(conn *tls.Conn, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("set handshake deadline: %w", err)
+		}
+	}
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	// Clear the deadline so it doesn't interfere with data transfer
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return fmt.Errorf("clear handshake deadline: %w", err)
+		}
+	}
+	return nil
 }
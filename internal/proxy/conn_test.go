@@ -1,12 +1,20 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -28,18 +36,14 @@ func TestReadAndWrite(t *testing.T) {
 		defer cancel()
 
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 4096)
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(4))
 
 		// Test data
 		testData := []byte("Hello, World!")
 
 		// Start readAndWrite goroutine
 		wg.Add(1)
-		go readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, bufPool)
+		go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
 
 		// Write test data to client
 		go func() {
@@ -77,15 +81,11 @@ func TestReadAndWrite(t *testing.T) {
 
 		ctx, cancel := context.WithCancel(context.Background())
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 4096)
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(4))
 
 		// Start readAndWrite goroutine
 		wg.Add(1)
-		go readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, bufPool)
+		go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
 
 		// Cancel context immediately
 		cancel()
@@ -116,15 +116,11 @@ func TestReadAndWrite(t *testing.T) {
 		defer cancel()
 
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 4096)
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(4))
 
 		// Start readAndWrite goroutine
 		wg.Add(1)
-		go readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, bufPool)
+		go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
 
 		// Close the read connection to trigger an error
 		clientRead.Close()
@@ -157,15 +153,11 @@ func TestReadAndWrite(t *testing.T) {
 		defer cancel()
 
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 4096)
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(4))
 
 		// Start readAndWrite goroutine
 		wg.Add(1)
-		go readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, bufPool)
+		go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
 
 		// Close the write connection to trigger an error
 		backendWrite.Close()
@@ -204,18 +196,17 @@ func TestReadAndWrite(t *testing.T) {
 		defer cancel()
 
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 1024) // Smaller buffer to test multiple writes
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(1)) // Smaller buffer to test multiple writes
 
 		// Create large test data (larger than buffer)
 		testData := bytes.Repeat([]byte("A"), 5000)
 
 		// Start readAndWrite goroutine
 		wg.Add(1)
-		go readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, bufPool)
+		copied := make(chan int64, 1)
+		go func() {
+			copied <- p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
+		}()
 
 		// Write test data to client
 		go func() {
@@ -241,11 +232,167 @@ func TestReadAndWrite(t *testing.T) {
 			t.Fatalf("Data mismatch. Expected %d bytes, got %d bytes", len(testData), result.Len())
 		}
 
+		if n := <-copied; n != int64(len(testData)) {
+			t.Fatalf("readAndWrite reported %d bytes copied, expected %d", n, len(testData))
+		}
+
 		// Wait for goroutine to finish
 		wg.Wait()
 	})
 }
 
+// TestReadAndWriteRateLimit tests that readAndWrite is throttled by the shared rate limiter
+func TestReadAndWriteRateLimit(t *testing.T) {
+	clientRead, clientWrite := net.Pipe()
+	backendRead, backendWrite := net.Pipe()
+
+	defer clientRead.Close()
+	defer clientWrite.Close()
+	defer backendRead.Close()
+	defer backendWrite.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	// 10 KiB/s with a 10 KiB burst: the second 10 KiB has to wait about a second
+	p := newTestProxy(t, WithBufferSize(1), WithRateLimit(10*1024))
+
+	wg.Add(1)
+	go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
+
+	testData := bytes.Repeat([]byte("A"), 15*1024)
+	go func() {
+		defer clientWrite.Close()
+		clientWrite.Write(testData)
+	}()
+
+	start := time.Now()
+	if _, err := io.ReadFull(backendRead, make([]byte, len(testData))); err != nil {
+		t.Fatalf("Failed to read from backend: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("transfer took %v, expected it to be throttled", elapsed)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestReadAndWriteWriteTimeout(t *testing.T) {
+	clientRead, clientWrite := net.Pipe()
+	backendRead, backendWrite := net.Pipe()
+
+	defer clientRead.Close()
+	defer clientWrite.Close()
+	defer backendRead.Close()
+	defer backendWrite.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	p := newTestProxy(t, WithBufferSize(1), WithWriteTimeout(100*time.Millisecond))
+
+	wg.Add(1)
+	go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
+
+	// Nobody reads backendRead, so the write stalls until the deadline cancels the connection
+	go clientWrite.Write([]byte("stuck"))
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not cancelled after the write timeout")
+	}
+	wg.Wait()
+}
+
+func TestReadAndWriteReadTimeout(t *testing.T) {
+	clientRead, clientWrite := net.Pipe()
+	backendRead, backendWrite := net.Pipe()
+
+	defer clientRead.Close()
+	defer clientWrite.Close()
+	defer backendRead.Close()
+	defer backendWrite.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	p := newTestProxy(t, WithBufferSize(1), WithReadTimeout(200*time.Millisecond))
+
+	wg.Add(1)
+	go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
+
+	// Data within the timeout is relayed
+	go clientWrite.Write([]byte("ping"))
+	backendRead.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(backendRead, make([]byte, 4)); err != nil {
+		t.Fatalf("Failed to read from backend: %v", err)
+	}
+
+	// A read that gets nothing before the deadline cancels the connection
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not cancelled after the read timeout")
+	}
+	wg.Wait()
+}
+
+// TestReadAndWriteShutdownFlush tests that a write in progress when the context is cancelled
+// is completed within the flush timeout, and dropped without one
+func TestReadAndWriteShutdownFlush(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		flush     time.Duration
+		delivered bool
+	}{
+		{"flush", time.Second, true},
+		{"no flush", 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientRead, clientWrite := net.Pipe()
+			backendRead, backendWrite := net.Pipe()
+			defer clientWrite.Close()
+			defer backendRead.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var wg sync.WaitGroup
+			p := newTestProxy(t, WithShutdownFlushTimeout(tt.flush))
+
+			wg.Add(1)
+			copied := make(chan int64, 1)
+			go func() {
+				copied <- p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
+			}()
+
+			// The write to the backend stalls until backendRead is read, which only
+			// happens after the connection is cancelled
+			go clientWrite.Write([]byte("ping"))
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			time.Sleep(50 * time.Millisecond)
+
+			backendRead.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, 4)
+			_, err := io.ReadFull(backendRead, buf)
+			if tt.delivered && (err != nil || string(buf) != "ping") {
+				t.Errorf("got %q (err: %v), want the in-flight data flushed", buf, err)
+			}
+			if !tt.delivered && err == nil {
+				t.Errorf("got %q, want the in-flight data dropped", buf)
+			}
+			wg.Wait()
+			if n := <-copied; tt.delivered && n != 4 {
+				t.Errorf("readAndWrite reported %d bytes, want 4", n)
+			}
+		})
+	}
+}
+
 // TestHandle tests the handle function
 //
 //nolint:gocyclo
@@ -290,15 +437,11 @@ func TestHandle(t *testing.T) {
 		defer cancel()
 
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 4096)
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(4), WithBackendAddr(backendAddr))
 
 		// Start handle function
 		wg.Add(1)
-		go handle(ctx, proxyConn, backendAddr, &wg, bufPool)
+		go p.handle(ctx, proxyConn, &wg)
 
 		// Wait for backend to be ready before proceeding
 		select {
@@ -388,15 +531,11 @@ func TestHandle(t *testing.T) {
 		defer cancel()
 
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 4096)
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(4), WithBackendAddr(backendAddr))
 
 		// Start handle function
 		wg.Add(1)
-		go handle(ctx, proxyConn, backendAddr, &wg, bufPool)
+		go p.handle(ctx, proxyConn, &wg)
 
 		// Wait for handle to finish (should finish quickly due to connection error)
 		done := make(chan struct{})
@@ -441,15 +580,11 @@ func TestHandle(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 
 		var wg sync.WaitGroup
-		bufPool := &sync.Pool{
-			New: func() any {
-				return make([]byte, 4096)
-			},
-		}
+		p := newTestProxy(t, WithBufferSize(4), WithBackendAddr(backendAddr))
 
 		// Start handle function
 		wg.Add(1)
-		go handle(ctx, proxyConn, backendAddr, &wg, bufPool)
+		go p.handle(ctx, proxyConn, &wg)
 
 		// Wait a bit for connections to establish
 		time.Sleep(100 * time.Millisecond)
@@ -473,6 +608,831 @@ func TestHandle(t *testing.T) {
 	})
 }
 
+// TestHandleMaxConnLifetime tests that a connection is torn down once its lifetime elapses
+func TestHandleMaxConnLifetime(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+
+	// Backend accepts and keeps the connection open without sending anything
+	backendClosed := make(chan struct{})
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		close(backendClosed)
+	}()
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	p := newTestProxy(t, WithBufferSize(4), WithBackendAddr(backendListener.Addr().String()), WithMaxConnLifetime(200*time.Millisecond))
+	wg.Add(1)
+	go p.handle(ctx, proxyConn, &wg)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// Test passed - handle finished once the lifetime elapsed
+	case <-time.After(3 * time.Second):
+		t.Fatal("handle function didn't finish after max connection lifetime")
+	}
+
+	select {
+	case <-backendClosed:
+		// Backend side was closed as well
+	case <-time.After(time.Second):
+		t.Fatal("backend connection wasn't closed after max connection lifetime")
+	}
+}
+
+// TestHandleTLSHandshakeTimeout tests that a client which never completes the TLS handshake is dropped
+func TestHandleTLSHandshakeTimeout(t *testing.T) {
+	certPath, keyPath := generateTempCert(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load cert: %v", err)
+	}
+
+	// The client side of the pipe never sends a ClientHello
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	tlsConn := tls.Server(proxyConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	p := newTestProxy(t, WithBufferSize(4), WithBackendAddr("127.0.0.1:1"), WithTLSHandshakeTimeout(100*time.Millisecond))
+	wg.Add(1)
+	go p.handle(ctx, tlsConn, &wg)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// Test passed - handle gave up on the handshake
+	case <-time.After(3 * time.Second):
+		t.Fatal("handle function didn't finish after TLS handshake timeout")
+	}
+}
+
+// hangingDialer blocks every dial until its context is done
+type hangingDialer struct{}
+
+func (hangingDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// TestDialBackendTimeouts tests that the connect and the backend TLS handshake are bounded separately
+func TestDialBackendTimeouts(t *testing.T) {
+	t.Run("connect timeout", func(t *testing.T) {
+		cfg := config{dialer: hangingDialer{}, connectTimeout: 50 * time.Millisecond, backendTLSHandshakeTimeout: time.Minute}
+		start := time.Now()
+		_, err := dialBackend(t.Context(), cfg, "tcp", "127.0.0.1:1")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("dial took %v, want the connect timeout", elapsed)
+		}
+	})
+
+	t.Run("backend handshake timeout", func(t *testing.T) {
+		// The backend accepts but never answers the ClientHello
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to create backend listener: %v", err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}()
+
+		cfg := config{backendTLSEnabled: true, connectTimeout: time.Minute, backendTLSHandshakeTimeout: 50 * time.Millisecond}
+		start := time.Now()
+		_, err = dialBackend(t.Context(), cfg, "tcp", ln.Addr().String())
+		if err == nil || !strings.Contains(err.Error(), "backend tls handshake") {
+			t.Fatalf("expected backend tls handshake error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("handshake took %v, want the handshake timeout", elapsed)
+		}
+	})
+
+	t.Run("connection context", func(t *testing.T) {
+		// Neither timeout is set, so only cancelling the connection stops the dial
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := dialBackend(ctx, config{dialer: hangingDialer{}}, "tcp", "127.0.0.1:1"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the connection deadline, got %v", err)
+		}
+	})
+
+	for _, opt := range []Option{WithConnectTimeout(-time.Second), WithBackendHandshakeTimeout(-time.Second)} {
+		if _, err := CreateProxy(opt); err == nil {
+			t.Error("expected error for negative timeout")
+		}
+	}
+}
+
+// TestHandleBackendTLS tests that handle dials the backend over TLS when configured
+func TestHandleBackendTLS(t *testing.T) {
+	certPath, keyPath := generateTempCert(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load cert: %v", err)
+	}
+	backendListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+
+	// TLS echo backend
+	go func() {
+		for {
+			conn, err := backendListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	t.Run("echo through TLS backend", func(t *testing.T) {
+		clientConn, proxyConn := net.Pipe()
+		defer clientConn.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var wg sync.WaitGroup
+		p := newTestProxy(t,
+			WithBufferSize(4),
+			WithBackendAddr(backendListener.Addr().String()),
+			WithBackendTLS(""),
+			WithBackendTLSInsecureSkipVerify(true),
+		)
+		wg.Add(1)
+		go p.handle(ctx, proxyConn, &wg)
+
+		testData := []byte("Hello TLS Backend!")
+		clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := clientConn.Write(testData); err != nil {
+			t.Fatalf("Failed to write to client: %v", err)
+		}
+		response := make([]byte, len(testData))
+		if _, err := io.ReadFull(clientConn, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if !bytes.Equal(response, testData) {
+			t.Fatalf("Expected %s, got %s", testData, response)
+		}
+
+		clientConn.Close()
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("mirror dialed without TLS", func(t *testing.T) {
+		mirrorListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to create mirror listener: %v", err)
+		}
+		defer mirrorListener.Close()
+		mirrored := make(chan []byte, 1)
+		go func() {
+			conn, err := mirrorListener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			data, _ := io.ReadAll(conn)
+			mirrored <- data
+		}()
+
+		clientConn, proxyConn := net.Pipe()
+		p := newTestProxy(t,
+			WithBackendAddr(backendListener.Addr().String()),
+			WithBackendTLS("backend.internal"),
+			WithBackendTLSInsecureSkipVerify(true),
+			WithMirrorBackend(mirrorListener.Addr().String()),
+		)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go p.handle(t.Context(), proxyConn, &wg)
+		echo(t, clientConn, "ping")
+		clientConn.Close()
+		wg.Wait()
+
+		select {
+		case data := <-mirrored:
+			if string(data) != "ping" {
+				t.Errorf("mirror got %q, want %q", data, "ping")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("mirror connection wasn't closed")
+		}
+	})
+
+	t.Run("untrusted backend certificate", func(t *testing.T) {
+		_, err := dialBackend(context.Background(), config{backendTLSEnabled: true}, "tcp", backendListener.Addr().String())
+		if err == nil || !strings.Contains(err.Error(), "backend tls handshake") {
+			t.Fatalf("expected backend TLS handshake error, got %v", err)
+		}
+	})
+}
+
+// TestHandleStructuredLogging tests that connection errors are logged with structured fields
+func TestHandleStructuredLogging(t *testing.T) {
+	var logBuf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logBuf, nil))
+
+	// Nothing listens on port 1, so the dial fails
+	p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithLogger(logger))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	p.handle(withConnID(context.Background(), 7), proxyConn, &wg)
+	wg.Wait()
+
+	// The dial failure comes first, then the close; both carry the connection ID
+	decoder := json.NewDecoder(&logBuf)
+	var entry map[string]any
+	if err := decoder.Decode(&entry); err != nil {
+		t.Fatalf("failed to parse log line: %v", err)
+	}
+	if entry["msg"] != "backend dial failed" {
+		t.Errorf("expected backend dial failure message, got %v", entry["msg"])
+	}
+	if entry["backend"] != "127.0.0.1:1" {
+		t.Errorf("expected backend field 127.0.0.1:1, got %v", entry["backend"])
+	}
+	if _, ok := entry["error"]; !ok {
+		t.Errorf("expected error field in %v", entry)
+	}
+	if entry["conn_id"] != float64(7) {
+		t.Errorf("expected conn_id 7, got %v", entry["conn_id"])
+	}
+
+	var closed map[string]any
+	if err := decoder.Decode(&closed); err != nil {
+		t.Fatalf("failed to parse log line: %v", err)
+	}
+	if closed["msg"] != "connection closed" || closed["conn_id"] != float64(7) {
+		t.Errorf("expected connection closed line with conn_id 7, got %v", closed)
+	}
+}
+
+// TestHandleDialErrorResponse tests that the configured banner reaches the client when the dial fails
+func TestHandleDialErrorResponse(t *testing.T) {
+	banner := []byte("backend unavailable\r\n")
+	// Nothing listens on port 1, so the dial fails
+	p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithDialErrorResponse(banner))
+	banner[0] = 'X' // the option keeps its own copy
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(context.Background(), proxyConn, &wg)
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %v", err)
+	}
+	if string(got) != "backend unavailable\r\n" {
+		t.Errorf("got %q, want the dial error response", got)
+	}
+	wg.Wait()
+}
+
+// TestHandleClientGreeting tests that the greeting reaches the client before anything is relayed
+func TestHandleClientGreeting(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithBackendAddr(backendAddr), WithClientGreeting([]byte("220 ready\r\n")))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(context.Background(), proxyConn, &wg)
+
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len("220 ready\r\n"))
+	if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "220 ready\r\n" {
+		t.Fatalf("got %q (err: %v), want the greeting", buf, err)
+	}
+	echo(t, clientConn, "ping")
+	clientConn.Close()
+	wg.Wait()
+}
+
+// TestHandleConnWrapper tests that client and backend connections are both wrapped
+func TestHandleConnWrapper(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	var wrapped, read atomic.Int64
+	p := newTestProxy(t, WithBackendAddr(backendAddr), WithConnWrapper(func(conn net.Conn) net.Conn {
+		wrapped.Add(1)
+		return countingConn{Conn: conn, read: &read}
+	}))
+
+	clientConn, proxyConn := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+	echo(t, clientConn, "ping")
+	clientConn.Close()
+	wg.Wait()
+
+	if got := wrapped.Load(); got != 2 {
+		t.Errorf("wrapped %d connections, want the client and the backend", got)
+	}
+	// "ping" is read from the client and its echo from the backend
+	if got := read.Load(); got != 8 {
+		t.Errorf("wrapped connections read %d bytes, want 8", got)
+	}
+	if _, err := CreateProxy(WithConnWrapper(nil)); err == nil {
+		t.Error("expected error for nil conn wrapper")
+	}
+}
+
+// spoofedConn reports a remote address other than the real one
+type spoofedConn struct {
+	net.Conn
+}
+
+func (spoofedConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1}
+}
+
+// TestHandleClientAddr tests that the address recorded at accept is what middleware and the PROXY header see
+func TestHandleClientAddr(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	header := make(chan string, 1)
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		header <- line
+	}()
+
+	var seen net.Addr
+	p := newTestProxy(t,
+		WithBackendAddr(backendListener.Addr().String()),
+		WithSendProxyProtocol(1),
+		WithConnWrapper(func(conn net.Conn) net.Conn { return spoofedConn{conn} }),
+		WithConnMiddleware(func(next Handler) Handler {
+			return func(ctx context.Context, client net.Conn) {
+				seen, _ = ClientAddr(ctx)
+				next(ctx, client)
+			}
+		}),
+	)
+	client, proxyConn := tcpPair(t)
+	defer client.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+
+	select {
+	case line := <-header:
+		src, dst := client.LocalAddr().(*net.TCPAddr), client.RemoteAddr().(*net.TCPAddr)
+		if want := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port); line != want {
+			t.Errorf("PROXY header = %q, want %q", line, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend didn't receive a PROXY header")
+	}
+	client.Close()
+	wg.Wait()
+	if seen == nil || seen.String() != client.LocalAddr().String() {
+		t.Errorf("ClientAddr() = %v, want %v", seen, client.LocalAddr())
+	}
+}
+
+// dialerFunc adapts a function to ContextDialer
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// TestHandleBackendProbe tests that a backend resetting new connections counts as a failed dial
+func TestHandleBackendProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer ln.Close()
+	dialed, reset := make(chan struct{}), make(chan struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Closing with a zero linger sends RST
+			<-dialed
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			reset <- struct{}{}
+		}
+	}()
+	// Hand the connection over only once the backend has reset it
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			dialed <- struct{}{}
+			<-reset
+		}
+		return conn, err
+	})
+
+	for _, probe := range []bool{false, true} {
+		p := newTestProxy(t, WithBackendAddr(ln.Addr().String()), WithDialer(dialer), WithBackendProbe(probe), WithDialErrorResponse([]byte("unavailable")))
+		clientConn, proxyConn := net.Pipe()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go p.handle(t.Context(), proxyConn, &wg)
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		reply, _ := io.ReadAll(clientConn)
+		clientConn.Close()
+		wg.Wait()
+
+		wantErrors, wantReply := int64(0), ""
+		if probe {
+			wantErrors, wantReply = 1, "unavailable"
+		}
+		if got := p.Stats().DialErrors; got != wantErrors {
+			t.Errorf("probe %t: DialErrors = %d, want %d", probe, got, wantErrors)
+		}
+		if string(reply) != wantReply {
+			t.Errorf("probe %t: client got %q, want %q", probe, reply, wantReply)
+		}
+	}
+}
+
+// TestHandleBackendProbeGreeting tests that data a backend sends during the probe reaches the client
+func TestHandleBackendProbeGreeting(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	greeting := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// Have the echo backend send something before the client does
+		conn.Write([]byte("hello"))
+		time.Sleep(10 * time.Millisecond)
+		return conn, nil
+	})
+	p := newTestProxy(t, WithBackendAddr(backendAddr), WithDialer(greeting), WithBackendProbe(true))
+	clientConn, proxyConn := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q (err: %v), want the backend greeting", buf, err)
+	}
+	echo(t, clientConn, "ping")
+	clientConn.Close()
+	wg.Wait()
+	if got := p.Stats().DialErrors; got != 0 {
+		t.Errorf("DialErrors = %d, want 0", got)
+	}
+}
+
+// slowDialer dials after a delay, giving the client time to send data first
+type slowDialer struct {
+	delay time.Duration
+}
+
+func (d slowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// TestHandleMaxEarlyBytes tests that clients sending too much before the backend connects are dropped
+func TestHandleMaxEarlyBytes(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	for _, tt := range []struct {
+		name    string
+		early   string
+		dropped bool
+	}{
+		{"within limit", "ping", false},
+		{"over limit", "far too much", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, WithBackendAddr(backendAddr), WithDialer(slowDialer{delay: 100 * time.Millisecond}), WithMaxEarlyBytes(8))
+			clientConn, proxyConn := net.Pipe()
+			defer clientConn.Close()
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go p.handle(ctx, proxyConn, &wg)
+
+			if _, err := clientConn.Write([]byte(tt.early)); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, len(tt.early))
+			_, err := io.ReadFull(clientConn, buf)
+			if tt.dropped && err == nil {
+				t.Errorf("got %q, want the client dropped", buf)
+			}
+			if !tt.dropped && (err != nil || string(buf) != tt.early) {
+				t.Errorf("got %q (err: %v), want the early data relayed", buf, err)
+			}
+			clientConn.Close()
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+// TestHandleUnixBackend tests relaying to a backend listening on a Unix socket
+func TestHandleUnixBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backend.sock")
+	backendListener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	p := newTestProxy(t, WithBackendAddr("unix://"+path))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(ctx, proxyConn, &wg)
+
+	go clientConn.Write([]byte("ping"))
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	echo := make([]byte, len("ping"))
+	if _, err := io.ReadFull(clientConn, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("got %q (err: %v), want %q", echo, err, "ping")
+	}
+
+	clientConn.Close()
+	cancel()
+	wg.Wait()
+}
+
+// TestHandleFirstByteTimeout tests that silent clients are dropped before a backend is dialed
+func TestHandleFirstByteTimeout(t *testing.T) {
+	t.Run("silent client", func(t *testing.T) {
+		dialer := &recordingDialer{}
+		p := newTestProxy(t, WithDialer(dialer), WithFirstByteTimeout(100*time.Millisecond))
+		clientConn, proxyConn := net.Pipe()
+		defer clientConn.Close()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go p.handle(t.Context(), proxyConn, &wg)
+
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected silent client to be closed, got %v", err)
+		}
+		wg.Wait()
+		if len(dialer.addrs) != 0 {
+			t.Errorf("dialed %v for a client that sent nothing", dialer.addrs)
+		}
+	})
+
+	t.Run("first bytes are forwarded", func(t *testing.T) {
+		backendAddr := startEchoBackend(t, "")
+		p := newTestProxy(t, WithBackendAddr(backendAddr), WithFirstByteTimeout(time.Second))
+		clientConn, proxyConn := net.Pipe()
+
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go p.handle(ctx, proxyConn, &wg)
+
+		go clientConn.Write([]byte("hello"))
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("got %q (err: %v), want %q", buf, err, "hello")
+		}
+		clientConn.Close()
+		wg.Wait()
+		if got := p.Stats().BytesClientToBackend; got != 5 {
+			t.Errorf("BytesClientToBackend = %d, want 5", got)
+		}
+	})
+}
+
+// TestHandleSplice tests relaying between two TCP connections through the splice fast path
+func TestHandleSplice(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create proxy listener: %v", err)
+	}
+	defer proxyListener.Close()
+	clientConn, err := net.Dial("tcp", proxyListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy listener: %v", err)
+	}
+	defer clientConn.Close()
+	proxyConn, err := proxyListener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept client: %v", err)
+	}
+
+	p := newTestProxy(t, WithBackendAddr(backendListener.Addr().String()))
+	if !p.canSplice(proxyConn, clientConn) {
+		t.Fatal("expected two TCP connections to take the splice path")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(ctx, proxyConn, &wg)
+
+	testData := bytes.Repeat([]byte("splice"), 10000)
+	go clientConn.Write(testData)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := make([]byte, len(testData))
+	if _, err := io.ReadFull(clientConn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !bytes.Equal(response, testData) {
+		t.Fatal("response does not match the data sent")
+	}
+
+	clientConn.Close()
+	wg.Wait()
+	if stats := p.Stats(); stats.BytesClientToBackend != int64(len(testData)) || stats.BytesBackendToClient != int64(len(testData)) {
+		t.Errorf("got %+v, want %d bytes each way", stats, len(testData))
+	}
+}
+
+func TestCanSplice(t *testing.T) {
+	pipeA, pipeB := net.Pipe()
+	defer pipeA.Close()
+	defer pipeB.Close()
+	tcpConn := &net.TCPConn{}
+
+	if newTestProxy(t).canSplice(pipeA, tcpConn) {
+		t.Error("expected non-TCP client to take the buffered path")
+	}
+	if newTestProxy(t, WithRateLimit(1024)).canSplice(tcpConn, tcpConn) {
+		t.Error("expected throttled relay to take the buffered path")
+	}
+	if newTestProxy(t, WithWriteTimeout(time.Second)).canSplice(tcpConn, tcpConn) {
+		t.Error("expected relay with a write timeout to take the buffered path")
+	}
+	if newTestProxy(t, WithReadTimeout(time.Second)).canSplice(tcpConn, tcpConn) {
+		t.Error("expected relay with a read timeout to take the buffered path")
+	}
+	if newTestProxy(t, WithShutdownFlushTimeout(time.Second)).canSplice(tcpConn, tcpConn) {
+		t.Error("expected relay with a shutdown flush timeout to take the buffered path")
+	}
+}
+
+// recordingDialer dials through a net.Dialer and records the addresses it was asked for
+type recordingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+" "+addr)
+	d.mu.Unlock()
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// TestHandleCustomDialer tests that backend connections go through the configured dialer
+func TestHandleCustomDialer(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	dialer := &recordingDialer{}
+	p := newTestProxy(t, WithBackendAddr(backendListener.Addr().String()), WithDialer(dialer))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(ctx, proxyConn, &wg)
+
+	go clientConn.Write([]byte("ping"))
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	echo := make([]byte, len("ping"))
+	if _, err := io.ReadFull(clientConn, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("got %q (err: %v), want %q", echo, err, "ping")
+	}
+	clientConn.Close()
+	cancel()
+	wg.Wait()
+
+	want := "tcp " + backendListener.Addr().String()
+	if len(dialer.addrs) != 1 || dialer.addrs[0] != want {
+		t.Errorf("dialer was asked for %v, want [%s]", dialer.addrs, want)
+	}
+}
+
+// newTestProxy creates a proxy with the given options for exercising connection handling directly
+func newTestProxy(tb testing.TB, options ...Option) *Proxy {
+	tb.Helper()
+	p, err := CreateProxy(options...)
+	if err != nil {
+		tb.Fatalf("CreateProxy() failed: %v", err)
+	}
+	return p
+}
+
 // Benchmark for readAndWrite function
 func BenchmarkReadAndWrite(b *testing.B) {
 	clientRead, clientWrite := net.Pipe()
@@ -487,15 +1447,11 @@ func BenchmarkReadAndWrite(b *testing.B) {
 	defer cancel()
 
 	var wg sync.WaitGroup
-	bufPool := &sync.Pool{
-		New: func() any {
-			return make([]byte, 4096)
-		},
-	}
+	p := newTestProxy(b, WithBufferSize(4))
 
 	// Start readAndWrite goroutine
 	wg.Add(1)
-	go readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, bufPool)
+	go p.readAndWrite(ctx, clientRead, backendWrite, cancel, &wg, p.requestBufs, &p.counters.bytesClientToBackend)
 
 	testData := bytes.Repeat([]byte("benchmark test data"), 100)
 
@@ -531,3 +1487,136 @@ func BenchmarkReadAndWrite(b *testing.B) {
 	cancel()
 	wg.Wait()
 }
+
+func TestBackendNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config
+		want string
+	}{
+		{"tcp backend", config{backendNetwork: "tcp"}, "tcp"},
+		{"unix backend", config{backendNetwork: "unix"}, "unix"},
+		{"forced ipv4", config{backendNetwork: "tcp", dialNetwork: "tcp4"}, "tcp4"},
+		{"unix backend ignores dial network", config{backendNetwork: "unix", dialNetwork: "tcp6"}, "unix"},
+		{"connect targets are tcp", config{backendNetwork: "unix", connectMode: true}, "tcp"},
+		{"socks5 targets honour dial network", config{backendNetwork: "tcp", socks5Mode: true, dialNetwork: "tcp6"}, "tcp6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backendNetwork(tt.cfg); got != tt.want {
+				t.Errorf("backendNetwork() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendDialerDualStack(t *testing.T) {
+	p := newTestProxy(t, WithDualStack(true, 50*time.Millisecond))
+	if d := backendDialer(p.config).(*net.Dialer); d.FallbackDelay != 50*time.Millisecond {
+		t.Errorf("FallbackDelay = %v, want 50ms", d.FallbackDelay)
+	}
+	p = newTestProxy(t, WithDualStack(false, 0))
+	if d := backendDialer(p.config).(*net.Dialer); d.FallbackDelay >= 0 {
+		t.Errorf("FallbackDelay = %v, want negative to disable the fallback", d.FallbackDelay)
+	}
+}
+
+// TestHandleDialLocalAddr tests that backend connections originate from the configured address
+func TestHandleDialLocalAddr(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	p := newTestProxy(t, WithBackendAddr(backendListener.Addr().String()), WithDialLocalAddr("127.0.0.2"))
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+
+	select {
+	case addr := <-remote:
+		if ip := addr.(*net.TCPAddr).IP.String(); ip != "127.0.0.2" {
+			t.Errorf("backend saw a connection from %s, want 127.0.0.2", ip)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend was not dialed")
+	}
+	clientConn.Close()
+	wg.Wait()
+}
+
+func TestWithDialLocalAddr(t *testing.T) {
+	for addr, want := range map[string]string{"10.0.0.5": "10.0.0.5:0", "10.0.0.5:4000": "10.0.0.5:4000", "::1": "[::1]:0"} {
+		p := newTestProxy(t, WithDialLocalAddr(addr))
+		if got := p.config.dialLocalAddr.String(); got != want {
+			t.Errorf("WithDialLocalAddr(%q) set %s, want %s", addr, got, want)
+		}
+	}
+	for _, addr := range []string{"", "eth0", "backend.example:80", "10.0.0.5:http"} {
+		if _, err := CreateProxy(WithDialLocalAddr(addr)); err == nil || !strings.Contains(err.Error(), "dial local addr") {
+			t.Errorf("WithDialLocalAddr(%q): expected parse error, got %v", addr, err)
+		}
+	}
+
+	// A Unix socket backend is dialed without it
+	p := newTestProxy(t, WithDialLocalAddr("127.0.0.2"), WithBackendAddr("unix:///tmp/backend.sock"))
+	if d := backendDialer(p.config).(*net.Dialer); d.LocalAddr != nil {
+		t.Errorf("LocalAddr = %v for a unix backend, want nil", d.LocalAddr)
+	}
+}
+
+// TestHandleHalfClose tests that a client can finish sending and still read the response
+func TestHandleHalfClose(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"splice", nil},
+		{"buffered", []Option{WithReadTimeout(5 * time.Second)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to create backend listener: %v", err)
+			}
+			defer backendListener.Close()
+			// The backend only answers once the request is complete
+			go func() {
+				conn, err := backendListener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				req, _ := io.ReadAll(conn)
+				conn.Write(append([]byte("re:"), req...))
+			}()
+
+			client, proxySide := tcpPair(t)
+			p := newTestProxy(t, append(tt.opts, WithBackendAddr(backendListener.Addr().String()))...)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go p.handle(t.Context(), proxySide, &wg)
+
+			client.Write([]byte("request"))
+			client.CloseWrite()
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			resp, err := io.ReadAll(client)
+			if err != nil || string(resp) != "re:request" {
+				t.Errorf("got %q (err: %v), want %q", resp, err, "re:request")
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectRequestTimeout bounds how long a client may take to send its CONNECT request
+const connectRequestTimeout = 10 * time.Second
+
+var (
+	errConnectTargetNotAllowed = errors.New("connect target not allowed")
+	errDestPortNotAllowed      = errors.New("destination port not allowed")
+)
+
+// bufferedConn is a connection with bytes already buffered past the CONNECT request
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// NetConn returns the wrapped connection
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readConnectRequest consumes an HTTP CONNECT request of at most maxBytes from conn
+// and returns the requested target together with a connection to relay from. On
+// failure the matching HTTP error response has already been written to the client.
+func readConnectRequest(conn net.Conn, allowed []string, allowedPorts []int, maxBytes int) (string, net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(connectRequestTimeout)); err != nil {
+		return "", nil, fmt.Errorf("set request deadline: %w", err)
+	}
+	limited := limitHandshake(conn, maxBytes)
+	reader := bufio.NewReader(limited)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errHandshakeTooLarge) {
+			status = http.StatusRequestHeaderFieldsTooLarge
+		}
+		writeConnectResponse(conn, status)
+		return "", nil, fmt.Errorf("read connect request: %w", err)
+	}
+	limited.lift()
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", nil, fmt.Errorf("clear request deadline: %w", err)
+	}
+
+	if req.Method != http.MethodConnect {
+		writeConnectResponse(conn, http.StatusMethodNotAllowed)
+		return "", nil, fmt.Errorf("unexpected method %q", req.Method)
+	}
+	host, port, err := parseAddress(req.Host)
+	if err != nil {
+		writeConnectResponse(conn, http.StatusBadRequest)
+		return "", nil, fmt.Errorf("connect target: %w", err)
+	}
+	target := net.JoinHostPort(host, port)
+	if !connectTargetAllowed(target, allowed) {
+		writeConnectResponse(conn, http.StatusForbidden)
+		return "", nil, fmt.Errorf("%w: %s", errConnectTargetNotAllowed, target)
+	}
+	if !destPortAllowed(port, allowedPorts) {
+		writeConnectResponse(conn, http.StatusForbidden)
+		return "", nil, fmt.Errorf("%w: %s", errDestPortNotAllowed, target)
+	}
+
+	// Keep any bytes the client sent right after the request
+	if reader.Buffered() > 0 {
+		return target, &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return target, conn, nil
+}
+
+// connectTargetAllowed reports whether target is on the allowlist; an empty list allows everything
+func connectTargetAllowed(target string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(a, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// destPortAllowed reports whether port is one of allowed; an empty list allows every port
+func destPortAllowed(port string, allowed []int) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && slices.Contains(allowed, n)
+}
+
+// writeConnectResponse sends a bodiless HTTP response with the given status
+func writeConnectResponse(w io.Writer, status int) {
+	//nolint:errcheck
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n\r\n", status, connectStatusText(status))
+}
+
+func connectStatusText(status int) string {
+	if status == http.StatusOK {
+		return "Connection Established"
+	}
+	return http.StatusText(status)
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHandleConnectMode tests that CONNECT requests are tunnelled to the requested target
+func TestHandleConnectMode(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		for {
+			conn, err := backendListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	target := backendListener.Addr().String()
+
+	tests := []struct {
+		name       string
+		request    string
+		options    []Option
+		wantStatus int
+	}{
+		{
+			name:       "tunnel established",
+			request:    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\nping",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "allowed target",
+			request:    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\nping",
+			options:    []Option{WithConnectAllowlist(target)},
+			wantStatus: http.StatusOK,
+		},
+		{
+			// Bytes buffered past the request under the limit still reach the target
+			name:       "tunnel established under handshake limit",
+			request:    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\nping",
+			options:    []Option{WithMaxHandshakeBytes(len("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\npi"))},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "request too large",
+			request:    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nX-Padding: " + strings.Repeat("a", 256) + "\r\n\r\n",
+			options:    []Option{WithMaxHandshakeBytes(128)},
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "target not allowed",
+			request:    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+			options:    []Option{WithConnectAllowlist("example.com:443")},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "port not allowed",
+			request:    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+			options:    []Option{WithAllowedDestPorts([]int{443})},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "not a connect request",
+			request:    "GET / HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "unreachable target",
+			request:    "CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n",
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The configured backend must never be dialled in CONNECT mode
+			options := append([]Option{WithConnectMode(true), WithBackendAddr("127.0.0.1:1")}, tt.options...)
+			p := newTestProxy(t, options...)
+
+			clientConn, proxyConn := net.Pipe()
+			defer clientConn.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go p.handle(ctx, proxyConn, &wg)
+
+			go clientConn.Write([]byte(tt.request))
+
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			reader := bufio.NewReader(clientConn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			if tt.wantStatus == http.StatusOK {
+				echo := make([]byte, len("ping"))
+				if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "ping" {
+					t.Errorf("got %q (err: %v), want %q", echo, err, "ping")
+				}
+			}
+
+			clientConn.Close()
+			cancel()
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// dnsCache remembers backend host lookups for ttl so each connection doesn't
+// have to wait for the resolver
+type dnsCache struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl: ttl,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		entries: make(map[string]dnsEntry),
+	}
+}
+
+// resolve returns the addresses for host, looking it up again once the cached entry has expired
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+const (
+	// defaultFallbackDelay is how long a dual-stack dial waits on the preferred
+	// address family before racing the other one, as net.Dialer does
+	defaultFallbackDelay = 300 * time.Millisecond
+	// minAddrTimeout keeps each address's share of the connect timeout from getting too short to connect
+	minAddrTimeout = 2 * time.Second
+)
+
+// cachingDialer resolves host names through a dnsCache and dials the resulting
+// addresses the way net.Dialer does: each family in order, with the connect
+// timeout shared out between its addresses, and the second family raced against
+// the first after fallbackDelay. A negative fallbackDelay dials all addresses in order.
+type cachingDialer struct {
+	dialer        ContextDialer
+	cache         *dnsCache
+	fallbackDelay time.Duration
+}
+
+func (d *cachingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "unix" {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := d.cache.resolve(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	var primaries, fallbacks []string
+	for _, ip := range addrs {
+		is4 := ip.Unmap().Is4()
+		if ((network == "tcp4" || network == "udp4") && !is4) || ((network == "tcp6" || network == "udp6") && is4) {
+			continue
+		}
+		target := net.JoinHostPort(ip.Unmap().String(), port)
+		if network == "tcp" && d.fallbackDelay >= 0 && len(primaries) > 0 && is4 != addrs[0].Unmap().Is4() {
+			fallbacks = append(fallbacks, target)
+		} else {
+			primaries = append(primaries, target)
+		}
+	}
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("no %s addresses for %s", network, host)
+	}
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, primaries)
+	}
+	return d.dialParallel(ctx, network, primaries, fallbacks)
+}
+
+// dialParallel dials primaries, and fallbacks too once fallbackDelay has passed or
+// the primaries have all failed, returning whichever connects first
+func (d *cachingDialer) dialParallel(ctx context.Context, network string, primaries, fallbacks []string) (net.Conn, error) {
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result)
+	race := func(primary bool, targets []string) {
+		conn, err := d.dialSerial(ctx, network, targets)
+		select {
+		case results <- result{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			if conn != nil {
+				//nolint:errcheck
+				conn.Close()
+			}
+		}
+	}
+	go race(true, primaries)
+
+	delay := d.fallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+	startFallback := func() {
+		fallbackTimer.Stop()
+		go race(false, fallbacks)
+	}
+
+	var primaryErr, fallbackErr error
+	started, pending := false, 1
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !started {
+				started, pending = true, pending+1
+				startFallback()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			if !started {
+				started, pending = true, pending+1
+				startFallback()
+			}
+			if pending == 0 {
+				return nil, errors.Join(primaryErr, fallbackErr)
+			}
+		}
+	}
+}
+
+// dialSerial dials targets in order until one connects. When ctx has a deadline
+// each attempt gets an equal share of what is left, so one unreachable address
+// doesn't use up the whole connect timeout.
+func (d *cachingDialer) dialSerial(ctx context.Context, network string, targets []string) (net.Conn, error) {
+	var errs []error
+	for i, target := range targets {
+		dialCtx, cancel := ctx, func() {}
+		if deadline, ok := ctx.Deadline(); ok {
+			dialCtx, cancel = context.WithDeadline(ctx, addrDeadline(time.Now(), deadline, len(targets)-i))
+		}
+		conn, err := d.dialer.DialContext(dialCtx, network, target)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// addrDeadline splits the time left until deadline evenly between the remaining
+// addresses, giving each at least minAddrTimeout but never more than is left
+func addrDeadline(now, deadline time.Time, remaining int) time.Time {
+	timeLeft := deadline.Sub(now)
+	share := timeLeft / time.Duration(remaining)
+	if share < minAddrTimeout {
+		share = min(minAddrTimeout, timeLeft)
+	}
+	return now.Add(share)
+}
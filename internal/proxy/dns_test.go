@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLookup answers every lookup with addrs and counts how often it was asked
+func fakeLookup(calls *atomic.Int32, addrs ...string) func(context.Context, string) ([]netip.Addr, error) {
+	return func(context.Context, string) ([]netip.Addr, error) {
+		calls.Add(1)
+		result := make([]netip.Addr, 0, len(addrs))
+		for _, a := range addrs {
+			result = append(result, netip.MustParseAddr(a))
+		}
+		return result, nil
+	}
+}
+
+func TestDNSCacheResolve(t *testing.T) {
+	var calls atomic.Int32
+	cache := newDNSCache(100 * time.Millisecond)
+	cache.lookup = fakeLookup(&calls, "192.0.2.1")
+
+	for range 3 {
+		addrs, err := cache.resolve(context.Background(), "backend.example")
+		if err != nil || len(addrs) != 1 || addrs[0].String() != "192.0.2.1" {
+			t.Fatalf("resolve() = %v, %v", addrs, err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("lookups = %d before expiry, want 1", got)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := cache.resolve(context.Background(), "backend.example"); err != nil {
+		t.Fatalf("resolve() failed: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("lookups = %d after expiry, want 2", got)
+	}
+}
+
+func TestDNSCacheLookupError(t *testing.T) {
+	cache := newDNSCache(time.Minute)
+	cache.lookup = func(context.Context, string) ([]netip.Addr, error) {
+		return nil, errors.New("mock lookup error")
+	}
+	if _, err := cache.resolve(context.Background(), "backend.example"); err == nil {
+		t.Fatal("expected lookup error")
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("failed lookup was cached: %v", cache.entries)
+	}
+}
+
+func TestCachingDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var calls atomic.Int32
+	cache := newDNSCache(time.Minute)
+	// ::1 is skipped for tcp4 and nothing listens on 127.0.0.2, so the dialer ends up at 127.0.0.1
+	cache.lookup = fakeLookup(&calls, "::1", "127.0.0.2", "127.0.0.1")
+	dialer := &cachingDialer{dialer: &net.Dialer{Timeout: time.Second}, cache: cache}
+
+	for range 2 {
+		conn, err := dialer.DialContext(context.Background(), "tcp4", net.JoinHostPort("backend.example", port))
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+			t.Errorf("dialed %s, want 127.0.0.1", got)
+		}
+		conn.Close()
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("lookups = %d, want 1", got)
+	}
+
+	if _, err := dialer.DialContext(context.Background(), "tcp6", net.JoinHostPort("backend.example", "1")); err == nil {
+		t.Error("expected dial to ::1 port 1 to fail")
+	}
+}
+
+func TestBackendDialerDNSCache(t *testing.T) {
+	p := newTestProxy(t, WithDNSCacheTTL(time.Minute))
+	if _, ok := backendDialer(p.config).(*cachingDialer); !ok {
+		t.Errorf("backendDialer() = %T, want *cachingDialer", backendDialer(p.config))
+	}
+	p = newTestProxy(t)
+	if _, ok := backendDialer(p.config).(*net.Dialer); !ok {
+		t.Errorf("backendDialer() = %T without a dns cache, want *net.Dialer", backendDialer(p.config))
+	}
+}
+
+// TestCachingDialerDualStack tests that cached addresses are dialed with Happy
+// Eyeballs, so an unreachable IPv6 address doesn't hold up the IPv4 one
+func TestCachingDialerDualStack(t *testing.T) {
+	var calls atomic.Int32
+	p := newTestProxy(t, WithDNSCacheTTL(time.Minute), WithDualStack(true, 50*time.Millisecond))
+	p.config.dnsCache.lookup = fakeLookup(&calls, "2001:db8::1", "2001:db8::2", "192.0.2.1")
+	dialer, ok := backendDialer(p.config).(*cachingDialer)
+	if !ok {
+		t.Fatalf("backendDialer() = %T, want *cachingDialer", backendDialer(p.config))
+	}
+	if dialer.fallbackDelay != 50*time.Millisecond {
+		t.Errorf("fallbackDelay = %v, want 50ms", dialer.fallbackDelay)
+	}
+
+	// The IPv6 addresses black-hole until their share of the timeout runs out
+	var deadlines []time.Duration
+	var mu sync.Mutex
+	dialer.dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "192.0.2.1:80" {
+			client, server := net.Pipe()
+			t.Cleanup(func() { server.Close() })
+			return client, nil
+		}
+		deadline, _ := ctx.Deadline()
+		mu.Lock()
+		deadlines = append(deadlines, time.Until(deadline))
+		mu.Unlock()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", "backend.example:80")
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial took %v, want the IPv4 fallback after about 50ms", elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The first of two IPv6 addresses only gets half of the connect timeout
+	if len(deadlines) != 1 || deadlines[0] > 6*time.Second {
+		t.Errorf("IPv6 dial deadlines = %v, want one of about 5s", deadlines)
+	}
+}
+
+func TestAddrDeadline(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		timeLeft  time.Duration
+		remaining int
+		want      time.Duration
+	}{
+		{name: "even share", timeLeft: 9 * time.Second, remaining: 3, want: 3 * time.Second},
+		{name: "minimum share", timeLeft: 5 * time.Second, remaining: 5, want: minAddrTimeout},
+		{name: "never past the deadline", timeLeft: time.Second, remaining: 2, want: time.Second},
+		{name: "last address", timeLeft: 4 * time.Second, remaining: 1, want: 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addrDeadline(now, now.Add(tt.timeLeft), tt.remaining).Sub(now); got != tt.want {
+				t.Errorf("addrDeadline() = %v from now, want %v", got, tt.want)
+			}
+		})
+	}
+}
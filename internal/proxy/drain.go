@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// drainPollInterval is how often shutdown checks whether active connections have finished
+const drainPollInterval = 50 * time.Millisecond
+
+// connContext returns the context proxied connections run under. Without a drain
+// timeout connections are torn down as soon as ctx is cancelled; with one they
+// outlive ctx until the returned cancel func is called.
+func (p *Proxy) connContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.config.drainTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithCancel(context.WithoutCancel(ctx))
+}
+
+// drain waits for active connections to finish on their own, up to the drain timeout
+func (p *Proxy) drain() {
+	if p.config.drainTimeout <= 0 {
+		return
+	}
+	active := p.counters.activeConnections.Load()
+	if active == 0 {
+		return
+	}
+	p.logger.Info("draining connections", "active", active, "timeout", p.config.drainTimeout)
+
+	deadline := time.NewTimer(p.config.drainTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			p.logger.Warn("drain timeout reached, closing connections", "active", p.counters.activeConnections.Load())
+			return
+		case <-ticker.C:
+			if p.counters.activeConnections.Load() == 0 {
+				p.logger.Info("all connections drained")
+				return
+			}
+		}
+	}
+}
+
+// backendConns tracks the established connections to each backend so they can be
+// closed together when the backend's circuit opens
+type backendConns struct {
+	mu    sync.Mutex
+	conns map[string]map[*backendConn]struct{}
+}
+
+// backendConn is one tracked connection; cancel tears it down
+type backendConn struct {
+	cancel context.CancelFunc
+}
+
+// add tracks a connection to backend and returns the func that stops tracking it
+func (b *backendConns) add(backend string, cancel context.CancelFunc) func() {
+	conn := &backendConn{cancel: cancel}
+	b.mu.Lock()
+	if b.conns == nil {
+		b.conns = make(map[string]map[*backendConn]struct{})
+	}
+	if b.conns[backend] == nil {
+		b.conns[backend] = make(map[*backendConn]struct{})
+	}
+	b.conns[backend][conn] = struct{}{}
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.conns[backend], conn)
+		if len(b.conns[backend]) == 0 {
+			delete(b.conns, backend)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// drain cancels every connection to backend and returns how many there were
+func (b *backendConns) drain(backend string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns[backend] {
+		conn.cancel()
+	}
+	return len(b.conns[backend])
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startDrainProxy runs a proxy in front of an echo backend and returns a connected client
+func startDrainProxy(t *testing.T, drainTimeout time.Duration) (net.Conn, context.CancelFunc, *Proxy, string) {
+	t.Helper()
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	t.Cleanup(func() { backendListener.Close() })
+	go func() {
+		for {
+			conn, err := backendListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendListener.Addr().String()), WithDrainTimeout(drainTimeout))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+
+	<-p.Ready()
+	listenAddr := p.Addr().String()
+	conn, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	echo(t, conn, "before shutdown")
+	return conn, cancel, p, listenAddr
+}
+
+// echo sends msg through conn and checks that it comes back
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("got %q (err: %v), want %q", buf, err, msg)
+	}
+}
+
+func TestProxy_DrainLetsConnectionsFinish(t *testing.T) {
+	conn, cancel, p, listenAddr := startDrainProxy(t, 5*time.Second)
+	cancel()
+
+	// New connections are refused once shutdown starts
+	waitFor(t, func() bool {
+		c, err := net.Dial("tcp", listenAddr)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	})
+
+	// The existing connection keeps working during the drain
+	echo(t, conn, "during drain")
+
+	conn.Close()
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not finish after the last connection closed")
+	}
+}
+
+func TestProxy_DrainTimeout(t *testing.T) {
+	conn, cancel, p, _ := startDrainProxy(t, 100*time.Millisecond)
+	start := time.Now()
+	cancel()
+
+	// The idle connection is force-closed once the drain timeout elapses
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("expected connection to be closed by the proxy, got %v", err)
+	}
+	p.Wait()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("connection closed after %v, before the drain timeout", elapsed)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestInvalidDrainTimeout(t *testing.T) {
+	_, err := CreateProxy(WithDrainTimeout(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "drain timeout must not be negative") {
+		t.Errorf("expected drain timeout error, got %v", err)
+	}
+}
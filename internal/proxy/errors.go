@@ -0,0 +1,24 @@
+package proxy
+
+import "errors"
+
+// Errors returned by Run and ListenAndServe, wrapped with details. Use errors.Is
+// to tell them apart, e.g. to retry a bind that failed but not a bad certificate.
+var (
+	// ErrListen means the proxy's listener could not be created. It wraps the
+	// cause, such as ErrBind or ErrLoadCert.
+	ErrListen = errors.New("create listener")
+	// ErrBind means an address could not be bound, e.g. because it is in use
+	ErrBind = errors.New("listen error")
+	// ErrBindPermission means the process may not bind the port, typically one
+	// below 1024. It is wrapped together with ErrBind.
+	ErrBindPermission = errors.New("permission denied")
+	// ErrLoadCert means the TLS certificate or key could not be loaded.
+	// ReloadCert failures wrap it too.
+	ErrLoadCert = errors.New("load x509 key pair")
+	// ErrAccept means accepting connections failed with a non-temporary error
+	ErrAccept = errors.New("accept")
+)
+
+// errStoppedBeforeReady is returned by WaitReady when the proxy stops without ever listening
+var errStoppedBeforeReady = errors.New("proxy stopped before it was ready")
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// handlerPool runs handle on a fixed set of workers, so a connection storm
+// queues up behind the accept loop instead of spawning a goroutine per client
+type handlerPool struct {
+	jobs chan handleJob
+}
+
+type handleJob struct {
+	ctx  context.Context
+	conn net.Conn
+}
+
+// startHandlerPool starts size workers tracked by wg. They run until close is called.
+func (p *Proxy) startHandlerPool(size int, wg *sync.WaitGroup) *handlerPool {
+	pool := &handlerPool{jobs: make(chan handleJob)}
+	wg.Add(size)
+	for range size {
+		go func() {
+			defer wg.Done()
+			for job := range pool.jobs {
+				wg.Add(1)
+				p.handle(job.ctx, job.conn, wg)
+			}
+		}()
+	}
+	return pool
+}
+
+// submit hands conn to the next free worker, blocking while all of them are busy.
+// It reports false if ctx is done before a worker frees up.
+func (h *handlerPool) submit(ctx, connCtx context.Context, conn net.Conn) bool {
+	select {
+	case h.jobs <- handleJob{ctx: connCtx, conn: conn}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close lets the workers exit once they finish their current connection
+func (h *handlerPool) close() {
+	close(h.jobs)
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxy_HandlerPool(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr), WithHandlerPool(1))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go p.Run(ctx)
+	<-p.Ready()
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", p.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		return conn
+	}
+
+	// The only worker is busy with the first connection
+	first := dial()
+	defer first.Close()
+	echo(t, first, "one")
+
+	second := dial()
+	defer second.Close()
+	second.Write([]byte("two"))
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := second.Read(make([]byte, 3)); !isTimeout(err) {
+		t.Fatalf("expected the second connection to wait for a worker, got %v", err)
+	}
+
+	// Once the first connection is done the worker picks up the second
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(second, buf); err != nil || string(buf) != "two" {
+		t.Errorf("got %q (err: %v), want %q", buf, err, "two")
+	}
+
+	cancel()
+	p.Wait()
+}
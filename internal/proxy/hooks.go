@@ -0,0 +1,19 @@
+package proxy
+
+import "net"
+
+// Hooks are optional callbacks invoked at points in a connection's lifecycle.
+// Nil callbacks are skipped. Callbacks run synchronously on the connection's
+// goroutine, so they should return quickly.
+type Hooks struct {
+	// OnAccept is called right after a client connection is accepted.
+	OnAccept func(conn net.Conn)
+	// OnBackendDial is called after dialing the backend; err is nil on success.
+	OnBackendDial func(client net.Conn, backend string, err error)
+	// OnClose is called once the client connection is closed, with the number of
+	// bytes copied from the client to the backend (bytesIn) and back (bytesOut).
+	OnClose func(client net.Conn, bytesIn, bytesOut int64)
+	// OnStats is called after OnClose with the exact byte counts for the
+	// connection, e.g. for billing.
+	OnStats func(client net.Conn, stats Stats)
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+
+	// Backend reads the request and replies with a longer response
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		conn.Write([]byte("hello, client"))
+	}()
+
+	var mu sync.Mutex
+	var accepted, dialed bool
+	var dialErr error
+	var bytesIn, bytesOut int64
+	var stats Stats
+	closed := make(chan struct{})
+	hooks := Hooks{
+		OnAccept: func(net.Conn) {
+			mu.Lock()
+			defer mu.Unlock()
+			accepted = true
+		},
+		OnBackendDial: func(_ net.Conn, backend string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dialed = backend == backendListener.Addr().String()
+			dialErr = err
+		},
+		OnClose: func(_ net.Conn, in, out int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			bytesIn, bytesOut = in, out
+		},
+		OnStats: func(_ net.Conn, s Stats) {
+			mu.Lock()
+			defer mu.Unlock()
+			stats = s
+			close(closed)
+		},
+	}
+
+	mockListener := newMockListener(false)
+	proxy, err := CreateProxy(WithBackendAddr(backendListener.Addr().String()), WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	proxy.listenerFactory = func(config config) (net.Listener, error) {
+		return mockListener, nil
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go proxy.Run(ctx)
+
+	clientConn, proxyConn := net.Pipe()
+	mockListener.conns <- proxyConn
+
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	clientConn.Write([]byte("hello"))
+	response := make([]byte, len("hello, client"))
+	if _, err := io.ReadFull(clientConn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	clientConn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnClose wasn't called")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !accepted {
+		t.Error("OnAccept wasn't called")
+	}
+	if !dialed || dialErr != nil {
+		t.Errorf("OnBackendDial wasn't called with the backend address (err: %v)", dialErr)
+	}
+	if bytesIn != 5 || bytesOut != int64(len(response)) {
+		t.Errorf("OnClose got bytesIn=%d bytesOut=%d, expected 5 and %d", bytesIn, bytesOut, len(response))
+	}
+	expected := Stats{ClientAddr: proxyConn.RemoteAddr(), BytesClientToBackend: 5, BytesBackendToClient: int64(len(response))}
+	if stats != expected {
+		t.Errorf("OnStats got %+v, expected %+v", stats, expected)
+	}
+	cancel()
+	proxy.Wait()
+}
+
+func TestHooksBackendDialFailure(t *testing.T) {
+	dialErrs := make(chan error, 1)
+	closed := make(chan struct{})
+	p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithHooks(Hooks{
+		OnBackendDial: func(_ net.Conn, _ string, err error) { dialErrs <- err },
+		OnClose:       func(net.Conn, int64, int64) { close(closed) },
+	}))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	p.handle(context.Background(), proxyConn, &wg)
+
+	if err := <-dialErrs; err == nil {
+		t.Error("expected OnBackendDial to receive the dial error")
+	}
+	select {
+	case <-closed:
+	default:
+		t.Error("expected OnClose to be called after a failed dial")
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// acquireConnSlot reserves a slot for a new connection, waiting up to the configured
+// time for one to free up. It reports false if the connection limit is still reached.
+func (p *Proxy) acquireConnSlot(ctx context.Context) bool {
+	if p.connSlots == nil {
+		return true
+	}
+	select {
+	case p.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if p.config.maxConnectionsWait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(p.config.maxConnectionsWait)
+	defer timer.Stop()
+	select {
+	case p.connSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *Proxy) releaseConnSlot() {
+	if p.connSlots != nil {
+		<-p.connSlots
+	}
+}
+
+// acquireIPSlot reserves a connection slot for the client IP. It reports false if
+// the IP already has the maximum number of connections open.
+func (p *Proxy) acquireIPSlot(ip string) bool {
+	if p.config.maxConnectionsPerIP <= 0 || ip == "" {
+		return true
+	}
+	p.ipConnsMu.Lock()
+	defer p.ipConnsMu.Unlock()
+	if p.ipConns[ip] >= p.config.maxConnectionsPerIP {
+		return false
+	}
+	p.ipConns[ip]++
+	return true
+}
+
+func (p *Proxy) releaseIPSlot(ip string) {
+	if p.config.maxConnectionsPerIP <= 0 || ip == "" {
+		return
+	}
+	p.ipConnsMu.Lock()
+	defer p.ipConnsMu.Unlock()
+	p.ipConns[ip]--
+	// Drop zeroed entries so the map doesn't grow with every client ever seen
+	if p.ipConns[ip] <= 0 {
+		delete(p.ipConns, ip)
+	}
+}
+
+// checkClientAllowed applies the CIDR allow and deny lists to a client address.
+// The denylist wins over the allowlist, and an empty allowlist allows everyone.
+func (p *Proxy) checkClientAllowed(addr net.Addr) error {
+	if len(p.config.allowedCIDRs) == 0 && len(p.config.deniedCIDRs) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		if len(p.config.allowedCIDRs) > 0 {
+			return errors.New("client has no ip address to check against the allowlist")
+		}
+		return nil
+	}
+	for _, ipNet := range p.config.deniedCIDRs {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("client ip %s is in denied range %s", ip, ipNet)
+		}
+	}
+	if len(p.config.allowedCIDRs) == 0 {
+		return nil
+	}
+	for _, ipNet := range p.config.allowedCIDRs {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client ip %s is not in an allowed range", ip)
+}
+
+// clientIP returns the IP part of a client address, or an empty string if it has none
+func clientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
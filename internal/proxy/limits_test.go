@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcquireConnSlot(t *testing.T) {
+	t.Run("no limit", func(t *testing.T) {
+		p := newTestProxy(t)
+		for i := 0; i < 10; i++ {
+			if !p.acquireConnSlot(context.Background()) {
+				t.Fatal("expected slot to be acquired without a limit")
+			}
+		}
+	})
+
+	t.Run("reject when full", func(t *testing.T) {
+		p := newTestProxy(t, WithMaxConnections(1))
+		if !p.acquireConnSlot(context.Background()) {
+			t.Fatal("expected first slot to be acquired")
+		}
+		if p.acquireConnSlot(context.Background()) {
+			t.Fatal("expected second slot to be rejected")
+		}
+		p.releaseConnSlot()
+		if !p.acquireConnSlot(context.Background()) {
+			t.Fatal("expected slot to be acquired after release")
+		}
+	})
+
+	t.Run("wait for a free slot", func(t *testing.T) {
+		p := newTestProxy(t, WithMaxConnections(1), WithMaxConnectionsWait(time.Second))
+		if !p.acquireConnSlot(context.Background()) {
+			t.Fatal("expected first slot to be acquired")
+		}
+		time.AfterFunc(50*time.Millisecond, p.releaseConnSlot)
+		if !p.acquireConnSlot(context.Background()) {
+			t.Fatal("expected slot to be acquired once released")
+		}
+	})
+
+	t.Run("give up after waiting", func(t *testing.T) {
+		p := newTestProxy(t, WithMaxConnections(1), WithMaxConnectionsWait(50*time.Millisecond))
+		p.acquireConnSlot(context.Background())
+		start := time.Now()
+		if p.acquireConnSlot(context.Background()) {
+			t.Fatal("expected slot to be rejected after waiting")
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("gave up after %v, expected to wait at least 50ms", elapsed)
+		}
+	})
+}
+
+func TestProxy_MaxConnections(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+
+	// Backend holds every connection open
+	go func() {
+		for {
+			conn, err := backendListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	mockListener := newMockListener(false)
+	proxy := newTestProxy(t, WithBackendAddr(backendListener.Addr().String()), WithMaxConnections(1))
+	proxy.listenerFactory = func(config config) (net.Listener, error) {
+		return mockListener, nil
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go proxy.Run(ctx)
+
+	firstClient, firstProxy := net.Pipe()
+	defer firstClient.Close()
+	mockListener.conns <- firstProxy
+	waitFor(t, func() bool { return proxy.Stats().ActiveConnections == 1 })
+
+	// The second connection is over the limit and gets closed right away
+	secondClient, secondProxy := net.Pipe()
+	defer secondClient.Close()
+	mockListener.conns <- secondProxy
+	secondClient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := secondClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection over the limit to be closed, got %v", err)
+	}
+	if got := proxy.Stats().Rejected; got != (Rejections{MaxConnections: 1}) {
+		t.Errorf("Rejected = %+v, want one connection over the limit", got)
+	}
+
+	cancel()
+	proxy.Wait()
+}
+
+func TestAcquireIPSlot(t *testing.T) {
+	p := newTestProxy(t, WithMaxConnectionsPerIP(2))
+
+	for i := 0; i < 2; i++ {
+		if !p.acquireIPSlot("10.0.0.1") {
+			t.Fatalf("expected slot %d to be acquired", i+1)
+		}
+	}
+	if p.acquireIPSlot("10.0.0.1") {
+		t.Fatal("expected third connection from the same IP to be rejected")
+	}
+	if !p.acquireIPSlot("10.0.0.2") {
+		t.Fatal("expected connection from another IP to be accepted")
+	}
+
+	p.releaseIPSlot("10.0.0.1")
+	if !p.acquireIPSlot("10.0.0.1") {
+		t.Fatal("expected slot to be acquired after release")
+	}
+
+	// Zeroed entries are removed from the map
+	p.releaseIPSlot("10.0.0.1")
+	p.releaseIPSlot("10.0.0.1")
+	p.releaseIPSlot("10.0.0.2")
+	if len(p.ipConns) != 0 {
+		t.Errorf("expected per-ip map to be empty, got %v", p.ipConns)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{"tcp4", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, "192.0.2.1"},
+		{"tcp6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, "2001:db8::1"},
+		{"unix", &net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientIP(tt.addr); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckClientAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		addr    net.Addr
+		wantErr bool
+	}{
+		{"no lists", nil, nil, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, false},
+		{"allowed", []string{"192.0.2.0/24"}, nil, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, false},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1)}, true},
+		{"denied", nil, []string{"192.0.2.0/24"}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, true},
+		{"not denied", nil, []string{"192.0.2.0/24"}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1)}, false},
+		{"deny wins over allow", []string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 200)}, true},
+		{"ipv6", []string{"2001:db8::/32"}, nil, &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, false},
+		{"no ip with allowlist", []string{"192.0.2.0/24"}, nil, &net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"}, true},
+		{"no ip with denylist", nil, []string{"192.0.2.0/24"}, &net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, WithAllowedCIDRs(tt.allowed), WithDeniedCIDRs(tt.denied))
+			if err := p.checkClientAllowed(tt.addr); (err != nil) != tt.wantErr {
+				t.Errorf("checkClientAllowed() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxy_DeniedClient(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	backendConns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		backendConns <- conn
+	}()
+
+	proxy := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendListener.Addr().String()), WithDeniedCIDRs([]string{"127.0.0.0/8"}))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go proxy.Run(ctx)
+	<-proxy.Ready()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected denied client to be closed, got %v", err)
+	}
+	select {
+	case backend := <-backendConns:
+		backend.Close()
+		t.Error("denied client was forwarded to the backend")
+	default:
+	}
+	if got := proxy.Stats().Rejected; got != (Rejections{IPDenied: 1}) {
+		t.Errorf("Rejected = %+v, want one denied client", got)
+	}
+
+	cancel()
+	proxy.Wait()
+}
+
+func TestProxy_AcceptRateLimit(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr), WithAcceptRateLimit(10, 2))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer p.Wait()
+	defer cancel()
+	go p.Run(ctx)
+	<-p.Ready()
+
+	for range 4 {
+		conn, err := net.Dial("tcp", p.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		defer conn.Close()
+	}
+
+	// The burst is accepted straight away and the rest at 10 per second
+	time.Sleep(50 * time.Millisecond)
+	if got := p.Stats().AcceptedConnections; got != 2 {
+		t.Errorf("AcceptedConnections = %d after 50ms, want the burst of 2", got)
+	}
+	waitFor(t, func() bool { return p.Stats().AcceptedConnections == 4 })
+	if got := p.Stats().AcceptedConnections; got != 4 {
+		t.Errorf("AcceptedConnections = %d, want all 4 in the end", got)
+	}
+}
+
+func TestWithAcceptRateLimitValidation(t *testing.T) {
+	if _, err := CreateProxy(WithAcceptRateLimit(-1, 1)); err == nil {
+		t.Error("expected error for negative accept rate")
+	}
+	if _, err := CreateProxy(WithAcceptRateLimit(10, 0)); err == nil {
+		t.Error("expected error for zero burst")
+	}
+	p := newTestProxy(t, WithAcceptRateLimit(0, 0))
+	if p.acceptLimiter != nil {
+		t.Error("expected a zero rate to disable accept rate limiting")
+	}
+}
@@ -1,35 +1,231 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync/atomic"
 )
 
-type ListenerFactory func(config config) (net.Listener, error)
+// unixSocketMode lets the owner and group connect to a Unix listener socket
+const unixSocketMode = 0o660
 
-var tcpListenerFactory ListenerFactory = func(config config) (net.Listener, error) {
-	l, err := net.Listen("tcp", config.listenAddr)
+// ListenerFactory creates a listener for network and addr. A factory passed to
+// WithListenerFactory is called once per listen address and acceptor.
+type ListenerFactory func(network, addr string) (net.Listener, error)
+
+// listenFunc creates the proxy's listener from the whole config
+type listenFunc func(config config) (net.Listener, error)
+
+var tcpListenerFactory listenFunc = func(config config) (net.Listener, error) {
+	var lc net.ListenConfig
+	if config.acceptors > 1 {
+		lc.Control = setReusePort
+	}
+	l, err := lc.Listen(context.Background(), "tcp", config.listenAddr)
 	if err != nil {
-		return nil, fmt.Errorf("listen error: %w", err)
+		return nil, bindError(err)
+	}
+	if config.acceptProxyProtocol {
+		return newProxyProtoListener(l, config.maxHandshakeBytes), nil
 	}
 	return l, nil
 }
 
-var tlsListenerFactory ListenerFactory = func(config config) (net.Listener, error) {
-	if config.certFilePath == "" || config.keyFilePath == "" {
-		return nil, errors.New("cert file path or key file path is empty")
+var unixListenerFactory listenFunc = func(config config) (net.Listener, error) {
+	if err := removeStaleSocket(config.listenAddr); err != nil {
+		return nil, err
 	}
-	cert, err := tls.LoadX509KeyPair(config.certFilePath, config.keyFilePath)
+	// The socket file is unlinked again when the listener is closed
+	l, err := net.Listen("unix", config.listenAddr)
 	if err != nil {
-		return nil, fmt.Errorf("load x509 key pair: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrBind, err)
 	}
-	//nolint:gosec
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-	l, err := tls.Listen("tcp", config.listenAddr, tlsConfig)
+	if err := os.Chmod(config.listenAddr, unixSocketMode); err != nil {
+		//nolint:errcheck
+		l.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	if config.acceptProxyProtocol {
+		return newProxyProtoListener(l, config.maxHandshakeBytes), nil
+	}
+	return l, nil
+}
+
+// bindError wraps a failure to bind a TCP or UDP port in ErrBind, explaining how
+// to get permission when the port is privileged
+func bindError(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w: %w: %w; ports below 1024 need root or, on Linux, the CAP_NET_BIND_SERVICE capability "+
+			"(e.g. setcap cap_net_bind_service=+ep on the binary)", ErrBind, ErrBindPermission, err)
+	}
+	return fmt.Errorf("%w: %w", ErrBind, err)
+}
+
+// inheritedListenerFactory adopts the listening socket passed in by the process that
+// started this one, instead of binding the listen address
+var inheritedListenerFactory listenFunc = func(config config) (net.Listener, error) {
+	f := os.NewFile(config.inheritedFD, "inherited-listener")
+	if f == nil {
+		return nil, fmt.Errorf("%w: invalid inherited listener fd %d", ErrBind, config.inheritedFD)
+	}
+	// FileListener works on a duplicate, so the original descriptor is closed either way
+	l, err := net.FileListener(f)
+	//nolint:errcheck
+	f.Close()
 	if err != nil {
-		return nil, fmt.Errorf("listen error: %w", err)
+		return nil, fmt.Errorf("%w: inherited listener fd %d: %w", ErrBind, config.inheritedFD, err)
+	}
+	if config.acceptProxyProtocol {
+		return newProxyProtoListener(l, config.maxHandshakeBytes), nil
 	}
 	return l, nil
 }
+
+// baseListenerFactory returns the factory for the plain listener TLS is layered on
+func baseListenerFactory(config config) listenFunc {
+	switch {
+	case config.inheritListener:
+		return inheritedListenerFactory
+	case config.listenNetwork == "unix":
+		return unixListenerFactory
+	default:
+		return tcpListenerFactory
+	}
+}
+
+// listenerFile returns a duplicate of the file descriptor under l, looking through
+// the TLS and PROXY protocol wrappers
+func listenerFile(l net.Listener) (*os.File, error) {
+	for {
+		switch ln := l.(type) {
+		case *tlsListener:
+			l = ln.Listener
+		case *proxyProtoListener:
+			l = ln.Listener
+		case *net.UnixListener:
+			// The socket file has to outlive this listener for whoever takes it over
+			ln.SetUnlinkOnClose(false)
+			return ln.File()
+		case interface{ File() (*os.File, error) }:
+			return ln.File()
+		default:
+			return nil, fmt.Errorf("listener %T has no file descriptor", l)
+		}
+	}
+}
+
+// customListenerFactory adapts a user supplied ListenerFactory
+func customListenerFactory(factory ListenerFactory) listenFunc {
+	return func(config config) (net.Listener, error) {
+		return factory(config.listenNetwork, config.listenAddr)
+	}
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run.
+// Anything other than a socket is left alone so a typo can't delete a regular file.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat socket: %w", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	return nil
+}
+
+var tlsListenerFactory listenFunc = func(config config) (net.Listener, error) {
+	store := config.certStore
+	if store == nil {
+		store = &certStore{}
+	}
+	switch {
+	case config.certificate != nil:
+		store.cert.Store(config.certificate)
+	case config.certFilePath == "" || config.keyFilePath == "":
+		return nil, fmt.Errorf("%w: cert file path or key file path is empty", ErrLoadCert)
+	default:
+		if err := store.load(config.certFilePath, config.keyFilePath); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig := &tls.Config{
+		// Look the certificate up on every handshake so a reloaded one is picked up by new connections
+		GetCertificate: store.getCertificate,
+		MinVersion:     config.minTLSVersion,
+		CipherSuites:   config.tlsCipherSuites,
+		NextProtos:     config.alpnProtocols,
+		// Tickets are encrypted with keys rotated by crypto/tls unless fixed ones are set
+		SessionTicketsDisabled: config.noSessionTickets,
+	}
+	if len(config.sessionTicketKeys) > 0 {
+		tlsConfig.SetSessionTicketKeys(config.sessionTicketKeys)
+	}
+	if config.clientCAs != nil {
+		tlsConfig.ClientCAs = config.clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// Any PROXY protocol header precedes the TLS handshake, so TLS sits on top of the plain listener
+	l, err := baseListenerFactory(config)(config)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsListener{Listener: l, config: tlsConfig}, nil
+}
+
+// tlsListener is what tls.NewListener returns, but with the plain listener
+// reachable so listenerFile can get at its descriptor
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+// certStore holds the listener certificate and allows swapping it while the listener is running
+type certStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// load reads a key pair and swaps it in. The pair is parsed and checked against
+// itself first, so a broken or mismatched one leaves the current certificate serving.
+func (s *certStore) load(certFilePath, keyFilePath string) error {
+	certPEM, err := os.ReadFile(certFilePath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLoadCert, err)
+	}
+	keyPEM, err := os.ReadFile(keyFilePath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLoadCert, err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLoadCert, err)
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return cert, nil
+}
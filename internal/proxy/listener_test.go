@@ -2,18 +2,24 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"io"
 	"math/big"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -85,6 +91,61 @@ func TestTCPListenerFactory(t *testing.T) {
 	})
 }
 
+func TestUnixListenerFactory(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxy.sock")
+		ln, err := unixListenerFactory(config{listenAddr: path})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("expected socket file: %v", err)
+		}
+		if perm := info.Mode().Perm(); perm != unixSocketMode {
+			t.Errorf("got socket mode %o, want %o", perm, unixSocketMode)
+		}
+
+		ln.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected socket file to be removed on close, got %v", err)
+		}
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxy.sock")
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("failed to create stale socket: %v", err)
+		}
+		// Leave the file behind as a crashed process would
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		ln, err := unixListenerFactory(config{listenAddr: path})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ln.Close()
+	})
+
+	t.Run("regular file in the way", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxy.sock")
+		if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		ln, err := unixListenerFactory(config{listenAddr: path})
+		if err == nil {
+			ln.Close()
+			t.Fatal("expected error, got nil")
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected regular file to be kept: %v", err)
+		}
+	})
+}
+
 func TestTLSListenerFactory(t *testing.T) {
 	t.Run("empty cert or key path", func(t *testing.T) {
 		cfg := config{listenAddr: "127.0.0.1:0"}
@@ -93,6 +154,9 @@ func TestTLSListenerFactory(t *testing.T) {
 			ln.Close()
 			t.Fatalf("expected error for empty cert/key path")
 		}
+		if !errors.Is(err, ErrLoadCert) {
+			t.Errorf("expected ErrLoadCert, got %v", err)
+		}
 	})
 
 	t.Run("invalid cert path", func(t *testing.T) {
@@ -106,6 +170,9 @@ func TestTLSListenerFactory(t *testing.T) {
 			ln.Close()
 			t.Fatalf("expected error for invalid cert path")
 		}
+		if !errors.Is(err, ErrLoadCert) || errors.Is(err, ErrBind) {
+			t.Errorf("expected ErrLoadCert only, got %v", err)
+		}
 	})
 
 	t.Run("success with temp cert", func(t *testing.T) {
@@ -154,6 +221,83 @@ func TestTLSListenerFactory(t *testing.T) {
 		}
 	})
 
+	t.Run("rejects clients below min version", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		certPath, keyPath := generateTempCert(t, tmpDir)
+
+		cfg := config{
+			listenAddr:    "127.0.0.1:0",
+			certFilePath:  certPath,
+			keyFilePath:   keyPath,
+			minTLSVersion: tls.VersionTLS13,
+		}
+		ln, err := tlsListenerFactory(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer ln.Close()
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.(*tls.Conn).Handshake()
+		}()
+
+		clientConfig := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("expected handshake to fail for TLS 1.2 client")
+		}
+	})
+
+	t.Run("negotiates configured ALPN protocol", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		certPath, keyPath := generateTempCert(t, tmpDir)
+
+		cfg := config{
+			listenAddr:    "127.0.0.1:0",
+			certFilePath:  certPath,
+			keyFilePath:   keyPath,
+			alpnProtocols: []string{"h2"},
+		}
+		ln, err := tlsListenerFactory(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer ln.Close()
+
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		if err != nil {
+			t.Fatalf("failed to dial TLS listener: %v", err)
+		}
+		if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+			t.Errorf("expected negotiated protocol h2, got %q", proto)
+		}
+		conn.Close()
+
+		// A client offering only unsupported protocols is rejected
+		conn, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3"}})
+		if err == nil {
+			conn.Close()
+			t.Fatalf("expected handshake to fail for mismatched ALPN protocols")
+		}
+	})
+
 	t.Run("check that traffic is really encrypted", func(t *testing.T) {
 		tmpDir := t.TempDir()
 		certPath, keyPath := generateTempCert(t, tmpDir)
@@ -244,3 +388,353 @@ func (c *connSpy) Read(p []byte) (n int, err error) {
 	}
 	return n, err
 }
+
+// generateClientCert returns a self-signed client certificate that doubles as its own CA
+func generateClientCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate private key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(0xbeef),
+		Subject:               pkix.Name{CommonName: "client-1", Organization: []string{"Test Org"}},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, cert
+}
+
+func TestProxy_ClientCert(t *testing.T) {
+	certPEM, keyPEM := readTempCert(t, t.TempDir())
+	clientCert, clientX509 := generateClientCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(clientX509)
+
+	var accessLog bytes.Buffer
+	statsCh := make(chan Stats, 2)
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr),
+		WithTlSEnabled(true), WithCertKeyPEM(certPEM, keyPEM), WithClientCAs(pool),
+		WithAccessLog(&accessLog), WithAccessLogFormat(AccessLogJSON),
+		WithHooks(Hooks{OnStats: func(_ net.Conn, stats Stats) { statsCh <- stats }}))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-p.Ready()
+
+	// A client without a certificate doesn't get through the handshake
+	if conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{InsecureSkipVerify: true}); err == nil {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("expected a client without a certificate to be rejected")
+		}
+		conn.Close()
+	}
+
+	conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatalf("TLS dial failed: %v", err)
+	}
+	echo(t, conn, "ping")
+	conn.Close()
+
+	nextStats := func() Stats {
+		select {
+		case stats := <-statsCh:
+			return stats
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnStats was not called")
+			return Stats{}
+		}
+	}
+	if stats := nextStats(); stats.ClientCertSubject != "" {
+		t.Errorf("rejected client reported certificate %q", stats.ClientCertSubject)
+	}
+	stats := nextStats()
+	if stats.ClientCertSubject != "CN=client-1,O=Test Org" || stats.ClientCertSerial != "BEEF" || len(stats.ClientCertFingerprint) != 64 {
+		t.Errorf("unexpected client certificate in stats: %+v", stats)
+	}
+
+	cancel()
+	p.Wait()
+	lines := strings.Split(strings.TrimSpace(accessLog.String()), "\n")
+	var entry accessLogEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatalf("failed to parse access log line %q: %v", accessLog.String(), err)
+	}
+	if entry.ClientCertSubject != stats.ClientCertSubject || entry.ClientCertSerial != stats.ClientCertSerial || entry.ClientCertFingerprint != stats.ClientCertFingerprint {
+		t.Errorf("access log entry %+v doesn't match stats %+v", entry, stats)
+	}
+
+	if _, err := CreateProxy(WithClientCAs(pool)); err == nil || !strings.Contains(err.Error(), "requires tls") {
+		t.Errorf("expected error for client CAs without tls, got %v", err)
+	}
+}
+
+func TestProxy_TLSConnectionInfo(t *testing.T) {
+	certPEM, keyPEM := readTempCert(t, t.TempDir())
+	var accessLog bytes.Buffer
+	statsCh := make(chan Stats, 1)
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr),
+		WithTlSEnabled(true), WithCertKeyPEM(certPEM, keyPEM), WithAccessLog(&accessLog),
+		WithHooks(Hooks{OnStats: func(_ net.Conn, stats Stats) { statsCh <- stats }}))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-p.Ready()
+
+	conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{
+		ServerName:         "db.example",
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("TLS dial failed: %v", err)
+	}
+	echo(t, conn, "ping")
+	conn.Close()
+
+	var stats Stats
+	select {
+	case stats = <-statsCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnStats was not called")
+	}
+	if stats.TLSVersion != "TLS 1.2" || stats.TLSCipherSuite != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" || stats.TLSServerName != "db.example" {
+		t.Errorf("unexpected TLS details in stats: %+v", stats)
+	}
+
+	cancel()
+	p.Wait()
+	want := ` tls_version="TLS 1.2" tls_cipher_suite=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 tls_server_name=db.example` + "\n"
+	if !strings.HasSuffix(accessLog.String(), want) {
+		t.Errorf("access log %q doesn't end with %q", accessLog.String(), want)
+	}
+}
+
+func TestProxy_TLSSessionTickets(t *testing.T) {
+	certPEM, keyPEM := readTempCert(t, t.TempDir())
+	backendAddr := startEchoBackend(t, "")
+	start := func(options ...Option) *Proxy {
+		t.Helper()
+		options = append([]Option{WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr),
+			WithTlSEnabled(true), WithCertKeyPEM(certPEM, keyPEM)}, options...)
+		p := newTestProxy(t, options...)
+		ctx, cancel := context.WithCancel(t.Context())
+		t.Cleanup(func() {
+			cancel()
+			p.Wait()
+		})
+		go p.Run(ctx)
+		<-p.Ready()
+		return p
+	}
+	// resumed connects with cache and reports whether the session was resumed
+	resumed := func(p *Proxy, cache tls.ClientSessionCache) bool {
+		t.Helper()
+		conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{
+			ServerName:         "proxy.example",
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+		})
+		if err != nil {
+			t.Fatalf("TLS dial failed: %v", err)
+		}
+		defer conn.Close()
+		// Reading processes the ticket the server sends after the handshake
+		echo(t, conn, "ping")
+		return conn.ConnectionState().DidResume
+	}
+
+	// Proxies sharing ticket keys resume each other's sessions
+	keys := [][32]byte{{1, 2, 3}}
+	first := start(WithTLSSessionTicketKeys(keys))
+	second := start(WithTLSSessionTicketKeys(keys))
+	cache := tls.NewLRUClientSessionCache(1)
+	if resumed(first, cache) {
+		t.Error("first connection resumed a session")
+	}
+	if !resumed(second, cache) {
+		t.Error("expected a proxy with the same ticket keys to resume the session")
+	}
+
+	// Without tickets every connection does a full handshake
+	disabled := start(WithTLSSessionTicketsDisabled(true))
+	cache = tls.NewLRUClientSessionCache(1)
+	resumed(disabled, cache)
+	if resumed(disabled, cache) {
+		t.Error("expected no resumption with session tickets disabled")
+	}
+
+	if _, err := CreateProxy(WithTLSSessionTicketKeys(nil)); err == nil || !strings.Contains(err.Error(), "no session ticket keys given") {
+		t.Errorf("expected error for empty ticket keys, got %v", err)
+	}
+	if err := first.Reload(WithTLSSessionTicketKeys([][32]byte{{4, 5, 6}})); err == nil || !strings.Contains(err.Error(), "tls session tickets cannot be changed by reload") {
+		t.Errorf("expected reload error, got %v", err)
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	tmpDir := t.TempDir()
+	certPath, keyPath := generateTempCert(t, tmpDir)
+
+	store := &certStore{}
+	cfg := config{
+		listenAddr:   "127.0.0.1:0",
+		certFilePath: certPath,
+		keyFilePath:  keyPath,
+		certStore:    store,
+	}
+	ln, err := tlsListenerFactory(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	peerCert := func() []byte {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("failed to dial TLS listener: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	before := peerCert()
+
+	// Rotate the files on disk and reload them
+	rotatedCert, rotatedKey := generateTempCert(t, t.TempDir())
+	certBytes, _ := os.ReadFile(rotatedCert)
+	keyBytes, _ := os.ReadFile(rotatedKey)
+	os.WriteFile(certPath, certBytes, 0o600)
+	os.WriteFile(keyPath, keyBytes, 0o600)
+	if err := store.load(certPath, keyPath); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	after := peerCert()
+	if bytes.Equal(before, after) {
+		t.Error("expected new handshakes to use the reloaded certificate")
+	}
+	block, _ := pem.Decode(certBytes)
+	if !bytes.Equal(after, block.Bytes) {
+		t.Error("served certificate doesn't match the rotated certificate")
+	}
+
+	// A broken or mismatched pair is refused and the last good certificate keeps serving
+	os.WriteFile(certPath, []byte("-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n"), 0o600)
+	if err := store.load(certPath, keyPath); !errors.Is(err, ErrLoadCert) {
+		t.Errorf("expected %v for an invalid PEM, got %v", ErrLoadCert, err)
+	}
+	os.WriteFile(certPath, certBytes, 0o600)
+	_, otherKey := generateTempCert(t, t.TempDir())
+	otherKeyBytes, _ := os.ReadFile(otherKey)
+	os.WriteFile(keyPath, otherKeyBytes, 0o600)
+	if err := store.load(certPath, keyPath); !errors.Is(err, ErrLoadCert) {
+		t.Errorf("expected %v for a key that doesn't match, got %v", ErrLoadCert, err)
+	}
+	if !bytes.Equal(peerCert(), after) {
+		t.Error("expected the last good certificate to be served after a failed reload")
+	}
+}
+
+func TestWithListenerFactory(t *testing.T) {
+	certFile, keyFile, err := createTempCertAndKey(t)
+	if err != nil {
+		t.Fatalf("Failed to create temp cert and key: %v", err)
+	}
+	var gotNetwork, gotAddr string
+	factory := func(network, addr string) (net.Listener, error) {
+		gotNetwork, gotAddr = network, addr
+		return newMockListener(false), nil
+	}
+	// The custom factory wins even when TLS would otherwise be selected
+	p, err := CreateProxy(WithListenAddr("127.0.0.1:7000"), WithTlSEnabled(true), WithCertFilePath(certFile), WithKeyFilePath(keyFile), WithListenerFactory(factory))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	ln, err := p.listenerFactory(p.config)
+	if err != nil {
+		t.Fatalf("listener factory failed: %v", err)
+	}
+	defer ln.Close()
+	if _, ok := ln.(*mockListener); !ok {
+		t.Errorf("got listener %T, want the custom one", ln)
+	}
+	if gotNetwork != "tcp" || gotAddr != "127.0.0.1:7000" {
+		t.Errorf("factory called with %q %q, want tcp 127.0.0.1:7000", gotNetwork, gotAddr)
+	}
+
+	if _, err := CreateProxy(WithListenerFactory(nil)); err == nil || !strings.Contains(err.Error(), "listener factory is nil") {
+		t.Errorf("expected nil factory error, got %v", err)
+	}
+}
+
+func TestBindError(t *testing.T) {
+	denied := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EACCES)}
+	err := bindError(denied)
+	if !errors.Is(err, ErrBind) || !errors.Is(err, ErrBindPermission) || !errors.Is(err, syscall.EACCES) {
+		t.Errorf("bindError() = %v, want ErrBind, ErrBindPermission and the cause", err)
+	}
+	if !strings.Contains(err.Error(), "CAP_NET_BIND_SERVICE") {
+		t.Errorf("bindError() = %q, want a capability hint", err)
+	}
+
+	inUse := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	err = bindError(inUse)
+	if !errors.Is(err, ErrBind) || errors.Is(err, ErrBindPermission) {
+		t.Errorf("bindError() = %v, want ErrBind only", err)
+	}
+}
+
+func TestListenerFileErrors(t *testing.T) {
+	p := newTestProxy(t)
+	if _, err := p.ListenerFile(); err == nil {
+		t.Error("ListenerFile() should fail before the proxy is listening")
+	}
+	p.listeners = []net.Listener{newMockListener(false)}
+	if _, err := p.ListenerFile(); err == nil {
+		t.Error("ListenerFile() should fail for a listener without a file descriptor")
+	}
+	_, err := CreateProxy(WithInheritedListener(3), WithAcceptors(2))
+	if err == nil || !strings.Contains(err.Error(), "inherited listener") {
+		t.Errorf("expected inherited listener error with multiple acceptors, got %v", err)
+	}
+}
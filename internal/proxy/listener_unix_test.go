@@ -0,0 +1,58 @@
+//go:build unix
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// TestListenerHandoff tests that a second proxy adopting the first one's socket serves its port
+func TestListenerHandoff(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	old := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr))
+	oldCtx, stopOld := context.WithCancel(t.Context())
+	defer stopOld()
+	go func() {
+		if err := old.Run(oldCtx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-old.Ready()
+
+	f, err := old.ListenerFile()
+	if err != nil {
+		t.Fatalf("ListenerFile() failed: %v", err)
+	}
+	// The new proxy takes ownership of the descriptor, as a child process would of its inherited one
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to dup listener fd: %v", err)
+	}
+	p := newTestProxy(t, WithInheritedListener(uintptr(fd)), WithBackendAddr(backendAddr))
+	defer p.Wait()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-p.Ready()
+	if p.Addr().String() != old.Addr().String() {
+		t.Errorf("new proxy listens on %v, want %v", p.Addr(), old.Addr())
+	}
+
+	// Once the old proxy is gone, the port is still served
+	stopOld()
+	old.Wait()
+	conn, err := net.Dial("tcp", old.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial the handed over port: %v", err)
+	}
+	defer conn.Close()
+	echo(t, conn, "ping")
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+)
+
+// errMaintenance is the close reason for connections turned away in maintenance mode
+var errMaintenance = errors.New("proxy in maintenance mode")
+
+// maintenance is the state SetMaintenance switched on; its message goes to every new client
+type maintenance struct {
+	message []byte
+}
+
+// SetMaintenance switches maintenance mode on or off at runtime. While it is on the
+// listener stays bound and new connections are accepted, sent message if it is not
+// empty, and closed without dialing a backend. Established connections are unaffected.
+func (p *Proxy) SetMaintenance(on bool, message []byte) {
+	if !on {
+		if p.maintenance.Swap(nil) != nil {
+			p.logger.Info("maintenance mode disabled")
+		}
+		return
+	}
+	p.maintenance.Store(&maintenance{message: bytes.Clone(message)})
+	p.logger.Info("maintenance mode enabled")
+}
+
+// InMaintenance reports whether maintenance mode is on
+func (p *Proxy) InMaintenance() bool {
+	return p.maintenance.Load() != nil
+}
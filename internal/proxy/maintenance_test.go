@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxy_Maintenance(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go p.Run(ctx)
+	<-p.Ready()
+
+	established, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer established.Close()
+	echo(t, established, "before")
+
+	p.SetMaintenance(true, []byte("down for maintenance\r\n"))
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy in maintenance mode: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(got) != "down for maintenance\r\n" {
+		t.Errorf("got %q (err: %v), want the maintenance message", got, err)
+	}
+	// Connections from before maintenance mode keep working
+	echo(t, established, "during")
+	if got := p.Stats().Rejected.Maintenance; got != 1 {
+		t.Errorf("Rejected.Maintenance = %d, want 1", got)
+	}
+
+	p.SetMaintenance(false, nil)
+	conn, err = net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	echo(t, conn, "after")
+}
+
+func TestHandleMaintenanceWithoutMessage(t *testing.T) {
+	var dialed bool
+	p := newTestProxy(t, WithDialer(dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		dialed = true
+		return nil, io.EOF
+	})))
+	p.SetMaintenance(true, nil)
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(context.Background(), proxyConn, &wg)
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(clientConn); err != nil || len(got) > 0 {
+		t.Errorf("got %q (err: %v), want the connection closed silently", got, err)
+	}
+	wg.Wait()
+	if dialed {
+		t.Error("backend dialed in maintenance mode")
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithBackendAddr(backendAddr), WithAdminHTTP("127.0.0.1:0"), WithAdminToken("secret"))
+	p.setReady(&net.TCPAddr{})
+	handler := p.adminHandler()
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve(http.MethodPut, "/maintenance", "back soon\n"); rec.Code != http.StatusOK {
+		t.Fatalf("PUT /maintenance = %d, want 200", rec.Code)
+	}
+	if !p.InMaintenance() || string(p.maintenance.Load().message) != "back soon\n" {
+		t.Error("PUT /maintenance did not switch maintenance mode on with the body as message")
+	}
+	if rec := serve(http.MethodGet, "/maintenance", ""); rec.Body.String() != "on\n" {
+		t.Errorf("GET /maintenance = %q, want on", rec.Body.String())
+	}
+	if rec := serve(http.MethodGet, "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz in maintenance mode = %d, want 503", rec.Code)
+	}
+	if rec := serve(http.MethodPut, "/maintenance", strings.Repeat("x", maxMaintenanceMessage+1)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT /maintenance with an oversized message = %d, want 413", rec.Code)
+	}
+
+	if rec := serve(http.MethodDelete, "/maintenance", ""); rec.Code != http.StatusOK || p.InMaintenance() {
+		t.Errorf("DELETE /maintenance = %d, maintenance still %v", rec.Code, p.InMaintenance())
+	}
+	if rec := serve(http.MethodGet, "/readyz", ""); rec.Code != http.StatusOK {
+		t.Errorf("/readyz after maintenance = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminMaintenanceAuth(t *testing.T) {
+	serve := func(handler http.Handler, method, authorization string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/maintenance", strings.NewReader("down\n"))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a token the admin server is read-only
+	p := newTestProxy(t, WithAdminHTTP("127.0.0.1:0"))
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		if code := serve(p.adminHandler(), method, ""); code != http.StatusMethodNotAllowed {
+			t.Errorf("%s /maintenance without a token configured = %d, want 405", method, code)
+		}
+	}
+	if code := serve(p.adminHandler(), http.MethodGet, ""); code != http.StatusOK {
+		t.Errorf("GET /maintenance = %d, want 200", code)
+	}
+
+	p = newTestProxy(t, WithAdminHTTP("127.0.0.1:0"), WithAdminToken("secret"))
+	for _, authorization := range []string{"", "Bearer wrong", "secret"} {
+		if code := serve(p.adminHandler(), http.MethodPut, authorization); code != http.StatusUnauthorized {
+			t.Errorf("PUT /maintenance with Authorization %q = %d, want 401", authorization, code)
+		}
+	}
+	if p.InMaintenance() {
+		t.Error("unauthorized request switched maintenance mode on")
+	}
+
+	if _, err := CreateProxy(WithAdminToken("secret")); err == nil || !strings.Contains(err.Error(), "admin token requires an admin http address") {
+		t.Errorf("expected admin token without admin address to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	meterName              = tracerName
+	dialDurationMetricName = "proxy.backend.dial.duration"
+	rejectedMetricName     = "proxy.connections.rejected"
+
+	// Values of the dial outcome attribute
+	dialSuccess = "success"
+	dialFailure = "failure"
+)
+
+// metrics holds the instruments the proxy records to
+type metrics struct {
+	dialDuration metric.Float64Histogram
+	rejected     metric.Int64Counter
+}
+
+func newMetrics(mp metric.MeterProvider) (*metrics, error) {
+	meter := mp.Meter(meterName)
+	dialDuration, err := meter.Float64Histogram(dialDurationMetricName,
+		metric.WithDescription("Time taken to connect to the backend, including the backend TLS handshake"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial duration histogram: %w", err)
+	}
+	rejected, err := meter.Int64Counter(rejectedMetricName,
+		metric.WithDescription("Connections accepted and then turned away without being proxied, by reason"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("rejected connections counter: %w", err)
+	}
+	return &metrics{dialDuration: dialDuration, rejected: rejected}, nil
+}
+
+// recordDial records how long a dial to backend took and whether it succeeded
+func (m *metrics) recordDial(ctx context.Context, backend string, d time.Duration, err error) {
+	outcome := dialSuccess
+	if err != nil {
+		outcome = dialFailure
+	}
+	m.dialDuration.Record(ctx, d.Seconds(), metric.WithAttributes(
+		attribute.String("proxy.backend", backend),
+		attribute.String("proxy.dial.outcome", outcome),
+	))
+}
+
+// recordRejected counts a connection turned away for reason
+func (m *metrics) recordRejected(ctx context.Context, reason rejectReason) {
+	m.rejected.Add(ctx, 1, metric.WithAttributes(attribute.String("proxy.reject.reason", reason.String())))
+}
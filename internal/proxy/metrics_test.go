@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// dialDurations collects the dial duration histogram points from reader, keyed by outcome
+func dialDurations(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.HistogramDataPoint[float64] {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Collect() failed: %v", err)
+	}
+	points := make(map[string]metricdata.HistogramDataPoint[float64])
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != dialDurationMetricName {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+				outcome, _ := dp.Attributes.Value("proxy.dial.outcome")
+				points[outcome.AsString()] = dp
+			}
+		}
+	}
+	return points
+}
+
+func TestHandleDialMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	backendAddr := startEchoBackend(t, "")
+
+	dial := func(p *Proxy) {
+		clientConn, proxyConn := net.Pipe()
+		ctx, cancel := context.WithCancel(t.Context())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go p.handle(ctx, proxyConn, &wg)
+		echo(t, clientConn, "ping")
+		clientConn.Close()
+		cancel()
+		wg.Wait()
+	}
+	dial(newTestProxy(t, WithBackendAddr(backendAddr), WithMeterProvider(mp)))
+
+	// Nothing listens on port 1, so the dial fails
+	failing := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithMeterProvider(mp))
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	failing.handle(t.Context(), proxyConn, &wg)
+
+	points := dialDurations(t, reader)
+	success, ok := points[dialSuccess]
+	if !ok || success.Count != 1 {
+		t.Fatalf("expected one successful dial, got %+v", points)
+	}
+	if backend, _ := success.Attributes.Value("proxy.backend"); backend != attribute.StringValue(backendAddr) {
+		t.Errorf("proxy.backend = %v, want %s", backend, backendAddr)
+	}
+	if success.Sum <= 0 {
+		t.Errorf("dial duration sum = %v, want it positive", success.Sum)
+	}
+	failure, ok := points[dialFailure]
+	if !ok || failure.Count != 1 {
+		t.Fatalf("expected one failed dial, got %+v", points)
+	}
+	if backend, _ := failure.Attributes.Value("proxy.backend"); backend.AsString() != "127.0.0.1:1" {
+		t.Errorf("proxy.backend = %v, want 127.0.0.1:1", backend)
+	}
+}
+
+func TestWithMeterProviderNil(t *testing.T) {
+	if _, err := CreateProxy(WithMeterProvider(nil)); err == nil {
+		t.Error("expected error for nil meter provider")
+	}
+}
+
+func TestRejectedMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	p := newTestProxy(t, WithMeterProvider(mp))
+	p.countRejected(t.Context(), rejectIPDenied)
+	p.countRejected(t.Context(), rejectIPDenied)
+	p.countRejected(t.Context(), rejectMaintenance)
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Collect() failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != rejectedMetricName {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				reason, _ := dp.Attributes.Value("proxy.reject.reason")
+				got[reason.AsString()] = dp.Value
+			}
+		}
+	}
+	if got["ip_denied"] != 2 || got["maintenance"] != 1 || len(got) != 2 {
+		t.Errorf("rejected counts by reason = %v, want ip_denied=2 maintenance=1", got)
+	}
+	if want := (Rejections{IPDenied: 2, Maintenance: 1}); p.Stats().Rejected != want {
+		t.Errorf("Stats().Rejected = %+v, want %+v", p.Stats().Rejected, want)
+	}
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"context"
+	"net"
+)
+
+// Handler serves one accepted client connection. The proxy closes the connection
+// once the handler returns.
+type Handler func(ctx context.Context, client net.Conn)
+
+// Middleware wraps a Handler to inspect, transform or reject connections, e.g. for
+// auth, logging or metrics. Returning without calling next rejects the connection.
+// Passing next a wrapped net.Conn hides the underlying connection type, so the
+// proxy can't splice it or complete its TLS handshake up front.
+type Middleware func(next Handler) Handler
+
+// chain wraps h in mws so the first middleware is the outermost
+func chain(h Handler, mws []Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn counts the bytes read from the client
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestConnMiddleware(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	var mu sync.Mutex
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, client net.Conn) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				next(ctx, client)
+			}
+		}
+	}
+	var read atomic.Int64
+	counting := func(next Handler) Handler {
+		return func(ctx context.Context, client net.Conn) {
+			next(ctx, countingConn{Conn: client, read: &read})
+		}
+	}
+	p := newTestProxy(t, WithBackendAddr(backendAddr),
+		WithConnMiddleware(trace("outer")), WithConnMiddleware(trace("inner")), WithConnMiddleware(counting))
+
+	clientConn, proxyConn := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+	echo(t, clientConn, "ping")
+	clientConn.Close()
+	wg.Wait()
+
+	if want := []string{"outer", "inner"}; !slices.Equal(order, want) {
+		t.Errorf("middleware ran in order %v, want %v", order, want)
+	}
+	if got := read.Load(); got != 4 {
+		t.Errorf("wrapped conn read %d bytes, want 4", got)
+	}
+}
+
+func TestConnMiddlewareReject(t *testing.T) {
+	dialer := &recordingDialer{}
+	reject := func(Handler) Handler {
+		return func(context.Context, net.Conn) {}
+	}
+	p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithDialer(dialer), WithConnMiddleware(reject))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	p.handle(t.Context(), proxyConn, &wg)
+
+	// The rejected client is hung up on without a backend being dialed
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want EOF", err)
+	}
+	if len(dialer.addrs) != 0 {
+		t.Errorf("dialed %v for a rejected connection", dialer.addrs)
+	}
+}
+
+func TestWithConnMiddlewareValidation(t *testing.T) {
+	if _, err := CreateProxy(WithConnMiddleware(nil)); err == nil {
+		t.Error("expected error for nil middleware")
+	}
+}
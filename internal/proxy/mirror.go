@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mirrorQueueLen is how many writes may wait for a slow mirror before it is given up on
+	mirrorQueueLen = 64
+	// mirrorFlushTimeout bounds sending what is still queued for the mirror once the connection closes
+	mirrorFlushTimeout = time.Second
+)
+
+var (
+	errMirrorBehind = errors.New("mirror backend is falling behind")
+	errHalfClose    = errors.New("backend connection can't be half-closed")
+)
+
+// mirrorConn is a backend connection whose writes are also copied to a mirror
+// backend over plain TCP. The mirror is dialed and fed by its own goroutine, so it can never slow
+// down or fail the primary; once it fails or falls behind it is dropped.
+type mirrorConn struct {
+	net.Conn
+	addr       string
+	log        *slog.Logger
+	cancelDial context.CancelFunc
+	failed     atomic.Bool
+	mirror     atomic.Pointer[net.Conn]
+	wg         sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan []byte
+}
+
+// startMirror wraps backend so everything written to it also goes to cfg.mirrorAddr
+func startMirror(ctx context.Context, cfg config, backend net.Conn, log *slog.Logger) *mirrorConn {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &mirrorConn{
+		Conn:       backend,
+		addr:       cfg.mirrorAddr,
+		log:        log,
+		cancelDial: cancel,
+		queue:      make(chan []byte, mirrorQueueLen),
+	}
+	m.wg.Add(1)
+	go m.run(ctx, cfg)
+	return m
+}
+
+func (m *mirrorConn) run(ctx context.Context, cfg config) {
+	defer m.wg.Done()
+	// The backend TLS settings, server name included, belong to the primary
+	cfg.backendTLSEnabled = false
+	conn, err := dialBackend(ctx, cfg, "tcp", m.addr)
+	if err != nil {
+		m.fail("mirror dial failed", err)
+		// Keep draining so writes never block until the connection closes
+		for range m.queue {
+		}
+		return
+	}
+	//nolint:errcheck
+	defer conn.Close()
+	m.mirror.Store(&conn)
+	// Close may have missed the connection while it was still being dialed
+	if ctx.Err() != nil {
+		//nolint:errcheck
+		conn.SetWriteDeadline(time.Now().Add(mirrorFlushTimeout))
+	}
+	// The mirror's responses are discarded
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		//nolint:errcheck
+		io.Copy(io.Discard, conn)
+	}()
+	for data := range m.queue {
+		if m.failed.Load() {
+			continue
+		}
+		// A nil write marks where the client half-closed its side
+		if data == nil {
+			closeWrite(conn)
+			continue
+		}
+		if _, err := conn.Write(data); err != nil {
+			m.fail("mirror write failed", err)
+		}
+	}
+}
+
+// fail gives up on the mirror, logging why the first time
+func (m *mirrorConn) fail(msg string, err error) {
+	if m.failed.CompareAndSwap(false, true) {
+		m.log.Warn(msg, "mirror", m.addr, "error", err)
+	}
+}
+
+// Write writes to the primary backend and queues what was written for the mirror
+func (m *mirrorConn) Write(b []byte) (int, error) {
+	n, err := m.Conn.Write(b)
+	if n == 0 || m.failed.Load() {
+		return n, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		select {
+		case m.queue <- bytes.Clone(b[:n]):
+		default:
+			m.fail("mirror dropped", errMirrorBehind)
+		}
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the primary connection, and the mirror once it has
+// been sent everything queued before
+func (m *mirrorConn) CloseWrite() error {
+	if !closeWrite(m.Conn) {
+		return errHalfClose
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed && !m.failed.Load() {
+		select {
+		case m.queue <- nil:
+		default:
+			m.fail("mirror dropped", errMirrorBehind)
+		}
+	}
+	return nil
+}
+
+// Close closes the primary connection and gives the mirror a moment to catch up
+// before closing it too
+func (m *mirrorConn) Close() error {
+	err := m.Conn.Close()
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return err
+	}
+	m.closed = true
+	close(m.queue)
+	m.mu.Unlock()
+
+	m.cancelDial()
+	if conn := m.mirror.Load(); conn != nil {
+		//nolint:errcheck
+		(*conn).SetWriteDeadline(time.Now().Add(mirrorFlushTimeout))
+	}
+	m.wg.Wait()
+	return err
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleMirror(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	mirrorListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create mirror listener: %v", err)
+	}
+	defer mirrorListener.Close()
+	mirrored := make(chan []byte, 1)
+	go func() {
+		conn, err := mirrorListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The mirror answers, but nobody should hear it
+		conn.Write([]byte("ignored"))
+		data, _ := io.ReadAll(conn)
+		mirrored <- data
+	}()
+
+	p := newTestProxy(t, WithBackendAddr(backendAddr), WithMirrorBackend(mirrorListener.Addr().String()))
+	clientConn, proxyConn := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+	echo(t, clientConn, "ping")
+	echo(t, clientConn, "pong")
+	clientConn.Close()
+	wg.Wait()
+
+	select {
+	case data := <-mirrored:
+		if string(data) != "pingpong" {
+			t.Errorf("mirror got %q, want %q", data, "pingpong")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mirror connection wasn't closed")
+	}
+}
+
+// TestHandleMirrorHalfClose tests that a half-close reaches both the primary and the mirror
+func TestHandleMirrorHalfClose(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	mirrorListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create mirror listener: %v", err)
+	}
+	defer mirrorListener.Close()
+	mirrored := make(chan []byte, 1)
+	mirrorDone := make(chan struct{})
+	go func() {
+		defer close(mirrorDone)
+		conn, err := mirrorListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		mirrored <- data
+	}()
+	// The backend only answers once the request is complete and the mirror has
+	// seen it end, so the connection can't close before the mirror is dialed
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := io.ReadAll(conn)
+		select {
+		case <-mirrorDone:
+		case <-time.After(2 * time.Second):
+		}
+		conn.Write(append([]byte("re:"), req...))
+	}()
+
+	client, proxySide := tcpPair(t)
+	p := newTestProxy(t, WithBackendAddr(backendListener.Addr().String()), WithMirrorBackend(mirrorListener.Addr().String()))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxySide, &wg)
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	select {
+	case data := <-mirrored:
+		if string(data) != "request" {
+			t.Errorf("mirror got %q, want %q", data, "request")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mirror didn't see the half-close")
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "re:request" {
+		t.Errorf("got %q (err: %v), want %q", resp, err, "re:request")
+	}
+	wg.Wait()
+}
+
+func TestHandleMirrorUnreachable(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	var logBuf bytes.Buffer
+	// Nothing listens on port 1
+	p := newTestProxy(t, WithBackendAddr(backendAddr), WithMirrorBackend("127.0.0.1:1"),
+		WithLogger(slog.New(slog.NewTextHandler(&logBuf, nil))))
+	clientConn, proxyConn := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+	// The primary is unaffected
+	echo(t, clientConn, "ping")
+	echo(t, clientConn, "pong")
+	clientConn.Close()
+	wg.Wait()
+	if !strings.Contains(logBuf.String(), "mirror dial failed") {
+		t.Errorf("expected the mirror failure to be logged, got %q", logBuf.String())
+	}
+}
+
+func TestMirrorFallsBehind(t *testing.T) {
+	primary, primaryServer := net.Pipe()
+	defer primaryServer.Close()
+	go io.Copy(io.Discard, primaryServer)
+	var logBuf bytes.Buffer
+	// Nothing drains the queue, as with a mirror that stopped reading
+	m := &mirrorConn{Conn: primary, log: slog.New(slog.NewTextHandler(&logBuf, nil)), queue: make(chan []byte, 1)}
+
+	for range 3 {
+		if _, err := m.Write([]byte("data")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if !m.failed.Load() {
+		t.Error("expected the mirror to be dropped once its queue was full")
+	}
+	if got := strings.Count(logBuf.String(), "mirror dropped"); got != 1 {
+		t.Errorf("logged the dropped mirror %d times, want once", got)
+	}
+	primary.Close()
+}
+
+func TestWithMirrorBackendValidation(t *testing.T) {
+	if _, err := CreateProxy(WithMirrorBackend("not an address")); err == nil {
+		t.Error("expected error for invalid mirror address")
+	}
+	if _, err := CreateProxy(WithMirrorBackend("127.0.0.1:9001"), WithUDP(true)); err == nil {
+		t.Error("expected error for mirror backend in udp mode")
+	}
+}
@@ -4,76 +4,523 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
 )
 
 type Proxy struct {
 	config          config
-	bufPool         sync.Pool
-	listenerFactory ListenerFactory
+	requestBufs     *bufferPool // client to backend
+	replyBufs       *bufferPool // backend to client
+	listenerFactory listenFunc
+	logger          *slog.Logger
+	tracer          trace.Tracer
+	metrics         *metrics
+	accessLog       *accessLogger
+	breaker         *circuitBreaker
+	backendConns    backendConns
+	backendPool     *backendPool
+	routes          []*route
+	handler         Handler
+	counters        counters
+	connSlots       chan struct{}
+	ipConnsMu       sync.Mutex
+	ipConns         map[string]int
+	rateLimiter     atomic.Pointer[rateLimiter]
+	acceptLimiter   *rateLimiter
+	nextConnID      atomic.Uint64
+	maintenance     atomic.Pointer[maintenance]
+	// goroutines tracks everything Run starts, down to each connection's relays
+	goroutines sync.WaitGroup
+
+	// configMu guards the fields Reload may change; read them through loadConfig
+	configMu sync.RWMutex
+
+	// ready is closed once Run has bound the listen address, which is then available from Addr
+	ready     chan struct{}
+	readyOnce sync.Once
+	// done is closed once Run or ListenAndServe has returned and every goroutine it started has exited
+	done      chan struct{}
+	doneOnce  sync.Once
+	addrMu    sync.Mutex
+	addr      net.Addr
+	adminAddr net.Addr
+	startedAt time.Time
+	listeners []net.Listener
 }
 
 func CreateProxy(options ...Option) (*Proxy, error) {
-	cfg := config{
-		listenAddr:  listenAddrDefault,
-		backendAddr: backendAddrDefault,
-		bufferSize:  bufferSizeDefault,
-		tlsEnabled:  tlsEnabledDefault,
-	}
-
+	cfg := defaultConfig()
 	for _, opt := range options {
 		if err := opt(&cfg); err != nil {
 			return nil, fmt.Errorf("apply option: %w", err)
 		}
 	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 
-	factory := tcpListenerFactory
+	cfg.logWarnings(cfg.logger)
+
+	factory := baseListenerFactory(cfg)
 	if cfg.tlsEnabled {
 		factory = tlsListenerFactory
+		cfg.certStore = &certStore{}
+	}
+	if cfg.listenerFactory != nil {
+		factory = customListenerFactory(cfg.listenerFactory)
+	}
+	if cfg.dnsCacheTTL > 0 {
+		cfg.dnsCache = newDNSCache(cfg.dnsCacheTTL)
 	}
 
-	return &Proxy{
+	p := &Proxy{
 		config:          cfg,
-		bufPool:         sync.Pool{New: func() any { return make([]byte, 1024*cfg.bufferSize) }},
 		listenerFactory: factory,
-	}, nil
+		logger:          cfg.logger,
+		tracer:          cfg.tracerProvider.Tracer(tracerName),
+		ready:           make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	p.handler = chain(p.serveConn, cfg.middleware)
+	p.requestBufs = newBufferPool(p.requestBufferBytes, cfg.bufferPoolMax)
+	p.replyBufs = newBufferPool(p.replyBufferBytes, cfg.bufferPoolMax)
+	p.routes = newRoutes(cfg.routes, cfg.bufferPoolMax)
+	m, err := newMetrics(cfg.meterProvider)
+	if err != nil {
+		return nil, fmt.Errorf("create metrics: %w", err)
+	}
+	p.metrics = m
+	if cfg.accessLog != nil {
+		p.accessLog = &accessLogger{w: cfg.accessLog, format: cfg.accessLogFormat}
+	}
+	if cfg.backendPoolSize > 0 {
+		p.backendPool = newBackendPool(cfg.backendPoolSize, cfg.backendPoolMaxIdle, func(ctx context.Context, addr string) (net.Conn, error) {
+			cfg := p.loadConfig()
+			return dialBackend(ctx, cfg, backendNetwork(cfg), addr)
+		})
+	}
+	if cfg.breakerFailures > 0 {
+		p.breaker = newCircuitBreaker(cfg.breakerFailures, cfg.breakerWindow, cfg.breakerCooldown)
+	}
+	if cfg.acceptRate > 0 {
+		p.acceptLimiter = newRateLimiter(int64(cfg.acceptRate), int64(cfg.acceptBurst))
+	}
+	if cfg.maxConnections > 0 {
+		p.connSlots = make(chan struct{}, cfg.maxConnections)
+	}
+	if cfg.maxConnectionsPerIP > 0 {
+		p.ipConns = make(map[string]int)
+	}
+	p.setRateLimit(cfg.rateLimit)
+	return p, nil
+}
+
+// Run serves until ctx is cancelled or accepting fails. Connections still open
+// when it returns drain in the background; Wait or Done tell when they have.
+func (p *Proxy) Run(ctx context.Context) error {
+	err := p.serve(ctx, &p.goroutines)
+	go func() {
+		p.goroutines.Wait()
+		p.setDone()
+	}()
+	return err
 }
 
-func (p *Proxy) Run(ctx context.Context, wg *sync.WaitGroup) error {
-	defer wg.Done()
-	listener, listenerErr := p.listenerFactory(p.config)
-	if listenerErr != nil {
-		return fmt.Errorf("create listener: %w", listenerErr)
+// ListenAndServe serves until ctx is cancelled, then waits for all connections to
+// finish before returning. It is Run followed by Wait.
+func (p *Proxy) ListenAndServe(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err := p.serve(ctx, &p.goroutines)
+	// serve can return on an error before ctx is done; shut down what it started either way
+	cancel()
+	p.goroutines.Wait()
+	p.setDone()
+	return err
+}
+
+func (p *Proxy) serve(ctx context.Context, wg *sync.WaitGroup) error {
+	// The admin server lives exactly as long as serve does
+	if p.config.adminAddr != "" {
+		adminCtx, stopAdmin := context.WithCancel(ctx)
+		defer stopAdmin()
+		if err := p.startAdmin(adminCtx, wg); err != nil {
+			return fmt.Errorf("start admin http: %w", err)
+		}
+	}
+	if p.config.udp {
+		return p.runUDP(ctx, wg)
+	}
+	listeners, err := p.listen()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrListen, err)
+	}
+	p.addrMu.Lock()
+	p.listeners = listeners
+	p.addrMu.Unlock()
+	p.setReady(listeners[0].Addr())
+	acceptors := max(1, p.loadConfig().acceptors)
+	for i := 0; i < len(listeners); i += acceptors {
+		p.logger.Info("listening", "addr", listeners[i].Addr(), "acceptors", acceptors)
 	}
-	fmt.Printf("Listening on :%v\n", p.config.listenAddr)
 
-	// Setup goroutine to close listener when context is cancelled
+	// The accept loops stop as soon as ctx is done and the listeners are closed
+	// on the way out. Active connections then get to drain before being torn down.
+	defer func() {
+		for _, listener := range listeners {
+			//nolint:errcheck
+			listener.Close()
+		}
+	}()
+	connCtx, cancelConns := p.connContext(ctx)
 	wg.Add(1)
-	go func() {
+	context.AfterFunc(ctx, func() {
 		defer wg.Done()
-		<-ctx.Done()
-		//nolint:errcheck
-		listener.Close()
-	}()
+		defer cancelConns()
+		p.drain()
+	})
+
+	if p.backendPool != nil {
+		p.backendPool.warm(p.loadConfig().backendAddr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.backendPool.maintain(ctx, func(addr string, err error) {
+				p.logger.Warn("backend pool dial failed", "backend", addr, "error", err)
+			})
+		}()
+	}
+
+	var pool *handlerPool
+	if size := p.config.handlerPoolSize; size > 0 {
+		pool = p.startHandlerPool(size, wg)
+		defer pool.close()
+	}
 
-	// Accept and handle incoming connections until context is cancelled
+	if len(listeners) == 1 {
+		return p.acceptLoop(ctx, connCtx, listeners[0], pool, wg)
+	}
+	// Every listener gets its own accept loop; acceptors on one address share the port via SO_REUSEPORT
+	errs := make([]error, len(listeners))
+	var loops sync.WaitGroup
+	for i, listener := range listeners {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			errs[i] = p.acceptLoop(ctx, connCtx, listener, pool, wg)
+		}()
+	}
+	loops.Wait()
+	return errors.Join(errs...)
+}
+
+// listen creates one listener per configured acceptor on every listen address.
+// If any address fails to bind, the listeners already created are closed.
+func (p *Proxy) listen() ([]net.Listener, error) {
+	cfg := p.loadConfig()
+	addrs := cfg.listenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{cfg.listenAddr}
+	}
+	acceptors := max(1, cfg.acceptors)
+	listeners := make([]net.Listener, 0, len(addrs)*acceptors)
+	for _, addr := range addrs {
+		addrCfg := cfg
+		addrCfg.listenAddr = addr
+		for i := range acceptors {
+			listener, err := p.listenerFactory(addrCfg)
+			if err != nil {
+				for _, l := range listeners {
+					//nolint:errcheck
+					l.Close()
+				}
+				return nil, fmt.Errorf("listen on %s: %w", addr, err)
+			}
+			// Bind the rest to the port the first one got, in case it was ephemeral
+			if i == 0 {
+				addrCfg.listenAddr = listener.Addr().String()
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners, nil
+}
+
+// acceptLoop accepts incoming connections until ctx is done or the listener is closed and handles them
+// under connCtx, on pool's workers if there is a pool and on a goroutine per connection otherwise
+func (p *Proxy) acceptLoop(ctx, connCtx context.Context, listener net.Listener, pool *handlerPool, wg *sync.WaitGroup) error {
+	stop := context.AfterFunc(ctx, func() { interruptAccept(listener) })
+	defer stop()
+	var backoff time.Duration
 	for {
+		// Over the accept rate, connections wait in the backlog rather than being refused
+		if p.acceptLimiter != nil {
+			if err := p.acceptLimiter.waitN(ctx, 1); err != nil {
+				return nil
+			}
+		}
 		conn, err := listener.Accept()
 		if err != nil {
-			// Listener was closed gracefully (expected during shutdown)
-			if errors.Is(err, net.ErrClosed) {
+			// Shutting down, or the listener was closed from outside
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
 				return nil
 			}
-			// Log other accept errors and continue
-			log.Printf("accept error: %v", err)
+			if !isTemporaryAcceptError(err) {
+				return fmt.Errorf("%w: %w", ErrAccept, err)
+			}
+			// Back off on temporary errors (e.g. out of file descriptors) instead of spinning
+			backoff = nextAcceptBackoff(backoff)
+			p.logger.Warn("temporary accept error", "error", err, "retry_in", backoff)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+		// IDs tie together every log line about one connection
+		id := p.nextConnID.Add(1)
+		log := p.logger.With("conn_id", id)
+		p.counters.acceptedConnections.Add(1)
+		// A PROXY protocol header carries the address the client checks need. It is
+		// read on the connection's own goroutine, so a client that never sends one
+		// can't hold up the accept loop; handle admits the client once it has.
+		header := proxyHeaderConn(conn)
+		if header == nil && !p.admitClient(ctx, conn, log) {
+			continue
+		}
+		if !p.acquireConnSlot(ctx) {
+			if header == nil {
+				p.releaseIPSlot(clientIP(conn.RemoteAddr()))
+			}
+			log.Warn("connection limit reached", "remote_addr", acceptedAddr(conn, header))
+			p.countRejected(ctx, rejectMaxConnections)
+			//nolint:errcheck
+			conn.Close()
 			continue
 		}
-		log.Printf("Accepting connection from %v", conn.RemoteAddr())
 
+		if pool != nil {
+			if !pool.submit(ctx, withConnID(connCtx, id), conn) {
+				p.releaseConnSlot()
+				if header == nil {
+					p.releaseIPSlot(clientIP(conn.RemoteAddr()))
+				}
+				//nolint:errcheck
+				conn.Close()
+			}
+			continue
+		}
 		// Handle each connection in a separate goroutine
 		wg.Add(1)
-		go handle(ctx, conn, p.config.backendAddr, wg, &p.bufPool)
+		go p.handle(withConnID(connCtx, id), conn, wg)
+	}
+}
+
+// admitClient runs the checks that depend on the client's address and takes its
+// per-IP slot, which handle releases. A client that fails them is closed.
+func (p *Proxy) admitClient(ctx context.Context, conn net.Conn, log *slog.Logger) bool {
+	if err := p.checkClientAllowed(conn.RemoteAddr()); err != nil {
+		log.Warn("client rejected", "remote_addr", conn.RemoteAddr(), "reason", err)
+		p.countRejected(ctx, rejectIPDenied)
+		//nolint:errcheck
+		conn.Close()
+		return false
+	}
+	log.Info("accepting connection", "remote_addr", conn.RemoteAddr())
+	if onAccept := p.config.hooks.OnAccept; onAccept != nil {
+		onAccept(conn)
+	}
+	if !p.acquireIPSlot(clientIP(conn.RemoteAddr())) {
+		log.Warn("per-ip connection limit reached", "remote_addr", conn.RemoteAddr())
+		p.countRejected(ctx, rejectMaxConnectionsPerIP)
+		//nolint:errcheck
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// acceptedAddr is conn's remote address without waiting for a PROXY protocol header
+func acceptedAddr(conn net.Conn, header *proxyProtoConn) net.Addr {
+	if header != nil {
+		return header.Conn.RemoteAddr()
+	}
+	return conn.RemoteAddr()
+}
+
+// interruptAccept wakes up a blocked Accept. Listeners that support deadlines get
+// one in the past, which leaves them open for serve to close; anything else is closed.
+func interruptAccept(listener net.Listener) {
+	if l, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+		if l.SetDeadline(time.Now()) == nil {
+			return
+		}
+	}
+	//nolint:errcheck
+	listener.Close()
+}
+
+// Addr returns the address the proxy is listening on, or nil if Run hasn't bound it yet.
+// Unlike the configured listen address it carries the actual port when port 0 was requested.
+func (p *Proxy) Addr() net.Addr {
+	p.addrMu.Lock()
+	defer p.addrMu.Unlock()
+	return p.addr
+}
+
+// ListenerFile returns a duplicate of the listening socket's file descriptor, for
+// handing to a new process that adopts it with WithInheritedListener. The caller
+// owns the file and should close it once the new process has started. A Unix
+// socket file is no longer removed when this proxy stops, since the new process
+// keeps using it. It fails before Run is listening and when there is more than
+// one listener.
+func (p *Proxy) ListenerFile() (*os.File, error) {
+	p.addrMu.Lock()
+	listeners := p.listeners
+	p.addrMu.Unlock()
+	switch {
+	case len(listeners) == 0:
+		return nil, errors.New("proxy is not listening")
+	case len(listeners) > 1:
+		return nil, fmt.Errorf("proxy has %d listeners, listener file needs exactly one", len(listeners))
+	}
+	return listenerFile(listeners[0])
+}
+
+// StartedAt returns when Run started listening, or the zero time if it hasn't yet
+func (p *Proxy) StartedAt() time.Time {
+	p.addrMu.Lock()
+	defer p.addrMu.Unlock()
+	return p.startedAt
+}
+
+// Uptime returns how long the proxy has been listening, or 0 if Run hasn't started listening yet
+func (p *Proxy) Uptime() time.Duration {
+	return uptime(p.StartedAt())
+}
+
+func uptime(startedAt time.Time) time.Duration {
+	if startedAt.IsZero() {
+		return 0
+	}
+	return time.Since(startedAt)
+}
+
+// Ready returns a channel that is closed once Run is listening and Addr is available.
+// It is never closed if Run fails to bind the listen address.
+func (p *Proxy) Ready() <-chan struct{} {
+	return p.ready
+}
+
+// WaitReady blocks until Run is listening, returning an error if ctx is done or
+// the proxy stops first, e.g. because the listen address could not be bound
+func (p *Proxy) WaitReady(ctx context.Context) error {
+	select {
+	case <-p.ready:
+		return nil
+	case <-p.done:
+		return errStoppedBeforeReady
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed once Run or ListenAndServe has returned and
+// all of the proxy's connections and background goroutines have finished.
+func (p *Proxy) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until Done is closed. It never returns if the proxy was not started.
+func (p *Proxy) Wait() {
+	<-p.done
+}
+
+// Config returns a read-only view of the effective config
+func (p *Proxy) Config() Config {
+	return p.loadConfig().view()
+}
+
+// ListenAddr returns the configured listen address; Addr returns the one actually bound
+func (p *Proxy) ListenAddr() string {
+	return p.Config().ListenAddr
+}
+
+// BackendAddr returns the address new connections are forwarded to
+func (p *Proxy) BackendAddr() string {
+	return p.Config().BackendAddr
+}
+
+// BufferSize returns the relay buffer size in bytes
+func (p *Proxy) BufferSize() int {
+	return p.Config().BufferSize
+}
+
+// ConfigString describes the effective config with sensitive values redacted, for logging at startup
+func (p *Proxy) ConfigString() string {
+	return p.loadConfig().String()
+}
+
+func (p *Proxy) setReady(addr net.Addr) {
+	p.addrMu.Lock()
+	p.addr = addr
+	if p.startedAt.IsZero() {
+		p.startedAt = time.Now()
+	}
+	p.addrMu.Unlock()
+	p.readyOnce.Do(func() { close(p.ready) })
+}
+
+func (p *Proxy) setDone() {
+	p.doneOnce.Do(func() { close(p.done) })
+}
+
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return acceptBackoffMin
+	}
+	return min(2*backoff, acceptBackoffMax)
+}
+
+// isTemporaryAcceptError reports whether the accept loop can recover from err by retrying later
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ReloadCert re-reads the certificate and key files and swaps them in for new TLS handshakes.
+// Connections that are already established keep using the previous certificate. If
+// the files don't hold a valid key pair the previous certificate keeps serving and
+// the error is returned. A certificate set with WithCertKeyPEM is replaced through Reload instead.
+func (p *Proxy) ReloadCert() error {
+	if !p.config.tlsEnabled || p.config.certStore == nil {
+		return errors.New("tls is not enabled")
+	}
+	if p.loadConfig().certificate != nil {
+		return errors.New("certificate was set from PEM; use Reload with WithCertKeyPEM to replace it")
+	}
+	if err := p.config.certStore.load(p.config.certFilePath, p.config.keyFilePath); err != nil {
+		p.logger.Error("certificate reload failed, keeping the current certificate", "error", err)
+		return fmt.Errorf("reload cert: %w", err)
 	}
+	return nil
 }
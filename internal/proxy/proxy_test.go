@@ -1,12 +1,18 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -76,31 +82,21 @@ func TestProxy_Run_ListenError_PortInUse(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	err = proxy.Run(ctx, &wg)
+	err = proxy.Run(ctx)
 	if err == nil {
 		t.Error("Run() should return listen error for address already in use")
 	}
 
 	// Verify the error is a listen error
-	if err != nil && !contains(err.Error(), "listen error") {
+	if err != nil && (!errors.Is(err, ErrListen) || !errors.Is(err, ErrBind)) {
 		t.Errorf("Expected listen error, got: %v", err)
 	}
 
-	// Wait for goroutine to complete
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
+	// A failed Run still reports the proxy as stopped
 	select {
-	case <-done:
-		// Good, WaitGroup completed
+	case <-proxy.Done():
 	case <-time.After(1 * time.Second):
-		t.Error("WaitGroup did not complete in time")
+		t.Error("Done() not closed in time")
 	}
 }
 
@@ -113,16 +109,14 @@ func TestProxy_Run_GracefulShutdown(t *testing.T) {
 
 	// Start the proxy in a goroutine
 	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	var runErr error
+	runErr := make(chan error, 1)
 
-	wg.Add(1)
 	go func() {
-		runErr = proxy.Run(ctx, &wg)
+		runErr <- proxy.Run(ctx)
 	}()
 
-	// Give the proxy time to start listening
-	time.Sleep(10 * time.Millisecond)
+	// Wait for the proxy to start listening
+	<-proxy.Ready()
 
 	// Cancel the context to trigger shutdown
 	cancel()
@@ -130,15 +124,15 @@ func TestProxy_Run_GracefulShutdown(t *testing.T) {
 	// Wait for completion with timeout
 	done := make(chan struct{})
 	go func() {
-		wg.Wait()
+		proxy.Wait()
 		close(done)
 	}()
 
 	select {
 	case <-done:
 		// Verify that Run() returned without error (graceful shutdown)
-		if runErr != nil {
-			t.Errorf("Run() should return nil on graceful shutdown, got: %v", runErr)
+		if err := <-runErr; err != nil {
+			t.Errorf("Run() should return nil on graceful shutdown, got: %v", err)
 		}
 	case <-time.After(1 * time.Second):
 		t.Error("Run() did not complete gracefully within timeout")
@@ -153,12 +147,59 @@ func TestProxy_Run_BufferPoolInitialization(t *testing.T) {
 	}
 
 	// Test that buffer pool is properly initialized
-	buf := proxy.bufPool.Get().([]byte)
+	buf := proxy.requestBufs.pool.Get().(*[]byte)
 	expectedSize := 1024 * bufferSize
-	if len(buf) != expectedSize {
-		t.Errorf("Buffer pool buffer size = %d, expected %d", len(buf), expectedSize)
+	if len(*buf) != expectedSize {
+		t.Errorf("Buffer pool buffer size = %d, expected %d", len(*buf), expectedSize)
+	}
+	proxy.requestBufs.pool.Put(buf)
+}
+
+func TestProxy_BufferPoolReuse(t *testing.T) {
+	proxy, err := CreateProxy()
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+
+	// sync.Pool may drop items at any time (the race detector does so on purpose),
+	// so allow a few attempts before concluding buffers are never reused
+	for range 10 {
+		buf := proxy.requestBufs.pool.Get().(*[]byte)
+		proxy.requestBufs.pool.Put(buf)
+		if proxy.requestBufs.pool.Get().(*[]byte) == buf {
+			return
+		}
+	}
+	t.Error("buffer returned to the pool was never reused")
+}
+
+func TestProxy_BufferPoolMax(t *testing.T) {
+	proxy, err := CreateProxy(WithBufferSize(1), WithBufferPoolMax(2))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+
+	bufs := []*[]byte{proxy.requestBufs.get(), proxy.requestBufs.get(), proxy.requestBufs.get()}
+	for _, buf := range bufs {
+		if len(*buf) != 1024 {
+			t.Fatalf("buffer size = %d, want 1024", len(*buf))
+		}
+		proxy.requestBufs.put(buf)
+	}
+	// Only two of the three buffers are kept
+	if got := proxy.Stats().PooledBuffers; got != 2 {
+		t.Errorf("PooledBuffers = %d, want 2", got)
+	}
+	if buf := proxy.requestBufs.get(); buf != bufs[0] {
+		t.Error("expected a retained buffer to be reused")
+	}
+	if got := proxy.Stats().PooledBuffers; got != 1 {
+		t.Errorf("PooledBuffers = %d after Get, want 1", got)
+	}
+
+	if _, err := CreateProxy(WithBufferPoolMax(-1)); err == nil {
+		t.Error("expected error for negative buffer pool max")
 	}
-	proxy.bufPool.Put(&buf)
 }
 
 // TestProxy_Run tests the basic functionality of the proxy
@@ -197,26 +238,24 @@ func TestProxy_Run(t *testing.T) {
 	}()
 
 	// Create and start proxy
-	proxy, proxyErr := CreateProxy()
+	proxy, proxyErr := CreateProxy(WithListenAddr("127.0.0.1:0"))
 	if proxyErr != nil {
 		t.Fatalf("CreateProxy() failed: %v", proxyErr)
 	}
-	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(t.Context())
 	defer cancel()
 
-	wg.Add(1)
 	go func() {
-		if err := proxy.Run(ctx, &wg); err != nil {
+		if err := proxy.Run(ctx); err != nil {
 			t.Errorf("Proxy run error: %v", err)
 		}
 	}()
 
 	// Wait for proxy to start
-	time.Sleep(100 * time.Millisecond)
+	<-proxy.Ready()
 
 	// Connect to proxy
-	conn, err := net.Dial("tcp", proxy.config.listenAddr)
+	conn, err := net.Dial("tcp", proxy.Addr().String())
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -255,26 +294,24 @@ func TestProxy_Run(t *testing.T) {
 
 // TestProxy_ConnectionRefused tests proxy behavior when backend is unavailable
 func TestProxy_ConnectionRefused(t *testing.T) {
-	proxy, proxyErr := CreateProxy(WithBackendAddr("127.0.0.1:44444"))
+	proxy, proxyErr := CreateProxy(WithListenAddr("127.0.0.1:0"), WithBackendAddr("127.0.0.1:44444"))
 	if proxyErr != nil {
 		t.Fatalf("CreateProxy() failed: %v", proxyErr)
 	}
-	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(t.Context())
 	defer cancel()
 
-	wg.Add(1)
 	go func() {
-		if err := proxy.Run(ctx, &wg); err != nil {
+		if err := proxy.Run(ctx); err != nil {
 			t.Errorf("Proxy run error: %v", err)
 		}
 	}()
 
 	// Wait for proxy to start
-	time.Sleep(100 * time.Millisecond)
+	<-proxy.Ready()
 
 	// Try to connect and send data
-	conn, err := net.Dial("tcp", proxy.config.listenAddr)
+	conn, err := net.Dial("tcp", proxy.Addr().String())
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -297,6 +334,33 @@ func TestProxy_ConnectionRefused(t *testing.T) {
 func TestProxy_AcceptError(t *testing.T) {
 	fmt.Println("TestProxy_AcceptError")
 	mockListener := newMockListener(true)
+	proxy, err := CreateProxy(WithListenerFactory(func(string, string) (net.Listener, error) {
+		return mockListener, nil
+	}))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- proxy.Run(ctx) }()
+	// A non-temporary accept error stops the proxy without ctx being cancelled
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrAccept) || !contains(err.Error(), "mock accept error") {
+			t.Errorf("Expected accept error, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after the accept error")
+	}
+	cancel()
+	proxy.Wait()
+}
+
+func TestProxy_TemporaryAcceptError(t *testing.T) {
+	mockListener := newMockListener(true)
+	mockListener.err = fmt.Errorf("accept: %w", syscall.EMFILE)
 	proxy, err := CreateProxy()
 	if err != nil {
 		t.Fatalf("CreateProxy() failed: %v", err)
@@ -305,26 +369,213 @@ func TestProxy_AcceptError(t *testing.T) {
 		return mockListener, nil
 	}
 
-	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(t.Context())
 	defer cancel()
-	wg.Add(1)
 	go func() {
-		if err := proxy.Run(ctx, &wg); err != nil {
-			if err.Error() != "mock accept error" {
-				t.Errorf("Expected accept error, got: %v", err)
-			}
+		// A temporary accept error is retried and Run keeps serving until shutdown
+		if err := proxy.Run(ctx); err != nil {
+			t.Errorf("Expected graceful shutdown, got: %v", err)
 		}
 	}()
-	time.Sleep(100 * time.Millisecond)
+	if err := proxy.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady() failed: %v", err)
+	}
+	// The accept loop goes back to Accept after backing off
+	waitFor(t, func() bool { return mockListener.accepts.Load() >= 2 })
+	if got := mockListener.accepts.Load(); got < 2 {
+		t.Errorf("Accept called %d times, want a retry after the temporary error", got)
+	}
 	cancel()
-	wg.Wait()
+	proxy.Wait()
+}
+
+func TestProxy_WaitReady(t *testing.T) {
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"))
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.WaitReady(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitReady() before Run = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	runCtx, stop := context.WithCancel(t.Context())
+	defer stop()
+	go p.Run(runCtx)
+	if err := p.WaitReady(t.Context()); err != nil {
+		t.Fatalf("WaitReady() failed: %v", err)
+	}
+	if p.Addr() == nil {
+		t.Error("Addr() is nil once ready")
+	}
+	stop()
+	p.Wait()
+
+	// A proxy that can't bind never becomes ready
+	busy := newTestProxy(t, WithListenAddr(p.Addr().String()))
+	occupied, err := net.Listen("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to bind %s: %v", p.Addr(), err)
+	}
+	defer occupied.Close()
+	go busy.Run(t.Context())
+	if err := busy.WaitReady(t.Context()); !errors.Is(err, errStoppedBeforeReady) {
+		t.Errorf("WaitReady() after a failed bind = %v, want %v", err, errStoppedBeforeReady)
+	}
+}
+
+func TestNextAcceptBackoff(t *testing.T) {
+	backoff := nextAcceptBackoff(0)
+	if backoff != acceptBackoffMin {
+		t.Errorf("first backoff = %v, expected %v", backoff, acceptBackoffMin)
+	}
+	for i := 0; i < 20; i++ {
+		backoff = nextAcceptBackoff(backoff)
+	}
+	if backoff != acceptBackoffMax {
+		t.Errorf("backoff = %v, expected it to be capped at %v", backoff, acceptBackoffMax)
+	}
+}
+
+// TestAcceptLoopContextCancel tests that cancelling the context stops the accept loop
+// without closing a listener that supports deadlines, and closes one that doesn't
+func TestAcceptLoopContextCancel(t *testing.T) {
+	p := newTestProxy(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer listener.Close()
+	mock := newMockListener(false)
+
+	for _, l := range []net.Listener{listener, mock} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		done := make(chan error, 1)
+		go func() { done <- p.acceptLoop(ctx, ctx, l, nil, &wg) }()
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("acceptLoop() returned %v, want nil", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("acceptLoop() did not return after the context was cancelled")
+		}
+	}
+
+	// The deadline interrupted Accept, so the TCP listener is still usable
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	conn.Close()
+	select {
+	case <-mock.close:
+	default:
+		t.Error("expected the listener without deadlines to be closed")
+	}
+}
+
+func TestProxy_ReloadCert(t *testing.T) {
+	t.Run("tls disabled", func(t *testing.T) {
+		proxy, err := CreateProxy()
+		if err != nil {
+			t.Fatalf("CreateProxy() failed: %v", err)
+		}
+		if err := proxy.ReloadCert(); err == nil {
+			t.Error("ReloadCert() should fail when TLS is disabled")
+		}
+	})
+
+	t.Run("tls enabled", func(t *testing.T) {
+		certPath, keyPath := generateTempCert(t, t.TempDir())
+		proxy, err := CreateProxy(WithTlSEnabled(true), WithCertFilePath(certPath), WithKeyFilePath(keyPath))
+		if err != nil {
+			t.Fatalf("CreateProxy() failed: %v", err)
+		}
+		if err := proxy.ReloadCert(); err != nil {
+			t.Errorf("ReloadCert() failed: %v", err)
+		}
+		if proxy.config.certStore.cert.Load() == nil {
+			t.Error("expected certificate to be loaded after ReloadCert()")
+		}
+	})
+}
+
+func TestProxy_CertKeyPEM(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := readTempCert(t, dir)
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithTlSEnabled(true), WithCertKeyPEM(certPEM, keyPEM))
+
+	defer p.Wait()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-p.Ready()
+
+	// No files are involved, so the certificate served is the one passed in
+	peerCert := func() []byte {
+		conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("TLS dial failed: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	first := peerCert()
+	if want := p.config.certificate.Certificate[0]; !bytes.Equal(first, want) {
+		t.Error("proxy served a different certificate than the one passed in")
+	}
+	if err := p.ReloadCert(); err == nil {
+		t.Error("ReloadCert() should fail for a certificate set from PEM")
+	}
+	// An invalid PEM is rejected and the listener keeps serving the current certificate
+	if err := p.Reload(WithCertKeyPEM([]byte("not a certificate"), keyPEM)); !errors.Is(err, ErrLoadCert) {
+		t.Errorf("expected %v for an invalid PEM, got %v", ErrLoadCert, err)
+	}
+	if !bytes.Equal(peerCert(), first) {
+		t.Error("expected the previous certificate to be served after a failed reload")
+	}
+
+	// Reload swaps in a new certificate for new handshakes
+	certPEM, keyPEM = readTempCert(t, t.TempDir())
+	if err := p.Reload(WithCertKeyPEM(certPEM, keyPEM)); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if bytes.Equal(peerCert(), first) {
+		t.Error("expected the reloaded certificate to be served")
+	}
+
+	if _, err := CreateProxy(WithCertKeyPEM([]byte("not a cert"), keyPEM)); !errors.Is(err, ErrLoadCert) {
+		t.Errorf("expected ErrLoadCert for invalid PEM, got %v", err)
+	}
+}
+
+// readTempCert generates a self-signed certificate in dir and returns its PEM bytes
+func readTempCert(t *testing.T, dir string) ([]byte, []byte) {
+	t.Helper()
+	certPath, keyPath := generateTempCert(t, dir)
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatalf("Failed to read cert: %v", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	return certPEM, keyPEM
 }
 
 type mockListener struct {
-	conns   chan net.Conn
-	close   chan struct{}
-	isError bool
+	conns     chan net.Conn
+	close     chan struct{}
+	closeOnce sync.Once
+	isError   bool
+	err       error
+	accepts   atomic.Int64
 }
 
 func newMockListener(isError bool) *mockListener {
@@ -332,13 +583,15 @@ func newMockListener(isError bool) *mockListener {
 		conns:   make(chan net.Conn, 1),
 		close:   make(chan struct{}),
 		isError: isError,
+		err:     errors.New("mock accept error"),
 	}
 }
 
 func (m *mockListener) Accept() (net.Conn, error) {
+	m.accepts.Add(1)
 	if m.isError {
 		m.isError = false
-		return nil, errors.New("mock accept error")
+		return nil, m.err
 	}
 	select {
 	case c := <-m.conns:
@@ -348,8 +601,9 @@ func (m *mockListener) Accept() (net.Conn, error) {
 	}
 }
 
+// Close may be called more than once, like on a real listener
 func (m *mockListener) Close() error {
-	close(m.close)
+	m.closeOnce.Do(func() { close(m.close) })
 	return nil
 }
 
@@ -369,3 +623,346 @@ func contains(s, substr string) bool {
 			return false
 		}()))
 }
+
+func TestProxy_Acceptors(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		for {
+			conn, err := backendListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	proxy, err := CreateProxy(WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendListener.Addr().String()), WithAcceptors(4))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+
+	defer proxy.Wait()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := proxy.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-proxy.Ready()
+	listenAddr := proxy.Addr().String()
+
+	// The kernel spreads connections over the listeners; every one must be served
+	for i := range 20 {
+		conn, err := net.Dial("tcp", listenAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		msg := fmt.Sprintf("ping %d", i)
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Errorf("got %q (err: %v), want %q", buf, err, msg)
+		}
+		conn.Close()
+	}
+
+	if got := proxy.Stats().AcceptedConnections; got != 20 {
+		t.Errorf("AcceptedConnections = %d, want 20", got)
+	}
+}
+
+func TestProxy_Addr(t *testing.T) {
+	proxy, err := CreateProxy(WithListenAddr("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	if proxy.Addr() != nil {
+		t.Errorf("Addr() = %v before Run, want nil", proxy.Addr())
+	}
+
+	defer proxy.Wait()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := proxy.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+
+	select {
+	case <-proxy.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("proxy did not become ready")
+	}
+	addr, ok := proxy.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Addr() = %v, want the bound TCP address", proxy.Addr())
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Failed to dial Addr(): %v", err)
+	}
+	conn.Close()
+}
+
+func TestProxy_ListenAndServe(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	proxy, err := CreateProxy(WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendListener.Addr().String()))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.ListenAndServe(ctx)
+	}()
+	<-proxy.Ready()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q (err: %v), want %q", buf, err, "ping")
+	}
+
+	// ListenAndServe only returns once the open connection has been torn down
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ListenAndServe() = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenAndServe() did not return after cancellation")
+	}
+	if active := proxy.Stats().ActiveConnections; active != 0 {
+		t.Errorf("ActiveConnections = %d after ListenAndServe returned, want 0", active)
+	}
+	select {
+	case <-proxy.Done():
+	default:
+		t.Error("Done() not closed after ListenAndServe returned")
+	}
+}
+
+func TestProxy_Wait(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-p.Ready()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	echo(t, conn, "ping")
+	select {
+	case <-p.Done():
+		t.Fatal("Done() closed while the proxy is running")
+	default:
+	}
+
+	// Wait returns once the connection is gone
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait() did not return after cancellation")
+	}
+	if active := p.Stats().ActiveConnections; active != 0 {
+		t.Errorf("ActiveConnections = %d after Wait returned, want 0", active)
+	}
+}
+
+func TestProxy_ListenAndServeAcceptError(t *testing.T) {
+	proxy, err := CreateProxy()
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	proxy.listenerFactory = func(config) (net.Listener, error) {
+		return newMockListener(true), nil
+	}
+
+	// A fatal accept error returns without waiting for the context
+	err = proxy.ListenAndServe(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "mock accept error") {
+		t.Errorf("expected accept error, got %v", err)
+	}
+}
+
+func TestProxy_AcceptorsListenError(t *testing.T) {
+	var created []*mockListener
+	proxy, err := CreateProxy(WithAcceptors(3))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	proxy.listenerFactory = func(config) (net.Listener, error) {
+		if len(created) == 2 {
+			return nil, errors.New("mock listen error")
+		}
+		l := newMockListener(false)
+		created = append(created, l)
+		return l, nil
+	}
+
+	err = proxy.Run(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "mock listen error") {
+		t.Fatalf("expected listen error, got %v", err)
+	}
+	for i, l := range created {
+		select {
+		case <-l.close:
+		default:
+			t.Errorf("listener %d was not closed after a later one failed", i)
+		}
+	}
+}
+
+func TestProxy_ListenAddrs(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		for {
+			conn, err := backendListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	var mu sync.Mutex
+	var listeners []net.Listener
+	proxy, err := CreateProxy(WithListenAddrs("127.0.0.1:0", "127.0.0.1:0"), WithBackendAddr(backendListener.Addr().String()))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	proxy.listenerFactory = func(cfg config) (net.Listener, error) {
+		l, err := tcpListenerFactory(cfg)
+		if err == nil {
+			mu.Lock()
+			listeners = append(listeners, l)
+			mu.Unlock()
+		}
+		return l, err
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.ListenAndServe(ctx)
+	}()
+	<-proxy.Ready()
+
+	mu.Lock()
+	if len(listeners) != 2 {
+		mu.Unlock()
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+	addrs := []string{listeners[0].Addr().String(), listeners[1].Addr().String()}
+	mu.Unlock()
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial %s: %v", addr, err)
+		}
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("%s: got %q (err: %v), want %q", addr, buf, err, "ping")
+		}
+		conn.Close()
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ListenAndServe() = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenAndServe() did not return after cancellation")
+	}
+	for _, addr := range addrs {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after shutdown", addr)
+		}
+	}
+}
+
+func TestProxy_ListenAddrsBindError(t *testing.T) {
+	var created []*mockListener
+	proxy, err := CreateProxy(WithListenAddrs("127.0.0.1:9001", "127.0.0.1:9002"))
+	if err != nil {
+		t.Fatalf("CreateProxy() failed: %v", err)
+	}
+	proxy.listenerFactory = func(cfg config) (net.Listener, error) {
+		if cfg.listenAddr == "127.0.0.1:9002" {
+			return nil, errors.New("mock listen error")
+		}
+		l := newMockListener(false)
+		created = append(created, l)
+		return l, nil
+	}
+
+	err = proxy.Run(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1:9002") {
+		t.Fatalf("expected listen error naming the address, got %v", err)
+	}
+	if len(created) != 1 {
+		t.Fatalf("created %d listeners, want 1", len(created))
+	}
+	select {
+	case <-created[0].close:
+	default:
+		t.Error("listener on the first address was not closed after the second failed to bind")
+	}
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature is the fixed 12-byte prefix of every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2VersionCommand = 0x21 // version 2, PROXY command
+	proxyV2FamilyUnspec   = 0x00
+	proxyV2FamilyTCP4     = 0x11
+	proxyV2FamilyTCP6     = 0x21
+
+	// proxyV1MaxLength is the longest possible v1 header line, including CRLF
+	proxyV1MaxLength = 107
+	// proxyHeaderTimeout bounds how long the listener waits for the upstream header
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+// proxyHeaderV1 builds a PROXY protocol v1 header describing a connection from src to dst.
+// Addresses that aren't TCP (e.g. Unix sockets) are reported as UNKNOWN.
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4(); srcIP != nil && dstIP != nil {
+		return fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcAddr.Port, dstAddr.Port)
+	}
+	return fmt.Appendf(nil, "PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP.To16(), dstAddr.IP.To16(), srcAddr.Port, dstAddr.Port)
+}
+
+// proxyHeaderV2 builds a binary PROXY protocol v2 header describing a connection from src to dst.
+// Addresses that aren't TCP are sent with an unspecified family and no address block.
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, proxyV2VersionCommand)
+
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		header = append(header, proxyV2FamilyUnspec)
+		return binary.BigEndian.AppendUint16(header, 0)
+	}
+
+	var addrs []byte
+	if srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4(); srcIP != nil && dstIP != nil {
+		header = append(header, proxyV2FamilyTCP4)
+		addrs = append(append(addrs, srcIP...), dstIP...)
+	} else {
+		header = append(header, proxyV2FamilyTCP6)
+		addrs = append(append(addrs, srcAddr.IP.To16()...), dstAddr.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcAddr.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstAddr.Port))
+
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// writeProxyHeader sends the PROXY protocol header for a client connecting from src to dst
+func writeProxyHeader(backend net.Conn, src, dst net.Addr, version int) error {
+	var header []byte
+	switch version {
+	case 1:
+		header = proxyHeaderV1(src, dst)
+	case 2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unsupported proxy protocol version: %d", version)
+	}
+	if _, err := backend.Write(header); err != nil {
+		return fmt.Errorf("write proxy protocol header: %w", err)
+	}
+	return nil
+}
+
+// proxyProtoListener expects every accepted connection to start with the PROXY
+// protocol header sent by an upstream load balancer
+type proxyProtoListener struct {
+	net.Listener
+	// maxHeaderBytes caps how much of a header is read before the connection is dropped
+	maxHeaderBytes int
+}
+
+func newProxyProtoListener(l net.Listener, maxHeaderBytes int) net.Listener {
+	return &proxyProtoListener{Listener: l, maxHeaderBytes: maxHeaderBytes}
+}
+
+// Accept returns the next connection without waiting for its header, which is
+// read on first use so one silent client can't stall the accept loop
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, maxHeaderBytes: l.maxHeaderBytes}, nil
+}
+
+// proxyProtoConn is a connection that starts with a PROXY protocol header. The header
+// is consumed by the first Read or RemoteAddr, or explicitly with readHeader; a
+// missing or malformed one fails every Read.
+type proxyProtoConn struct {
+	net.Conn
+	maxHeaderBytes int
+
+	headerOnce sync.Once
+	headerErr  error
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// readHeader consumes the header, once; later calls return the first result
+func (c *proxyProtoConn) readHeader() error {
+	c.headerOnce.Do(func() {
+		c.reader, c.remoteAddr, c.headerErr = parseProxyHeader(c.Conn, c.maxHeaderBytes)
+	})
+	return c.headerErr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// NetConn returns the wrapped connection
+func (c *proxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns the client address carried by the header, or the address of
+// the peer that sent a missing or malformed one
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.readHeader() != nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// proxyHeaderConn returns the PROXY protocol connection under conn, looking
+// through wrappers such as TLS, or nil if conn doesn't carry a header
+func proxyHeaderConn(conn net.Conn) *proxyProtoConn {
+	for {
+		switch c := conn.(type) {
+		case *proxyProtoConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// parseProxyHeader reads the header from conn within proxyHeaderTimeout. It returns
+// the reader holding whatever followed the header and the client address.
+func parseProxyHeader(conn net.Conn, maxBytes int) (*bufio.Reader, net.Addr, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, nil, fmt.Errorf("set header deadline: %w", err)
+	}
+	limited := limitHandshake(conn, maxBytes)
+	reader := bufio.NewReader(limited)
+	prefix, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read header: %w", err)
+	}
+
+	var src net.Addr
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		src, err = parseProxyHeaderV2(reader)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		src, err = parseProxyHeaderV1(reader)
+	default:
+		err = errors.New("missing proxy protocol header")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	limited.lift()
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, fmt.Errorf("clear header deadline: %w", err)
+	}
+	// UNKNOWN and LOCAL headers carry no usable address
+	if src == nil {
+		src = conn.RemoteAddr()
+	}
+	return reader, src, nil
+}
+
+func parseProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil {
+		return nil, fmt.Errorf("malformed v1 header address: %q", line)
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("v1 header address doesn't match protocol: %q", line)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 header port: %w", err)
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("malformed v1 header port: %w", err)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func parseProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("read v2 header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version: %d", versionCommand>>4)
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, addrs); err != nil {
+		return nil, fmt.Errorf("read v2 addresses: %w", err)
+	}
+
+	switch command := versionCommand & 0x0f; command {
+	case 0x0: // LOCAL: health checks from the load balancer itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 header command: %d", command)
+	}
+	switch family {
+	case proxyV2FamilyTCP4:
+		if len(addrs) < 12 {
+			return nil, errors.New("v2 header address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case proxyV2FamilyTCP6:
+		if len(addrs) < 36 {
+			return nil, errors.New("v2 header address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	default:
+		// Other families (UDP, Unix) don't map to a TCP client address
+		return nil, nil
+	}
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		want string
+	}{
+		{
+			name: "tcp4",
+			src:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443},
+			want: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+		},
+		{
+			name: "tcp6",
+			src:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			want: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name: "unix socket",
+			src:  &net.UnixAddr{Name: "@", Net: "unix"},
+			dst:  &net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"},
+			want: "PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(proxyHeaderV1(tt.src, tt.dst)); got != tt.want {
+				t.Errorf("proxyHeaderV1() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	signature := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		want []byte
+	}{
+		{
+			name: "tcp4",
+			src:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443},
+			want: append([]byte(signature),
+				0x21, 0x11, 0x00, 0x0c,
+				192, 0, 2, 1,
+				192, 0, 2, 2,
+				0xdc, 0x04,
+				0x01, 0xbb),
+		},
+		{
+			name: "tcp6",
+			src:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			want: append([]byte(signature),
+				0x21, 0x21, 0x00, 0x24,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0xdc, 0x04,
+				0x01, 0xbb),
+		},
+		{
+			name: "unix socket",
+			src:  &net.UnixAddr{Name: "@", Net: "unix"},
+			dst:  &net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"},
+			want: append([]byte(signature), 0x21, 0x00, 0x00, 0x00),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyHeaderV2(tt.src, tt.dst); !bytes.Equal(got, tt.want) {
+				t.Errorf("proxyHeaderV2() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSendsProxyHeader(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create proxy listener: %v", err)
+	}
+	defer proxyListener.Close()
+
+	clientConn, err := net.Dial("tcp", proxyListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy listener: %v", err)
+	}
+	defer clientConn.Close()
+	proxyConn, err := proxyListener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept client: %v", err)
+	}
+
+	p := newTestProxy(t, WithBackendAddr(backendListener.Addr().String()), WithSendProxyProtocol(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(ctx, proxyConn, &wg)
+
+	backendConn, err := backendListener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept backend connection: %v", err)
+	}
+	defer backendConn.Close()
+
+	clientConn.Write([]byte("payload\n"))
+
+	backendConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(backendConn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	want := string(proxyHeaderV1(clientConn.LocalAddr(), clientConn.RemoteAddr()))
+	if header != want {
+		t.Errorf("got header %q, want %q", header, want)
+	}
+	payload, err := reader.ReadString('\n')
+	if err != nil || payload != "payload\n" {
+		t.Errorf("got payload %q (err: %v), want %q", payload, err, "payload\n")
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+	server := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+	server6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		name     string
+		header   []byte
+		wantAddr string // empty means the connection's own remote address
+		wantErr  bool
+	}{
+		{name: "v1 tcp4", header: proxyHeaderV1(client, server), wantAddr: client.String()},
+		{name: "v1 tcp6", header: proxyHeaderV1(client6, server6), wantAddr: client6.String()},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v2 tcp4", header: proxyHeaderV2(client, server), wantAddr: client.String()},
+		{name: "v2 tcp6", header: proxyHeaderV2(client6, server6), wantAddr: client6.String()},
+		{name: "v2 local", header: append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00)},
+		{name: "missing header", header: []byte("GET / HTTP/1.1\r\n"), wantErr: true},
+		{name: "v1 malformed", header: []byte("PROXY TCP4 not-an-ip 192.0.2.2 1 2\r\n"), wantErr: true},
+		{name: "v1 without CRLF", header: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 120)...), wantErr: true},
+		{name: "v2 bad version", header: append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x11, 0x11, 0x00, 0x00), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, proxySide := net.Pipe()
+			defer upstream.Close()
+			defer proxySide.Close()
+
+			go func() {
+				upstream.Write(tt.header)
+				upstream.Write([]byte("payload"))
+			}()
+
+			conn := &proxyProtoConn{Conn: proxySide, maxHeaderBytes: maxHandshakeBytesDefault}
+			err := conn.readHeader()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error for invalid header")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			wantAddr := tt.wantAddr
+			if wantAddr == "" {
+				wantAddr = proxySide.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantAddr {
+				t.Errorf("RemoteAddr() = %q, want %q", got, wantAddr)
+			}
+
+			payload := make([]byte, len("payload"))
+			if _, err := io.ReadFull(conn, payload); err != nil || string(payload) != "payload" {
+				t.Errorf("got payload %q (err: %v), want %q", payload, err, "payload")
+			}
+		})
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	ln, err := tcpListenerFactory(config{listenAddr: "127.0.0.1:0", acceptProxyProtocol: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ln.Close()
+
+	// The first connection has no header, the second one has a valid header
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("garbage that is not a header\r\n"))
+
+	good, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer good.Close()
+	client := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	good.Write(append(proxyHeaderV1(client, good.RemoteAddr()), "hello"...))
+
+	// Accept doesn't look at the header; the connection fails on first use instead
+	badConn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer badConn.Close()
+	if _, err := badConn.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "missing proxy protocol header") {
+		t.Errorf("expected missing header error, got %v", err)
+	}
+	if got, want := badConn.RemoteAddr().String(), bad.LocalAddr().String(); got != want {
+		t.Errorf("RemoteAddr() without a header = %q, want the peer address %q", got, want)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != client.String() {
+		t.Errorf("RemoteAddr() = %q, want %q", got, client.String())
+	}
+	buf := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("got %q (err: %v), want the data after the header", buf, err)
+	}
+}
+
+// TestProxy_ProxyProtocolSilentClient tests that a client that never sends its
+// header doesn't hold up the clients behind it
+func TestProxy_ProxyProtocolSilentClient(t *testing.T) {
+	backendAddr := startEchoBackend(t, "")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(backendAddr), WithAcceptProxyProtocol(true))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer func() {
+		cancel()
+		p.Wait()
+	}()
+	go p.Run(ctx)
+	<-p.Ready()
+
+	silent, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer silent.Close()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	conn.Write(proxyHeaderV1(client, conn.RemoteAddr()))
+	start := time.Now()
+	echo(t, conn, "ping")
+	if elapsed := time.Since(start); elapsed >= proxyHeaderTimeout {
+		t.Errorf("second client waited %v for the silent one", elapsed)
+	}
+}
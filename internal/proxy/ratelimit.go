@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all connections. Tokens are reserved
+// up front, so a request larger than the bucket simply waits longer.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// setRate changes the rate and burst, keeping the tokens already in the bucket
+func (l *rateLimiter) setRate(rate, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+	l.burst = float64(burst)
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// reserve takes n tokens from the bucket and returns how long to wait before using them
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// refund returns n reserved tokens that won't be used
+func (l *rateLimiter) refund(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(l.burst, l.tokens+float64(n))
+}
+
+// waitN blocks until n tokens are available or the context is cancelled, in which
+// case the tokens go back to the bucket for other waiters
+func (l *rateLimiter) waitN(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.refund(n)
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("burst is available immediately", func(t *testing.T) {
+		l := newRateLimiter(1000, 1000)
+		if delay := l.reserve(1000); delay != 0 {
+			t.Errorf("expected no delay within burst, got %v", delay)
+		}
+	})
+
+	t.Run("waits for tokens beyond the burst", func(t *testing.T) {
+		l := newRateLimiter(1000, 100)
+		l.reserve(100)
+		start := time.Now()
+		if err := l.waitN(context.Background(), 100); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// 100 bytes at 1000 bytes/sec take about 100ms
+		if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+			t.Errorf("waited %v, expected about 100ms", elapsed)
+		}
+	})
+
+	t.Run("context cancellation", func(t *testing.T) {
+		l := newRateLimiter(1, 1)
+		l.reserve(1)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := l.waitN(ctx, 1000); err == nil {
+			t.Error("expected error after context cancellation")
+		}
+	})
+	t.Run("cancelled wait refunds its tokens", func(t *testing.T) {
+		l := newRateLimiter(100, 100)
+		l.reserve(100)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := l.waitN(ctx, 1000); err == nil {
+			t.Fatal("expected error from a cancelled context")
+		}
+		// Without the refund the next byte would queue behind the abandoned 1000, about 10s
+		if delay := l.reserve(1); delay > time.Second {
+			t.Errorf("next reservation waits %v after a cancelled one, want about 10ms", delay)
+		}
+	})
+}
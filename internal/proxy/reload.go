@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Reload applies options on top of the running config and swaps in the settings
+// that can change without restarting the listener: the backend address, the
+// buffer size, the rate limit and a certificate given with WithCertKeyPEM. New
+// connections pick them up, while established
+// ones keep the values they started with. Options that change anything else,
+// such as the listener, timeouts or connection limits, are rejected and nothing
+// is applied.
+func (p *Proxy) Reload(options ...Option) error {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	cfg := p.config
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return fmt.Errorf("apply option: %w", err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if err := checkReloadable(p.config, cfg); err != nil {
+		return err
+	}
+
+	cfg.logWarnings(p.logger)
+	if cfg.certificate != p.config.certificate && p.config.certStore != nil {
+		p.config.certStore.cert.Store(cfg.certificate)
+	}
+	p.config.certificate = cfg.certificate
+	p.config.backendAddr = cfg.backendAddr
+	p.config.backendNetwork = cfg.backendNetwork
+	p.config.bufferSize = cfg.bufferSize
+	p.config.replyBufferSize = cfg.replyBufferSize
+	p.config.rateLimit = cfg.rateLimit
+	p.setRateLimit(cfg.rateLimit)
+	p.logger.Info("config reloaded", "backend", cfg.backendAddr, "buffer_size", cfg.bufferSize, "reply_buffer_size", cfg.replyBufferSize, "rate_limit", cfg.rateLimit)
+	return nil
+}
+
+// checkReloadable rejects changes to settings that are fixed once the listener is up
+func checkReloadable(old, updated config) error {
+	fixed := []struct {
+		name    string
+		changed bool
+	}{
+		{"listen address", old.listenAddr != updated.listenAddr || !slices.Equal(old.listenAddrs, updated.listenAddrs) || old.listenNetwork != updated.listenNetwork},
+		{"inherited listener", old.inheritListener != updated.inheritListener || old.inheritedFD != updated.inheritedFD},
+		{"tls", old.tlsEnabled != updated.tlsEnabled},
+		{"cert file path", old.certFilePath != updated.certFilePath},
+		{"key file path", old.keyFilePath != updated.keyFilePath},
+		{"client CAs", old.clientCAs != updated.clientCAs},
+		{"tls session tickets", old.noSessionTickets != updated.noSessionTickets || !slices.Equal(old.sessionTicketKeys, updated.sessionTicketKeys)},
+		{"udp mode", old.udp != updated.udp},
+		{"connect mode", old.connectMode != updated.connectMode},
+		{"socks5 mode", old.socks5Mode != updated.socks5Mode},
+		{"acceptors", old.acceptors != updated.acceptors},
+		{"proxy protocol", old.acceptProxyProtocol != updated.acceptProxyProtocol},
+		{"admin address", old.adminAddr != updated.adminAddr},
+		{"routes", !slices.Equal(old.routes, updated.routes)},
+	}
+	for _, f := range fixed {
+		if f.changed {
+			return fmt.Errorf("%s cannot be changed by reload", f.name)
+		}
+	}
+	// Everything Reload doesn't swap in would otherwise be dropped silently
+	oldValue, updatedValue := reflect.ValueOf(old), reflect.ValueOf(updated)
+	for i := range oldValue.NumField() {
+		name := oldValue.Type().Field(i).Name
+		if reloadableFields[name] {
+			continue
+		}
+		if !sameValue(oldValue.Field(i), updatedValue.Field(i)) {
+			return fmt.Errorf("%s cannot be changed by reload", name)
+		}
+	}
+	return nil
+}
+
+// reloadableFields are the config fields Reload applies to the running proxy
+var reloadableFields = map[string]bool{
+	"certificate":     true,
+	"backendAddr":     true,
+	"backendNetwork":  true,
+	"bufferSize":      true,
+	"replyBufferSize": true,
+	"rateLimit":       true,
+}
+
+// sameValue reports whether a and b hold the same setting. It works like
+// reflect.DeepEqual but also reads unexported fields, and treats funcs as equal
+// when they point at the same code, so an option that isn't given again
+// doesn't count as a change.
+func sameValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Func, reflect.Map, reflect.Chan, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Pointer:
+		if a.Pointer() == b.Pointer() {
+			return true
+		}
+		return !a.IsNil() && !b.IsNil() && sameValue(a.Elem(), b.Elem())
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && sameValue(a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.IsNil() != b.IsNil() {
+			return false
+		}
+		fallthrough
+	case reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := range a.Len() {
+			if !sameValue(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := range a.NumField() {
+			if !sameValue(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// loadConfig returns a snapshot of the current config
+func (p *Proxy) loadConfig() config {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.config
+}
+
+// requestBufferBytes and replyBufferBytes return the current buffer size for
+// each direction, for the buffer pools
+func (p *Proxy) requestBufferBytes() int {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.config.bufferSize
+}
+
+func (p *Proxy) replyBufferBytes() int {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.config.replyBufferSize
+}
+
+// setRateLimit installs, updates or removes the shared rate limiter
+func (p *Proxy) setRateLimit(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		p.rateLimiter.Store(nil)
+		return
+	}
+	if limiter := p.rateLimiter.Load(); limiter != nil {
+		limiter.setRate(bytesPerSec, bytesPerSec)
+		return
+	}
+	p.rateLimiter.Store(newRateLimiter(bytesPerSec, bytesPerSec))
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEchoBackend starts a backend that replies to every read with prefix followed by the data
+func startEchoBackend(t *testing.T, prefix string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(append([]byte(prefix), buf[:n]...))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// roundTrip relays msg through a new connection handled by p and returns the reply
+func roundTrip(t *testing.T, p *Proxy, msg string, replyLen int) string {
+	t.Helper()
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(ctx, proxyConn, &wg)
+	defer func() {
+		clientConn.Close()
+		cancel()
+		wg.Wait()
+	}()
+
+	go clientConn.Write([]byte(msg))
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply := make([]byte, replyLen)
+	if _, err := io.ReadFull(clientConn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return string(reply)
+}
+
+func TestProxy_ReloadBackend(t *testing.T) {
+	first := startEchoBackend(t, "a:")
+	second := startEchoBackend(t, "b:")
+	p := newTestProxy(t, WithBackendAddr(first))
+
+	if got := roundTrip(t, p, "ping", 6); got != "a:ping" {
+		t.Fatalf("got %q before reload, want %q", got, "a:ping")
+	}
+	if err := p.Reload(WithBackendAddr(second)); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if got := roundTrip(t, p, "ping", 6); got != "b:ping" {
+		t.Errorf("got %q after reload, want %q", got, "b:ping")
+	}
+}
+
+func TestProxy_ReloadBufferSizeAndRateLimit(t *testing.T) {
+	p := newTestProxy(t, WithBufferSize(4))
+	if p.rateLimiter.Load() != nil {
+		t.Fatal("expected no rate limiter by default")
+	}
+
+	if err := p.Reload(WithBufferSize(8), WithRateLimit(1024)); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if buf := p.requestBufs.get(); len(*buf) != 8*1024 {
+		t.Errorf("got buffer of %d bytes after reload, want %d", len(*buf), 8*1024)
+	}
+	if p.rateLimiter.Load() == nil {
+		t.Error("expected reload to install a rate limiter")
+	}
+
+	if err := p.Reload(WithRateLimit(0)); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if p.rateLimiter.Load() != nil {
+		t.Error("expected reload to remove the rate limiter")
+	}
+}
+
+func TestProxy_ReloadRejected(t *testing.T) {
+	p := newTestProxy(t, WithBackendAddr("127.0.0.1:9000"))
+
+	tests := []struct {
+		name    string
+		options []Option
+		wantErr string
+	}{
+		{name: "listen address", options: []Option{WithListenAddr("127.0.0.1:1")}, wantErr: "listen address cannot be changed by reload"},
+		{name: "udp mode", options: []Option{WithUDP(true)}, wantErr: "udp mode cannot be changed by reload"},
+		{name: "invalid option", options: []Option{WithBufferSize(-1)}, wantErr: "must be positive"},
+		{name: "fixed field alongside a reloadable one", options: []Option{WithBackendAddr("127.0.0.1:9001"), WithConnectMode(true)}, wantErr: "connect mode cannot be changed by reload"},
+		{name: "connect timeout", options: []Option{WithConnectTimeout(time.Second)}, wantErr: "connectTimeout cannot be changed by reload"},
+		{name: "max connections", options: []Option{WithMaxConnections(10)}, wantErr: "maxConnections cannot be changed by reload"},
+		{name: "allowed cidrs", options: []Option{WithAllowedCIDRs([]string{"10.0.0.0/8"})}, wantErr: "allowedCIDRs cannot be changed by reload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Reload(tt.options...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			// A rejected reload leaves the running config untouched
+			if got := p.loadConfig().backendAddr; got != "127.0.0.1:9000" {
+				t.Errorf("backend address changed to %q by a rejected reload", got)
+			}
+		})
+	}
+}
+
+func TestProxy_ReloadUnchangedOptions(t *testing.T) {
+	options := []Option{
+		WithBackendAddr("127.0.0.1:9000"),
+		WithConnectTimeout(time.Second),
+		WithAllowedCIDRs([]string{"127.0.0.0/8"}),
+	}
+	p := newTestProxy(t, options...)
+
+	// Giving the same settings again, as a config file re-read on SIGHUP does, is not a change
+	if err := p.Reload(append(options, WithBackendAddr("127.0.0.1:9001"))...); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if got := p.loadConfig().backendAddr; got != "127.0.0.1:9001" {
+		t.Errorf("backend address is %q after reload, want %q", got, "127.0.0.1:9001")
+	}
+}
+
+func TestProxy_ReloadConcurrent(t *testing.T) {
+	backend := startEchoBackend(t, "")
+	p := newTestProxy(t, WithBackendAddr(backend))
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if err := p.Reload(WithBufferSize(4+i), WithRateLimit(int64(1<<20+i))); err != nil {
+					t.Errorf("Reload() failed: %v", err)
+				}
+			}
+		}()
+	}
+	for range 10 {
+		if got := roundTrip(t, p, "ping", 4); got != "ping" {
+			t.Errorf("got %q, want %q", got, "ping")
+		}
+	}
+	wg.Wait()
+}
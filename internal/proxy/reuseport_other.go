@@ -0,0 +1,12 @@
+//go:build !unix || solaris
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(_, _ string, _ syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
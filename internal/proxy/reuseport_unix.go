@@ -0,0 +1,25 @@
+//go:build unix && !solaris
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setReusePort is a net.ListenConfig Control func that lets several listeners bind the same address
+func setReusePort(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("set SO_REUSEPORT: %w", sockErr)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// Route overrides settings for the connections it matches. Fields left at their
+// zero value fall back to the global config.
+type Route struct {
+	// Match is compared, ignoring case, with the server name a TLS client sent
+	// (SNI) or, in CONNECT and SOCKS5 modes, the requested target as host:port
+	// or just its host
+	Match string
+	// Backend is dialed instead of the configured backend or requested target
+	Backend string
+	// BufferSize is the relay buffer size for both directions in KiB, as for WithBufferSize
+	BufferSize int
+	// DialTimeout bounds the backend dial, as WithConnectTimeout does
+	DialTimeout time.Duration
+	// IdleTimeout is the longest a single read from either side may block, as WithReadTimeout does
+	IdleTimeout time.Duration
+}
+
+// route is a Route with the buffer pools for its own buffer size
+type route struct {
+	Route
+	requestBufs *bufferPool
+	replyBufs   *bufferPool
+}
+
+// newRoutes builds a route for each of routes, with pools capped at poolMax
+func newRoutes(routes []Route, poolMax int) []*route {
+	built := make([]*route, 0, len(routes))
+	for _, r := range routes {
+		rt := &route{Route: r}
+		if r.BufferSize > 0 {
+			size := func() int { return r.BufferSize * bufferSizeUnit }
+			rt.requestBufs = newBufferPool(size, poolMax)
+			rt.replyBufs = newBufferPool(size, poolMax)
+		}
+		built = append(built, rt)
+	}
+	return built
+}
+
+// matchRoute returns the first route matching the connection, or nil. target is
+// the address resolveTarget picked, which the client chose in CONNECT and SOCKS5 modes.
+func (p *Proxy) matchRoute(client net.Conn, cfg config, target string) *route {
+	if len(p.routes) == 0 {
+		return nil
+	}
+	var names []string
+	if cfg.connectMode || cfg.socks5Mode {
+		names = append(names, target)
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			names = append(names, host)
+		}
+	} else if tlsConn, ok := client.(*tls.Conn); ok {
+		if sni := tlsConn.ConnectionState().ServerName; sni != "" {
+			names = append(names, sni)
+		}
+	}
+	for _, r := range p.routes {
+		for _, name := range names {
+			if strings.EqualFold(r.Match, name) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns cfg with the route's overrides in place
+func (r *route) apply(cfg config) config {
+	if r.Backend != "" {
+		cfg.backendAddr = r.Backend
+		cfg.backendNetwork = "tcp"
+	}
+	if r.DialTimeout > 0 {
+		cfg.connectTimeout = r.DialTimeout
+	}
+	return cfg
+}
+
+// routeKey is the context key for the route a connection matched
+type routeKey struct{}
+
+// readTimeout returns the per-read ceiling for the connection ctx belongs to
+func (p *Proxy) readTimeout(ctx context.Context) time.Duration {
+	if r, ok := ctx.Value(routeKey{}).(*route); ok && r.IdleTimeout > 0 {
+		return r.IdleTimeout
+	}
+	return p.config.readTimeout
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxy_RoutesBySNI(t *testing.T) {
+	certPEM, keyPEM := readTempCert(t, t.TempDir())
+	defaultAddr := startEchoBackend(t, "default:")
+	tenantAddr := startEchoBackend(t, "tenant:")
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"), WithBackendAddr(defaultAddr),
+		WithTlSEnabled(true), WithCertKeyPEM(certPEM, keyPEM),
+		WithRoutes(Route{Match: "tenant.example", Backend: tenantAddr}))
+
+	defer p.Wait()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+	<-p.Ready()
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"TENANT.example", "tenant:ping"},
+		{"other.example", "default:ping"},
+	}
+	for _, tt := range tests {
+		conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != tt.want {
+			t.Errorf("SNI %s: got %q (err: %v), want %q", tt.serverName, buf, err, tt.want)
+		}
+		conn.Close()
+	}
+}
+
+// connectThrough opens a CONNECT tunnel to target through a connection handled by p
+func connectThrough(t *testing.T, p *Proxy, target string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	clientConn, proxyConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+
+	go clientConn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	return clientConn, reader
+}
+
+func TestHandleRoutesConnect(t *testing.T) {
+	tenantAddr := startEchoBackend(t, "tenant:")
+	p := newTestProxy(t, WithConnectMode(true), WithRoutes(
+		Route{Match: "tenant.example", Backend: tenantAddr},
+		Route{Match: "idle.example:443", Backend: tenantAddr, IdleTimeout: 50 * time.Millisecond},
+	))
+
+	// The route's backend is dialed instead of the requested target
+	conn, reader := connectThrough(t, p, "tenant.example:443")
+	conn.Write([]byte("ping"))
+	buf := make([]byte, len("tenant:ping"))
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "tenant:ping" {
+		t.Errorf("got %q (err: %v), want %q", buf, err, "tenant:ping")
+	}
+
+	// A route's idle timeout closes a tunnel nobody uses
+	start := time.Now()
+	_, reader = connectThrough(t, p, "idle.example:443")
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("expected the idle tunnel to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle tunnel closed after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestHandleRoutesDialTimeout(t *testing.T) {
+	p := newTestProxy(t, WithConnectMode(true), WithDialer(hangingDialer{}), WithConnectTimeout(time.Minute),
+		WithRoutes(Route{Match: "slow.example", DialTimeout: 50 * time.Millisecond}))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.handle(t.Context(), proxyConn, &wg)
+	go clientConn.Write([]byte("CONNECT slow.example:443 HTTP/1.1\r\nHost: slow.example:443\r\n\r\n"))
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	// The global minute-long connect timeout would have outlasted the read deadline
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	wg.Wait()
+}
+
+func TestNewRoutesBufferSize(t *testing.T) {
+	routes := newRoutes([]Route{{Match: "a", BufferSize: 4}, {Match: "b"}}, 0)
+	if got := len(*routes[0].requestBufs.get()); got != 4*bufferSizeUnit {
+		t.Errorf("route buffer is %d bytes, want %d", got, 4*bufferSizeUnit)
+	}
+	if routes[1].requestBufs != nil {
+		t.Error("expected a route without a buffer size to use the global pools")
+	}
+}
+
+func TestWithRoutesValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+		wantErr string
+	}{
+		{"empty match", []Option{WithConnectMode(true), WithRoutes(Route{Backend: "127.0.0.1:9000"})}, "route match is empty"},
+		{"bad backend", []Option{WithConnectMode(true), WithRoutes(Route{Match: "a", Backend: "nope"})}, "route a backend"},
+		{"negative timeout", []Option{WithConnectMode(true), WithRoutes(Route{Match: "a", IdleTimeout: -time.Second})}, "must not be negative"},
+		{"nothing to match on", []Option{WithRoutes(Route{Match: "a"})}, "routes need tls, connect or socks5 mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CreateProxy(tt.options...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected %q error, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
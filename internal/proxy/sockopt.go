@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// tcpConnOf returns the TCP connection underneath conn, looking through TLS and
+// other wrappers that expose the connection they wrap via NetConn
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of conn, looking through wrappers like
+// tcpConnOf does. It reports false if the connection can't be half-closed.
+func closeWrite(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// setSocketOptions applies the configured TCP socket options to conn.
+// Connections that aren't backed by TCP (e.g. Unix sockets) are left alone.
+func setSocketOptions(conn net.Conn, cfg config) error {
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetNoDelay(cfg.noDelay); err != nil {
+		return fmt.Errorf("set nodelay: %w", err)
+	}
+	if err := tcpConn.SetKeepAlive(cfg.keepAlive > 0); err != nil {
+		return fmt.Errorf("set keepalive: %w", err)
+	}
+	if cfg.keepAlive > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(cfg.keepAlive); err != nil {
+			return fmt.Errorf("set keepalive period: %w", err)
+		}
+	}
+	return nil
+}
+
+// setBackendSocketBuffers applies the backend socket buffer sizes to conn.
+// Like setSocketOptions it skips connections that aren't backed by TCP.
+func setBackendSocketBuffers(conn net.Conn, cfg config) error {
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return nil
+	}
+	if cfg.backendReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(cfg.backendReadBuffer); err != nil {
+			return fmt.Errorf("set read buffer: %w", err)
+		}
+	}
+	if cfg.backendWriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(cfg.backendWriteBuffer); err != nil {
+			return fmt.Errorf("set write buffer: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestTCPConnOf(t *testing.T) {
+	tcpConn, _ := tcpPair(t)
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+
+	tests := []struct {
+		name string
+		conn net.Conn
+		want bool
+	}{
+		{name: "tcp", conn: tcpConn, want: true},
+		{name: "tls over tcp", conn: tls.Client(tcpConn, &tls.Config{}), want: true},
+		{name: "proxy protocol over tcp", conn: &proxyProtoConn{Conn: tcpConn, reader: bufio.NewReader(tcpConn)}, want: true},
+		{name: "pipe", conn: pipeConn, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tcpConnOf(tt.conn)
+			if ok != tt.want {
+				t.Fatalf("tcpConnOf() ok = %v, want %v", ok, tt.want)
+			}
+			if ok && got != tcpConn {
+				t.Error("tcpConnOf() returned a different connection")
+			}
+		})
+	}
+}
+
+func TestSetSocketOptions(t *testing.T) {
+	tcpConn, _ := tcpPair(t)
+	for _, cfg := range []config{
+		{},
+		{keepAlive: 30 * time.Second},
+		{noDelay: true},
+		{noDelay: true, keepAlive: time.Minute},
+	} {
+		if err := setSocketOptions(tcpConn, cfg); err != nil {
+			t.Errorf("setSocketOptions(keepAlive=%v, noDelay=%v) failed: %v", cfg.keepAlive, cfg.noDelay, err)
+		}
+	}
+
+	// Non-TCP connections are skipped
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+	if err := setSocketOptions(pipeConn, config{keepAlive: time.Second}); err != nil {
+		t.Errorf("expected non-TCP connection to be skipped, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sockoptInt reads an integer SOL_SOCKET option from conn
+func sockoptInt(t *testing.T, conn *net.TCPConn, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() failed: %v", err)
+	}
+	var value int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		t.Fatalf("Control() failed: %v", err)
+	}
+	if sockErr != nil {
+		t.Fatalf("getsockopt failed: %v", sockErr)
+	}
+	return value
+}
+
+func TestSetBackendSocketBuffers(t *testing.T) {
+	tcpConn, _ := tcpPair(t)
+	defaultSend := sockoptInt(t, tcpConn, syscall.SO_SNDBUF)
+
+	// The kernel may round the size up, but never below what was asked for
+	const size = 256 << 10
+	if err := setBackendSocketBuffers(tcpConn, config{backendReadBuffer: size}); err != nil {
+		t.Fatalf("setBackendSocketBuffers() failed: %v", err)
+	}
+	if got := sockoptInt(t, tcpConn, syscall.SO_RCVBUF); got < size {
+		t.Errorf("SO_RCVBUF = %d, want at least %d", got, size)
+	}
+	// A zero size leaves that direction at the OS default
+	if got := sockoptInt(t, tcpConn, syscall.SO_SNDBUF); got != defaultSend {
+		t.Errorf("SO_SNDBUF = %d, want the default %d", got, defaultSend)
+	}
+
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+	if err := setBackendSocketBuffers(pipeConn, config{backendReadBuffer: size}); err != nil {
+		t.Errorf("expected non-TCP connection to be skipped, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5UserPassVersion = 0x01
+	socks5UserPassSuccess = 0x00
+	socks5UserPassFailure = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded            = 0x00
+	socks5ReplyGeneralFailure       = 0x01
+	socks5ReplyNotAllowed           = 0x02
+	socks5ReplyNetworkUnreachable   = 0x03
+	socks5ReplyHostUnreachable      = 0x04
+	socks5ReplyConnectionRefused    = 0x05
+	socks5ReplyCommandNotSupported  = 0x07
+	socks5ReplyAddrTypeNotSupported = 0x08
+
+	// socks5HandshakeTimeout bounds how long a client may take to negotiate
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+var (
+	errSocks5NoAcceptableMethod = errors.New("no acceptable socks5 auth method")
+	errSocks5AuthFailed         = errors.New("socks5 authentication failed")
+)
+
+// readSocks5Request performs the SOCKS5 handshake on conn and returns the
+// requested CONNECT target. Username/password authentication is required
+// when username is set, otherwise no authentication is offered.
+// Targets on ports outside allowedPorts are refused, unless it is empty. No more
+// than maxBytes are read from conn. On failure the matching reply has already
+// been written to the client.
+func readSocks5Request(conn net.Conn, username, password string, allowedPorts []int, maxBytes int) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(socks5HandshakeTimeout)); err != nil {
+		return "", fmt.Errorf("set handshake deadline: %w", err)
+	}
+	conn = limitHandshake(conn, maxBytes)
+	if err := socks5Negotiate(conn, username, password); err != nil {
+		return "", err
+	}
+	target, err := socks5ReadCommand(conn)
+	if err != nil {
+		return "", err
+	}
+	if _, port, _ := net.SplitHostPort(target); !destPortAllowed(port, allowedPorts) {
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+		return "", fmt.Errorf("%w: %s", errDestPortNotAllowed, target)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", fmt.Errorf("clear handshake deadline: %w", err)
+	}
+	return target, nil
+}
+
+// socks5Negotiate reads the client's method selection and authenticates it
+func socks5Negotiate(conn net.Conn, username, password string) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("read auth methods: %w", err)
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if username != "" {
+		want = socks5MethodUserPass
+	}
+	selected := byte(socks5MethodNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			selected = want
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, selected}); err != nil {
+		return fmt.Errorf("write method selection: %w", err)
+	}
+	switch selected {
+	case socks5MethodNoAcceptable:
+		return errSocks5NoAcceptableMethod
+	case socks5MethodUserPass:
+		return socks5Authenticate(conn, username, password)
+	}
+	return nil
+}
+
+// socks5Authenticate runs the RFC 1929 username/password sub-negotiation
+func socks5Authenticate(conn net.Conn, username, password string) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read auth request: %w", err)
+	}
+	if header[0] != socks5UserPassVersion {
+		return fmt.Errorf("unsupported auth version: %d", header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return fmt.Errorf("read username: %w", err)
+	}
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passLen); err != nil {
+		return fmt.Errorf("read password length: %w", err)
+	}
+	pass := make([]byte, passLen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return fmt.Errorf("read password: %w", err)
+	}
+
+	userOK := subtle.ConstantTimeCompare(user, []byte(username))
+	passOK := subtle.ConstantTimeCompare(pass, []byte(password))
+	if userOK&passOK != 1 {
+		//nolint:errcheck
+		conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return errSocks5AuthFailed
+	}
+	if _, err := conn.Write([]byte{socks5UserPassVersion, socks5UserPassSuccess}); err != nil {
+		return fmt.Errorf("write auth reply: %w", err)
+	}
+	return nil
+}
+
+// socks5ReadCommand reads the client's request and returns its CONNECT target
+func socks5ReadCommand(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("read request: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", fmt.Errorf("read domain length: %w", err)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("read domain: %w", err)
+		}
+		host = string(domain)
+	default:
+		writeSocks5Reply(conn, socks5ReplyAddrTypeNotSupported, nil)
+		return "", fmt.Errorf("unsupported address type: %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("read port: %w", err)
+	}
+
+	// BIND and UDP ASSOCIATE need the proxy to accept connections on the
+	// client's behalf, which a reverse proxy has no use for
+	if header[1] != socks5CmdConnect {
+		writeSocks5Reply(conn, socks5ReplyCommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported socks5 command: %d", header[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSocks5Reply sends a reply with the given code and bound address.
+// A nil or non-TCP address is sent as 0.0.0.0:0.
+func writeSocks5Reply(w io.Writer, code byte, bound net.Addr) {
+	reply := []byte{socks5Version, code, 0x00}
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socks5AddrIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socks5AddrIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	//nolint:errcheck
+	w.Write(reply)
+}
+
+// socks5DialReply maps a backend dial error to the closest SOCKS5 reply code
+func socks5DialReply(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5ReplyHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5ReplyHostUnreachable
+	}
+	return socks5ReplyGeneralFailure
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socks5ConnectRequest builds a SOCKS5 request for cmd to the given TCP address
+func socks5ConnectRequest(cmd byte, addr *net.TCPAddr) []byte {
+	req := []byte{socks5Version, cmd, 0x00, socks5AddrIPv4}
+	req = append(req, addr.IP.To4()...)
+	return binary.BigEndian.AppendUint16(req, uint16(addr.Port))
+}
+
+// TestHandleSocks5Mode tests the SOCKS5 handshake and relay to the requested target
+func TestHandleSocks5Mode(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+	go func() {
+		for {
+			conn, err := backendListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	target := backendListener.Addr().(*net.TCPAddr)
+	unreachable := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	auth := func(user, pass string) []byte {
+		msg := []byte{socks5UserPassVersion, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		return append(msg, pass...)
+	}
+
+	tests := []struct {
+		name       string
+		options    []Option
+		greeting   []byte
+		wantMethod byte
+		auth       []byte
+		wantAuth   byte
+		request    []byte
+		wantReply  byte
+	}{
+		{
+			name:       "no auth connect",
+			greeting:   []byte{socks5Version, 1, socks5MethodNoAuth},
+			wantMethod: socks5MethodNoAuth,
+			request:    socks5ConnectRequest(socks5CmdConnect, target),
+			wantReply:  socks5ReplySucceeded,
+		},
+		{
+			name:       "username and password",
+			options:    []Option{WithSocks5Credentials("user", "secret")},
+			greeting:   []byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUserPass},
+			wantMethod: socks5MethodUserPass,
+			auth:       auth("user", "secret"),
+			wantAuth:   socks5UserPassSuccess,
+			request:    socks5ConnectRequest(socks5CmdConnect, target),
+			wantReply:  socks5ReplySucceeded,
+		},
+		{
+			name:       "wrong password",
+			options:    []Option{WithSocks5Credentials("user", "secret")},
+			greeting:   []byte{socks5Version, 1, socks5MethodUserPass},
+			wantMethod: socks5MethodUserPass,
+			auth:       auth("user", "wrong"),
+			wantAuth:   socks5UserPassFailure,
+		},
+		{
+			name:       "no acceptable method",
+			options:    []Option{WithSocks5Credentials("user", "secret")},
+			greeting:   []byte{socks5Version, 1, socks5MethodNoAuth},
+			wantMethod: socks5MethodNoAcceptable,
+		},
+		{
+			name:       "bind rejected",
+			greeting:   []byte{socks5Version, 1, socks5MethodNoAuth},
+			wantMethod: socks5MethodNoAuth,
+			request:    socks5ConnectRequest(0x02, target),
+			wantReply:  socks5ReplyCommandNotSupported,
+		},
+		{
+			name:       "udp associate rejected",
+			greeting:   []byte{socks5Version, 1, socks5MethodNoAuth},
+			wantMethod: socks5MethodNoAuth,
+			request:    socks5ConnectRequest(0x03, target),
+			wantReply:  socks5ReplyCommandNotSupported,
+		},
+		{
+			name:       "allowed port",
+			options:    []Option{WithAllowedDestPorts([]int{target.Port})},
+			greeting:   []byte{socks5Version, 1, socks5MethodNoAuth},
+			wantMethod: socks5MethodNoAuth,
+			request:    socks5ConnectRequest(socks5CmdConnect, target),
+			wantReply:  socks5ReplySucceeded,
+		},
+		{
+			name:       "port not allowed",
+			options:    []Option{WithAllowedDestPorts([]int{443})},
+			greeting:   []byte{socks5Version, 1, socks5MethodNoAuth},
+			wantMethod: socks5MethodNoAuth,
+			request:    socks5ConnectRequest(socks5CmdConnect, target),
+			wantReply:  socks5ReplyNotAllowed,
+		},
+		{
+			name:       "connection refused",
+			greeting:   []byte{socks5Version, 1, socks5MethodNoAuth},
+			wantMethod: socks5MethodNoAuth,
+			request:    socks5ConnectRequest(socks5CmdConnect, unreachable),
+			wantReply:  socks5ReplyConnectionRefused,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The configured backend must never be dialled in SOCKS5 mode
+			options := append([]Option{WithSocks5Mode(true), WithBackendAddr("127.0.0.1:1")}, tt.options...)
+			p := newTestProxy(t, options...)
+
+			clientConn, proxyConn := net.Pipe()
+			defer clientConn.Close()
+			clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go p.handle(ctx, proxyConn, &wg)
+			defer func() {
+				clientConn.Close()
+				cancel()
+				wg.Wait()
+			}()
+
+			clientConn.Write(tt.greeting)
+			reply := make([]byte, 2)
+			if _, err := io.ReadFull(clientConn, reply); err != nil {
+				t.Fatalf("Failed to read method selection: %v", err)
+			}
+			if reply[1] != tt.wantMethod {
+				t.Fatalf("got method %#x, want %#x", reply[1], tt.wantMethod)
+			}
+
+			if tt.auth != nil {
+				clientConn.Write(tt.auth)
+				if _, err := io.ReadFull(clientConn, reply); err != nil {
+					t.Fatalf("Failed to read auth reply: %v", err)
+				}
+				if reply[1] != tt.wantAuth {
+					t.Fatalf("got auth status %#x, want %#x", reply[1], tt.wantAuth)
+				}
+			}
+			if tt.request == nil {
+				return
+			}
+
+			clientConn.Write(tt.request)
+			// Replies carry an IPv4 bound address: 4 header bytes, 4 address bytes and the port
+			cmdReply := make([]byte, 10)
+			if _, err := io.ReadFull(clientConn, cmdReply); err != nil {
+				t.Fatalf("Failed to read reply: %v", err)
+			}
+			if cmdReply[1] != tt.wantReply {
+				t.Fatalf("got reply %#x, want %#x", cmdReply[1], tt.wantReply)
+			}
+			if tt.wantReply != socks5ReplySucceeded {
+				return
+			}
+
+			go clientConn.Write([]byte("ping"))
+			echo := make([]byte, len("ping"))
+			if _, err := io.ReadFull(clientConn, echo); err != nil || string(echo) != "ping" {
+				t.Errorf("got %q (err: %v), want %q", echo, err, "ping")
+			}
+		})
+	}
+}
+
+func TestSocks5ModeExclusive(t *testing.T) {
+	_, err := CreateProxy(WithSocks5Mode(true), WithConnectMode(true))
+	if err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("expected mutually exclusive error, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds the client address and byte counts of a single proxied connection
+type Stats struct {
+	// ClientAddr is the client's source address as accepted, the same one
+	// ClientAddr returns for the connection's context
+	ClientAddr           net.Addr
+	BytesClientToBackend int64
+	BytesBackendToClient int64
+	// ClientCertSubject, ClientCertSerial (hex) and ClientCertFingerprint (hex
+	// SHA-256 of the DER certificate) identify the certificate a TLS client was
+	// verified with. They are empty unless WithClientCAs is set.
+	ClientCertSubject     string
+	ClientCertSerial      string
+	ClientCertFingerprint string
+	// TLSVersion, TLSCipherSuite and TLSServerName (SNI) describe what a TLS
+	// client negotiated. They are empty when TLS is off.
+	TLSVersion     string
+	TLSCipherSuite string
+	TLSServerName  string
+}
+
+// setTLS records what a TLS client negotiated
+func (s *Stats) setTLS(state tls.ConnectionState) {
+	s.TLSVersion = tls.VersionName(state.Version)
+	s.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	s.TLSServerName = state.ServerName
+}
+
+// setClientCert records the certificate a TLS client was verified with
+func (s *Stats) setClientCert(cert *x509.Certificate) {
+	sum := sha256.Sum256(cert.Raw)
+	s.ClientCertSubject = cert.Subject.String()
+	s.ClientCertSerial = strings.ToUpper(cert.SerialNumber.Text(16))
+	s.ClientCertFingerprint = hex.EncodeToString(sum[:])
+}
+
+// Snapshot is a point-in-time view of the proxy counters since start
+type Snapshot struct {
+	ActiveConnections    int64
+	AcceptedConnections  int64
+	BytesClientToBackend int64
+	BytesBackendToClient int64
+	DialErrors           int64
+	// PooledBuffers is the number of idle relay buffers held by a pool capped
+	// with WithBufferPoolMax; it is always 0 for the default pool
+	PooledBuffers int64
+	// Rejected counts connections that were accepted and then turned away, by reason
+	Rejected Rejections
+	// StartedAt is when Run started listening and Uptime how long ago that was;
+	// both are zero before then
+	StartedAt time.Time
+	Uptime    time.Duration
+}
+
+// Rejections counts connections turned away before reaching a backend, by reason.
+// Rate limits delay connections rather than reject them, so they don't appear here.
+type Rejections struct {
+	// IPDenied counts clients outside WithAllowedCIDRs or inside WithDeniedCIDRs
+	IPDenied int64
+	// MaxConnectionsPerIP counts clients over WithMaxConnectionsPerIP
+	MaxConnectionsPerIP int64
+	// MaxConnections counts clients over WithMaxConnections
+	MaxConnections int64
+	// Maintenance counts clients turned away by SetMaintenance
+	Maintenance int64
+	// CircuitOpen counts clients turned away while WithCircuitBreaker had the backend's circuit open
+	CircuitOpen int64
+}
+
+// rejectReason says why a connection was turned away
+type rejectReason int
+
+const (
+	rejectIPDenied rejectReason = iota
+	rejectMaxConnectionsPerIP
+	rejectMaxConnections
+	rejectMaintenance
+	rejectCircuitOpen
+	numRejectReasons
+)
+
+// String is the reason as used in the rejected connections metric
+func (r rejectReason) String() string {
+	switch r {
+	case rejectIPDenied:
+		return "ip_denied"
+	case rejectMaxConnectionsPerIP:
+		return "max_conns_per_ip"
+	case rejectMaxConnections:
+		return "max_conns"
+	case rejectMaintenance:
+		return "maintenance"
+	case rejectCircuitOpen:
+		return "circuit_open"
+	default:
+		return "unknown"
+	}
+}
+
+// countRejected records a connection turned away for reason
+func (p *Proxy) countRejected(ctx context.Context, reason rejectReason) {
+	p.counters.rejected[reason].Add(1)
+	p.metrics.recordRejected(ctx, reason)
+}
+
+type counters struct {
+	activeConnections    atomic.Int64
+	acceptedConnections  atomic.Int64
+	bytesClientToBackend atomic.Int64
+	bytesBackendToClient atomic.Int64
+	dialErrors           atomic.Int64
+	rejected             [numRejectReasons]atomic.Int64
+}
+
+// Stats returns a snapshot of the proxy counters. It is safe to call while the proxy is running.
+func (p *Proxy) Stats() Snapshot {
+	startedAt := p.StartedAt()
+	return Snapshot{
+		ActiveConnections:    p.counters.activeConnections.Load(),
+		AcceptedConnections:  p.counters.acceptedConnections.Load(),
+		BytesClientToBackend: p.counters.bytesClientToBackend.Load(),
+		BytesBackendToClient: p.counters.bytesBackendToClient.Load(),
+		DialErrors:           p.counters.dialErrors.Load(),
+		PooledBuffers:        int64(p.requestBufs.idle() + p.replyBufs.idle()),
+		StartedAt:            startedAt,
+		Uptime:               uptime(startedAt),
+		Rejected: Rejections{
+			IPDenied:            p.counters.rejected[rejectIPDenied].Load(),
+			MaxConnectionsPerIP: p.counters.rejected[rejectMaxConnectionsPerIP].Load(),
+			MaxConnections:      p.counters.rejected[rejectMaxConnections].Load(),
+			Maintenance:         p.counters.rejected[rejectMaintenance].Load(),
+			CircuitOpen:         p.counters.rejected[rejectCircuitOpen].Load(),
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxy_Stats(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend listener: %v", err)
+	}
+	defer backendListener.Close()
+
+	// Echo backend
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	mockListener := newMockListener(false)
+	proxy := newTestProxy(t, WithBackendAddr(backendListener.Addr().String()))
+	proxy.listenerFactory = func(config config) (net.Listener, error) {
+		return mockListener, nil
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go proxy.Run(ctx)
+
+	clientConn, proxyConn := net.Pipe()
+	mockListener.conns <- proxyConn
+
+	testData := []byte("count me")
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	clientConn.Write(testData)
+	response := make([]byte, len(testData))
+	if _, err := io.ReadFull(clientConn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	// Counters are updated right after each write returns, so give them a moment to settle
+	waitFor(t, func() bool { return proxy.Stats().BytesBackendToClient == int64(len(testData)) })
+	snapshot := proxy.Stats()
+	if snapshot.ActiveConnections != 1 {
+		t.Errorf("ActiveConnections = %d, expected 1", snapshot.ActiveConnections)
+	}
+	if snapshot.AcceptedConnections != 1 {
+		t.Errorf("AcceptedConnections = %d, expected 1", snapshot.AcceptedConnections)
+	}
+	if snapshot.BytesClientToBackend != int64(len(testData)) {
+		t.Errorf("BytesClientToBackend = %d, expected %d", snapshot.BytesClientToBackend, len(testData))
+	}
+	if snapshot.BytesBackendToClient != int64(len(testData)) {
+		t.Errorf("BytesBackendToClient = %d, expected %d", snapshot.BytesBackendToClient, len(testData))
+	}
+
+	clientConn.Close()
+	waitFor(t, func() bool { return proxy.Stats().ActiveConnections == 0 })
+	if active := proxy.Stats().ActiveConnections; active != 0 {
+		t.Errorf("ActiveConnections = %d after close, expected 0", active)
+	}
+
+	cancel()
+	proxy.Wait()
+}
+
+func TestProxy_StatsDialErrors(t *testing.T) {
+	p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"))
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	p.handle(context.Background(), proxyConn, &wg)
+
+	if dialErrors := p.Stats().DialErrors; dialErrors != 1 {
+		t.Errorf("DialErrors = %d, expected 1", dialErrors)
+	}
+}
+
+func TestProxy_Uptime(t *testing.T) {
+	p := newTestProxy(t, WithListenAddr("127.0.0.1:0"))
+	if !p.StartedAt().IsZero() || p.Uptime() != 0 || p.Stats().Uptime != 0 {
+		t.Errorf("StartedAt() = %v, Uptime() = %v before Run, want zero", p.StartedAt(), p.Uptime())
+	}
+
+	before := time.Now()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer p.Wait()
+	defer cancel()
+	go p.Run(ctx)
+	<-p.Ready()
+
+	startedAt := p.StartedAt()
+	if startedAt.Before(before) || startedAt.After(time.Now()) {
+		t.Errorf("StartedAt() = %v, want a time after %v", startedAt, before)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stats := p.Stats()
+	if !stats.StartedAt.Equal(startedAt) {
+		t.Errorf("Stats().StartedAt = %v, want %v", stats.StartedAt, startedAt)
+	}
+	if stats.Uptime < 20*time.Millisecond || p.Uptime() < stats.Uptime {
+		t.Errorf("Stats().Uptime = %v, Uptime() = %v, want at least 20ms", stats.Uptime, p.Uptime())
+	}
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within 2s
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/ev-gor/tcp-reverse-proxy"
+	spanName   = "proxy.connection"
+
+	// Values of the outcome attribute, set when the span ends
+	outcomeFailed = "failed"
+	outcomeDialed = "dialed"
+	outcomeClosed = "closed"
+)
+
+// connSpan traces one proxied connection from accept to close
+type connSpan struct {
+	span    trace.Span
+	outcome string
+}
+
+func (p *Proxy) startConnSpan(ctx context.Context, clientAddr net.Addr) (context.Context, *connSpan) {
+	ctx, span := p.tracer.Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("client.address", clientAddr.String())),
+	)
+	return ctx, &connSpan{span: span, outcome: outcomeFailed}
+}
+
+func (s *connSpan) setBackend(addr string) {
+	s.span.SetAttributes(attribute.String("proxy.backend", addr))
+}
+
+// fail marks the connection as failed because of err
+func (s *connSpan) fail(msg string, err error) {
+	s.outcome = outcomeFailed
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, msg)
+}
+
+func (s *connSpan) end(stats Stats) {
+	s.span.SetAttributes(
+		attribute.String("proxy.outcome", s.outcome),
+		attribute.Int64("proxy.bytes_client_to_backend", stats.BytesClientToBackend),
+		attribute.Int64("proxy.bytes_backend_to_client", stats.BytesBackendToClient),
+	)
+	s.span.End()
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestHandleTracing(t *testing.T) {
+	t.Run("relayed connection", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		backendAddr := startEchoBackend(t, "")
+		p := newTestProxy(t, WithBackendAddr(backendAddr), WithTracerProvider(tp))
+
+		clientConn, proxyConn := net.Pipe()
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go p.handle(ctx, proxyConn, &wg)
+
+		go clientConn.Write([]byte("ping"))
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(clientConn, make([]byte, 4)); err != nil {
+			t.Fatalf("Failed to read from proxy: %v", err)
+		}
+		clientConn.Close()
+		wg.Wait()
+
+		spans := recorder.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("got %d spans, want 1", len(spans))
+		}
+		attrs := spanAttrs(spans[0])
+		if got := attrs["proxy.backend"].AsString(); got != backendAddr {
+			t.Errorf("proxy.backend = %q, want %q", got, backendAddr)
+		}
+		if got := attrs["proxy.outcome"].AsString(); got != outcomeClosed {
+			t.Errorf("proxy.outcome = %q, want %q", got, outcomeClosed)
+		}
+		if got := attrs["proxy.bytes_client_to_backend"].AsInt64(); got != 4 {
+			t.Errorf("proxy.bytes_client_to_backend = %d, want 4", got)
+		}
+		if _, ok := attrs["client.address"]; !ok {
+			t.Error("expected client.address attribute")
+		}
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		p := newTestProxy(t, WithBackendAddr("127.0.0.1:1"), WithTracerProvider(tp))
+
+		clientConn, proxyConn := net.Pipe()
+		defer clientConn.Close()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		p.handle(t.Context(), proxyConn, &wg)
+
+		spans := recorder.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("got %d spans, want 1", len(spans))
+		}
+		if got := spanAttrs(spans[0])["proxy.outcome"].AsString(); got != outcomeFailed {
+			t.Errorf("proxy.outcome = %q, want %q", got, outcomeFailed)
+		}
+		if status := spans[0].Status(); status.Code != codes.Error {
+			t.Errorf("span status = %v, want error", status)
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpSessionTimeoutDefault = 60 * time.Second
+	// udpMaxDatagramSize fits any UDP payload, so datagrams are never truncated
+	udpMaxDatagramSize = 64 * 1024
+)
+
+// udpSession relays datagrams between one client address and the backend
+type udpSession struct {
+	backend    net.Conn
+	lastActive atomic.Int64 // unix nanoseconds
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, s.lastActive.Load()))
+}
+
+// udpSessions tracks client sessions by source address
+type udpSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+}
+
+func (s *udpSessions) get(key string) *udpSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[key]
+}
+
+// add registers session under key. It reports false once closeAll has run, as
+// nothing would be left to close the session.
+func (s *udpSessions) add(key string, session *udpSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.sessions[key] = session
+	return true
+}
+
+// remove closes and forgets the session, if it is still the one registered under key
+func (s *udpSessions) remove(key string, session *udpSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[key] == session {
+		delete(s.sessions, key)
+	}
+	//nolint:errcheck
+	session.backend.Close()
+}
+
+// expire closes sessions that have been idle for longer than timeout
+func (s *udpSessions) expire(now time.Time, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, session := range s.sessions {
+		if session.idleSince(now) > timeout {
+			delete(s.sessions, key)
+			//nolint:errcheck
+			session.backend.Close()
+		}
+	}
+}
+
+// closeAll closes every session and refuses new ones from then on
+func (s *udpSessions) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for key, session := range s.sessions {
+		delete(s.sessions, key)
+		//nolint:errcheck
+		session.backend.Close()
+	}
+}
+
+// runUDP proxies datagrams from the listen address to the backend until ctx is cancelled.
+// Each client address gets its own backend socket so responses can be routed back.
+func (p *Proxy) runUDP(ctx context.Context, wg *sync.WaitGroup) error {
+	conn, err := net.ListenPacket("udp", p.config.listenAddr)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrListen, bindError(err))
+	}
+	p.setReady(conn.LocalAddr())
+	p.logger.Info("listening", "addr", p.Addr(), "network", "udp")
+
+	sessions := &udpSessions{sessions: make(map[string]*udpSession)}
+	timeout := p.config.udpSessionTimeout
+
+	// Close the socket and every session when the context is cancelled,
+	// and sweep idle sessions until then
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				//nolint:errcheck
+				conn.Close()
+				sessions.closeAll()
+				return
+			case now := <-ticker.C:
+				sessions.expire(now, timeout)
+			}
+		}
+	}()
+
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, clientAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("read datagram: %w", err)
+		}
+
+		key := clientAddr.String()
+		session := sessions.get(key)
+		if session == nil {
+			// Datagrams can't be refused, only dropped; each one from a denied source counts
+			if err := p.checkClientAllowed(clientAddr); err != nil {
+				p.logger.Debug("dropping datagram from rejected client", "remote_addr", clientAddr, "reason", err)
+				p.countRejected(ctx, rejectIPDenied)
+				continue
+			}
+			cfg := p.loadConfig()
+			dialCtx, cancel := withOptionalTimeout(ctx, cfg.connectTimeout)
+			backend, err := backendDialer(cfg).DialContext(dialCtx, udpNetwork(cfg), cfg.backendAddr)
+			cancel()
+			if err != nil {
+				p.counters.dialErrors.Add(1)
+				p.logger.Error("backend dial failed", "remote_addr", clientAddr, "backend", cfg.backendAddr, "error", err)
+				continue
+			}
+			session = &udpSession{backend: backend}
+			session.touch()
+			// Shutdown may have closed every session while this one was being dialed
+			if !sessions.add(key, session) {
+				//nolint:errcheck
+				backend.Close()
+				continue
+			}
+			p.logger.Info("new udp session", "remote_addr", clientAddr)
+
+			wg.Add(1)
+			go p.relayUDPResponses(conn, clientAddr, session, sessions, wg)
+		}
+
+		session.touch()
+		if _, err := session.backend.Write(buf[:n]); err != nil {
+			p.logger.Error("write error", "remote_addr", clientAddr, "backend", session.backend.RemoteAddr(), "error", err)
+			sessions.remove(key, session)
+			continue
+		}
+		p.counters.bytesClientToBackend.Add(int64(n))
+	}
+}
+
+// udpNetwork returns the network to dial a UDP backend over, following WithDialNetwork
+func udpNetwork(cfg config) string {
+	switch cfg.dialNetwork {
+	case "tcp4":
+		return "udp4"
+	case "tcp6":
+		return "udp6"
+	default:
+		return "udp"
+	}
+}
+
+// relayUDPResponses sends datagrams from the session's backend socket back to the client
+// until the session is closed
+func (p *Proxy) relayUDPResponses(conn net.PacketConn, clientAddr net.Addr, session *udpSession, sessions *udpSessions, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer sessions.remove(clientAddr.String(), session)
+
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, err := session.backend.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.logger.Error("read error", "remote_addr", clientAddr, "backend", session.backend.RemoteAddr(), "error", err)
+			}
+			return
+		}
+		session.touch()
+		if _, err := conn.WriteTo(buf[:n], clientAddr); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.logger.Error("write error", "remote_addr", clientAddr, "error", err)
+			}
+			return
+		}
+		p.counters.bytesBackendToClient.Add(int64(n))
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestProxy_RunUDP tests that datagrams are relayed to the backend and responses routed back per client
+func TestProxy_RunUDP(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	p := newTestProxy(t, WithUDP(true), WithListenAddr("127.0.0.1:0"), WithBackendAddr(backend.LocalAddr().String()))
+
+	defer p.Wait()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		if err := p.Run(ctx); err != nil {
+			t.Errorf("Proxy run error: %v", err)
+		}
+	}()
+
+	<-p.Ready()
+	listenAddr := p.Addr().String()
+
+	// Each client must only see responses to its own datagrams
+	for _, msg := range []string{"first", "second"} {
+		client, err := net.Dial("udp", listenAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		defer client.Close()
+
+		buf := make([]byte, 1024)
+		var n int
+		// Datagrams can be lost, so resend until a response arrives
+		waitFor(t, func() bool {
+			client.Write([]byte(msg))
+			client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			n, err = client.Read(buf)
+			return err == nil
+		})
+		if got := string(buf[:n]); got != "echo:"+msg {
+			t.Errorf("got %q, want %q", got, "echo:"+msg)
+		}
+	}
+
+	// Counters are updated after the response is sent
+	waitFor(t, func() bool { return p.Stats().BytesBackendToClient > 0 })
+	if stats := p.Stats(); stats.BytesClientToBackend == 0 || stats.BytesBackendToClient == 0 {
+		t.Errorf("expected udp bytes to be counted, got %+v", stats)
+	}
+}
+
+func TestProxy_RunUDPDeniedClient(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+	var received atomic.Int64
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, _, err := backend.ReadFrom(buf); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+
+	p := newTestProxy(t, WithUDP(true), WithListenAddr("127.0.0.1:0"), WithBackendAddr(backend.LocalAddr().String()),
+		WithDeniedCIDRs([]string{"127.0.0.0/8"}))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer func() {
+		cancel()
+		p.Wait()
+	}()
+	go p.Run(ctx)
+	<-p.Ready()
+
+	client, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer client.Close()
+	for range 3 {
+		client.Write([]byte("ping"))
+	}
+	waitFor(t, func() bool { return p.Stats().Rejected.IPDenied > 0 })
+	if got := received.Load(); got != 0 {
+		t.Errorf("backend received %d datagrams from a denied client", got)
+	}
+}
+
+// TestProxy_RunUDPDialSettings tests that UDP backends are dialed with the configured dialer settings
+func TestProxy_RunUDPDialSettings(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+
+	dialer := &recordingDialer{}
+	p := newTestProxy(t, WithUDP(true), WithListenAddr("127.0.0.1:0"), WithBackendAddr(backend.LocalAddr().String()),
+		WithDialer(dialer), WithDialNetwork("tcp4"))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer func() {
+		cancel()
+		p.Wait()
+	}()
+	go p.Run(ctx)
+	<-p.Ready()
+
+	client, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer client.Close()
+	buf := make([]byte, 1024)
+	// Datagrams can be lost, so resend until the backend sees one
+	waitFor(t, func() bool {
+		client.Write([]byte("ping"))
+		backend.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, _, err := backend.ReadFrom(buf)
+		return err == nil
+	})
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if want := "udp4 " + backend.LocalAddr().String(); len(dialer.addrs) != 1 || dialer.addrs[0] != want {
+		t.Errorf("dialed %v, want [%s]", dialer.addrs, want)
+	}
+
+	// The source address set with WithDialLocalAddr has to be a UDP one
+	cfg := newTestProxy(t, WithUDP(true), WithDialLocalAddr("127.0.0.1")).config
+	if d := backendDialer(cfg).(*net.Dialer); d.LocalAddr.Network() != "udp" {
+		t.Errorf("LocalAddr = %#v for a udp backend, want a *net.UDPAddr", d.LocalAddr)
+	}
+}
+
+// TestProxy_RunUDPShutdownDuringDial tests that a session dialed while the proxy
+// shuts down is closed too, so Wait doesn't hang on a backend that never answers
+func TestProxy_RunUDPShutdownDuringDial(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	var once sync.Once
+	dialed := make(chan struct{})
+	dialer := dialerFunc(func(_ context.Context, network, addr string) (net.Conn, error) {
+		once.Do(func() {
+			cancel()
+			close(dialed)
+		})
+		// Give the sweeper time to close every session before this one is registered
+		time.Sleep(100 * time.Millisecond)
+		return net.Dial(network, addr)
+	})
+	p := newTestProxy(t, WithUDP(true), WithListenAddr("127.0.0.1:0"), WithBackendAddr(backend.LocalAddr().String()),
+		WithDialer(dialer))
+	go p.Run(ctx)
+	<-p.Ready()
+
+	client, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer client.Close()
+	waitFor(t, func() bool {
+		client.Write([]byte("ping"))
+		select {
+		case <-dialed:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	})
+
+	select {
+	case <-p.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait didn't return after shutdown")
+	}
+}
+
+func TestUDPSessionsExpire(t *testing.T) {
+	sessions := &udpSessions{sessions: make(map[string]*udpSession)}
+	now := time.Now()
+
+	idleConn, _ := net.Pipe()
+	idle := &udpSession{backend: idleConn}
+	idle.lastActive.Store(now.Add(-2 * time.Minute).UnixNano())
+	sessions.add("idle", idle)
+
+	activeConn, _ := net.Pipe()
+	defer activeConn.Close()
+	active := &udpSession{backend: activeConn}
+	active.lastActive.Store(now.UnixNano())
+	sessions.add("active", active)
+
+	sessions.expire(now, time.Minute)
+
+	if sessions.get("idle") != nil {
+		t.Error("expected idle session to expire")
+	}
+	if sessions.get("active") == nil {
+		t.Error("expected active session to be kept")
+	}
+	if _, err := idleConn.Write([]byte("x")); err == nil {
+		t.Error("expected expired session's backend socket to be closed")
+	}
+}
+
+func TestInvalidUDPOptions(t *testing.T) {
+	_, err := CreateProxy(WithUDPSessionTimeout(0))
+	if err == nil || !strings.Contains(err.Error(), "udp session timeout must be positive") {
+		t.Errorf("expected udp session timeout error, got %v", err)
+	}
+
+	_, err = CreateProxy(WithUDP(true), WithSocks5Mode(true))
+	if err == nil || !strings.Contains(err.Error(), "udp mode cannot be combined") {
+		t.Errorf("expected udp mode combination error, got %v", err)
+	}
+}